@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	"net/url"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
 	"github.com/robfig/cron/v3"
 	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
 )
 
 func (svc *Service) listen(addr string) {
+	svc.router().Run(addr)
+}
+
+// router builds the http handler of the service.
+func (svc *Service) router() *gin.Engine {
 	r := gin.Default()
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
@@ -25,6 +34,12 @@ func (svc *Service) listen(addr string) {
 		c.Next()
 	})
 
+	// output feeds are read by other feed readers, the token in the url authenticates them
+	r.GET("/feeds/out/:file", svc.ServeOutputFeed)
+	// players can not send the authorization header, stream urls are signed instead
+	r.GET("/media/:enclosure_id", svc.StreamEnclosure)
+	r.HEAD("/media/:enclosure_id", svc.StreamEnclosure)
+
 	apiGroup := r.Group("/api")
 	apiGroup.POST("/login", svc.Login)
 	apiGroup.GET("/auth-status", svc.AuthStatus)
@@ -33,13 +48,73 @@ func (svc *Service) listen(addr string) {
 		apiGroup.GET("/feeds", svc.ListAllFeeds)
 		apiGroup.GET("/feed/all", svc.ListAllItems)
 		apiGroup.GET("/feed/:feed_id", svc.ListFeedItems)
+		apiGroup.GET("/feed/:feed_id/categories", svc.ListFeedCategories)
+		apiGroup.GET("/feed/:feed_id/icon", svc.GetFeedIcon)
 
 		apiGroup.POST("/feed", svc.AddFeed)
 		apiGroup.PUT("/feed/:feed_id", svc.UpdateFeed)
 		apiGroup.DELETE("/feed/:feed_id", svc.DeleteFeed)
 
+		apiGroup.POST("/smart-feed", svc.AddSmartFeed)
+		apiGroup.PUT("/smart-feed/:smart_feed_id", svc.UpdateSmartFeed)
+		apiGroup.DELETE("/smart-feed/:smart_feed_id", svc.DeleteSmartFeed)
+
+		apiGroup.GET("/output-feeds", svc.ListOutputFeeds)
+		apiGroup.POST("/output-feed", svc.AddOutputFeed)
+		apiGroup.PUT("/output-feed/:output_feed_id", svc.UpdateOutputFeed)
+		apiGroup.POST("/output-feed/:output_feed_id/token", svc.RotateOutputFeedToken)
+		apiGroup.DELETE("/output-feed/:output_feed_id", svc.DeleteOutputFeed)
+
+		apiGroup.GET("/folders", svc.ListFolders)
+		apiGroup.GET("/folder/:folder_id", svc.ListFolderItems)
+		apiGroup.POST("/folder", svc.AddFolder)
+		apiGroup.PUT("/folder/:folder_id", svc.UpdateFolder)
+		apiGroup.DELETE("/folder/:folder_id", svc.DeleteFolder)
+
+		apiGroup.GET("/opml", svc.ExportOPML)
+		apiGroup.POST("/opml", svc.ImportOPML)
+
+		apiGroup.GET("/tags", svc.ListTags)
+		apiGroup.PUT("/tags/order", svc.OrderTags)
+		apiGroup.PUT("/tag/:tag", svc.RenameTag)
+		apiGroup.PATCH("/tag/:tag", svc.UpdateTag)
+		apiGroup.POST("/tag/:tag/merge", svc.MergeTag)
+		apiGroup.DELETE("/tag/:tag", svc.DeleteTag)
+
+		apiGroup.GET("/labels", svc.ListLabels)
+
+		apiGroup.GET("/rules", svc.ListRules)
+		apiGroup.POST("/rule", svc.AddRule)
+		apiGroup.POST("/rule/test", svc.TestRule)
+		apiGroup.PUT("/rule/:rule_id", svc.UpdateRule)
+		apiGroup.DELETE("/rule/:rule_id", svc.DeleteRule)
+		apiGroup.POST("/rule/:rule_id/apply", svc.ApplyRule)
+
 		apiGroup.GET("/item/:item_id", svc.GetItem)
 		apiGroup.PATCH("/item/:item_id", svc.UpdateItem)
+		apiGroup.GET("/item/:item_id/cluster", svc.ListItemCluster)
+		apiGroup.GET("/item/:item_id/highlights", svc.ListItemHighlights)
+		apiGroup.POST("/item/:item_id/highlights", svc.AddHighlight)
+
+		apiGroup.GET("/downloads", svc.ListDownloads)
+		apiGroup.POST("/enclosure/:enclosure_id/download", svc.DownloadEnclosure)
+		apiGroup.DELETE("/enclosure/:enclosure_id/download", svc.DeleteEnclosureDownload)
+
+		apiGroup.GET("/highlights", svc.ListHighlights)
+		apiGroup.PATCH("/highlight/:highlight_id", svc.UpdateHighlight)
+		apiGroup.DELETE("/highlight/:highlight_id", svc.DeleteHighlight)
+
+		apiGroup.POST("/admin/purge", svc.PurgeItems)
+		apiGroup.POST("/admin/backup", svc.Backup)
+
+		apiGroup.GET("/export", svc.Export)
+		apiGroup.POST("/import", svc.Import)
+		apiGroup.POST("/import/starred", svc.ImportReaderExport)
+
+		apiGroup.GET("/2fa", svc.TwoFactorStatus)
+		apiGroup.POST("/2fa/setup", svc.SetupTwoFactor)
+		apiGroup.POST("/2fa/verify", svc.VerifyTwoFactor)
+		apiGroup.DELETE("/2fa", svc.DisableTwoFactor)
 	}
 
 	buildPath := "./web/build"
@@ -56,18 +131,26 @@ func (svc *Service) listen(addr string) {
 		c.File(indexPath)
 	})
 
-	r.Run(addr)
+	return r
 }
 
 func (svc *Service) AddFeed(c *gin.Context) {
 	ctx := c.Request.Context()
 
 	req := new(struct {
-		Url       string   `json:"url"`
-		Desc      string   `json:"desc"`
-		Cron      string   `json:"cron"`
-		Suspended bool     `json:"suspended"`
-		Tags      []string `json:"tags"`
+		Url         string   `json:"url"`
+		CustomTitle string   `json:"custom_title"`
+		Desc        string   `json:"desc"`
+		Cron        string   `json:"cron"`
+		Suspended   bool     `json:"suspended"`
+		Tags        []string `json:"tags"`
+		FolderID    string   `json:"folder_id"`
+
+		RetentionMaxItems int `json:"retention_max_items"`
+		RetentionMaxDays  int `json:"retention_max_days"`
+
+		DownloadEnclosures bool `json:"download_enclosures"`
+		DownloadQuotaMB    int  `json:"download_quota_mb"`
 	})
 	if err := c.BindJSON(req); err != nil {
 		logrus.WithError(err).Warn("invalid request")
@@ -81,16 +164,28 @@ func (svc *Service) AddFeed(c *gin.Context) {
 		logrus.WithError(err).Warn("invalid schedule spec")
 		c.JSON(400, gin.H{"error": "invalid schedule spec"})
 		return
+	} else if !svc.checkFolder(c, req.FolderID) {
+		return
 	}
 
 	id := Hash(req.Url)
+	customTitle := strings.TrimSpace(req.CustomTitle)
 	feed := &Feed{
-		ID:        id,
-		Link:      req.Url,
-		Desc:      req.Desc,
-		Cron:      req.Cron,
-		Suspended: req.Suspended,
-		Tags:      req.Tags,
+		ID:          id,
+		Title:       customTitle,
+		CustomTitle: customTitle,
+		Link:        req.Url,
+		Desc:        req.Desc,
+		Cron:        req.Cron,
+		Suspended:   req.Suspended,
+		Tags:        req.Tags,
+		FolderID:    req.FolderID,
+
+		RetentionMaxItems: req.RetentionMaxItems,
+		RetentionMaxDays:  req.RetentionMaxDays,
+
+		DownloadEnclosures: req.DownloadEnclosures,
+		DownloadQuotaMB:    req.DownloadQuotaMB,
 	}
 
 	if err := svc.db.SaveFeed(ctx, feed); err != nil {
@@ -102,6 +197,9 @@ func (svc *Service) AddFeed(c *gin.Context) {
 		svc.subscribe(feed)
 		if err := svc.fetch(ctx, feed.ID); err != nil {
 			logrus.WithField("feed_id", feed.ID).WithError(err).Error("fetch feed error")
+		} else if fetched, err := svc.db.GetFeed(ctx, feed.ID); err == nil {
+			// with the metadata of the fetch
+			feed = fetched
 		}
 	}
 
@@ -113,29 +211,61 @@ func (svc *Service) UpdateFeed(c *gin.Context) {
 	feedID := c.Param("feed_id")
 
 	req := new(struct {
-		Url       string   `json:"url"`
-		Desc      string   `json:"desc"`
-		Cron      string   `json:"cron"`
-		Tags      []string `json:"tags"`
-		Suspended bool     `json:"suspended"`
+		Url         string   `json:"url"`
+		CustomTitle *string  `json:"custom_title"` // 为空时恢复上游标题，不传则保持不变
+		Desc        string   `json:"desc"`
+		Cron        string   `json:"cron"`
+		Tags        []string `json:"tags"`
+		FolderID    *string  `json:"folder_id"` // 为空时移到根目录，不传则保持不变
+		Suspended   bool     `json:"suspended"`
+
+		RetentionMaxItems *int `json:"retention_max_items"` // 不传则保持不变
+		RetentionMaxDays  *int `json:"retention_max_days"`
+
+		DownloadEnclosures *bool `json:"download_enclosures"` // 不传则保持不变
+		DownloadQuotaMB    *int  `json:"download_quota_mb"`
 	})
 	if err := c.BindJSON(req); err != nil {
 		logrus.WithError(err).Warn("invalid request")
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
+	} else if req.FolderID != nil && !svc.checkFolder(c, *req.FolderID) {
+		return
 	}
 
 	feed, err := svc.db.GetFeed(ctx, feedID)
-	if err != nil {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "feed not found"})
+		return
+	} else if err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
 	feed.Link = req.Url
+	if req.CustomTitle != nil {
+		feed.CustomTitle = strings.TrimSpace(*req.CustomTitle)
+		feed.Title = lo.CoalesceOrEmpty(feed.CustomTitle, feed.UpstreamTitle)
+	}
 	feed.Desc = req.Desc
 	feed.Cron = req.Cron
 	feed.Tags = req.Tags
+	if req.FolderID != nil {
+		feed.FolderID = *req.FolderID
+	}
 	feed.Suspended = req.Suspended
+	if req.RetentionMaxItems != nil {
+		feed.RetentionMaxItems = *req.RetentionMaxItems
+	}
+	if req.RetentionMaxDays != nil {
+		feed.RetentionMaxDays = *req.RetentionMaxDays
+	}
+	if req.DownloadEnclosures != nil {
+		feed.DownloadEnclosures = *req.DownloadEnclosures
+	}
+	if req.DownloadQuotaMB != nil {
+		feed.DownloadQuotaMB = *req.DownloadQuotaMB
+	}
 
 	if err := svc.db.SaveFeed(ctx, feed); err != nil {
 		c.JSON(500, gin.H{"error": err.Error()})
@@ -161,6 +291,12 @@ func (svc *Service) DeleteFeed(c *gin.Context) {
 	}
 
 	svc.unsubscribe(feedID)
+	if err := svc.pruneDownloads(ctx); err != nil {
+		logrus.WithError(err).WithField("feed_id", feedID).Error("prune downloads error")
+	}
+	if err := removeIcon(feedID); err != nil {
+		logrus.WithError(err).WithField("feed_id", feedID).Error("remove feed icon error")
+	}
 
 	c.JSON(200, gin.H{"success": true})
 }
@@ -180,7 +316,19 @@ func (svc *Service) ListAllFeeds(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, gin.H{"feeds": feeds, "tags": tags})
+	folders, err := svc.db.ListFolders(ctx)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	smartFeeds, err := svc.listSmartFeeds(ctx)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"feeds": feeds, "tags": tags, "folders": folderTree(folders, feeds), "smart_feeds": smartFeeds})
 }
 
 func (svc *Service) ListAllItems(c *gin.Context) {
@@ -194,7 +342,7 @@ func (svc *Service) ListAllItems(c *gin.Context) {
 	}
 
 	feeds := lo.Map(feedsResult, func(feed *ListFeedResult, _ int) *Feed { return feed.Feed })
-	svc.listItems(c, feeds...)
+	svc.listItems(c, &ItemFilter{FeedIDs: lo.Map(feeds, func(feed *Feed, _ int) string { return feed.ID })}, feeds)
 }
 
 func (svc *Service) ListFeedItems(c *gin.Context) {
@@ -202,17 +350,26 @@ func (svc *Service) ListFeedItems(c *gin.Context) {
 	feedID := c.Param("feed_id")
 	log := logrus.WithField("feed_id", feedID)
 
+	if strings.HasPrefix(feedID, smartFeedPrefix) {
+		svc.listSmartFeedItems(c, feedID)
+		return
+	}
+
 	feed, err := svc.db.GetFeed(ctx, feedID)
-	if err != nil {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "feed not found"})
+		return
+	} else if err != nil {
 		log.WithError(err).Error("get feed error")
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
 
-	svc.listItems(c, feed)
+	svc.listItems(c, &ItemFilter{FeedIDs: []string{feed.ID}}, []*Feed{feed})
 }
 
-func (svc *Service) listItems(c *gin.Context, feeds ...*Feed) {
+// listItems 按查询参数分页列出 filter 范围内的文章，refresh=true 时先抓取 feeds
+func (svc *Service) listItems(c *gin.Context, filter *ItemFilter, feeds []*Feed) {
 	ctx := c.Request.Context()
 	unread := c.Query("unread") == "true"
 	today := c.Query("today") == "true"
@@ -229,17 +386,6 @@ func (svc *Service) listItems(c *gin.Context, feeds ...*Feed) {
 		}
 	}
 
-	filter := &ItemFilter{
-		FeedIDs: lo.Map(feeds, func(feed *Feed, _ int) string { return feed.ID }),
-	}
-
-	page, err := strconv.Atoi(c.Query("page"))
-	if err != nil {
-		page = 1
-	}
-	if page < 1 {
-		page = 1
-	}
 	size, err := strconv.Atoi(c.Query("size"))
 	if err != nil {
 		size = 10
@@ -247,9 +393,44 @@ func (svc *Service) listItems(c *gin.Context, feeds ...*Feed) {
 	if size < 1 {
 		size = 10
 	}
-	offset := (page - 1) * size
-	filter.Limit = &size
-	filter.Offset = &offset
+
+	// filter 可能已带有排序（如智能订阅），未指定 sort 参数时保留
+	if sort := c.Query("sort"); sort != "" || filter.Sort == "" {
+		if filter.Sort, err = ParseItemSort(sort); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// cursor 存在时使用 keyset 分页，否则兼容旧的 page/size 分页
+	cursor, cursorMode := c.GetQuery("cursor")
+	if cursorMode {
+		if !filter.Sort.Keyset() {
+			c.JSON(400, gin.H{"error": "cursor pagination is not supported with sort " + string(filter.Sort)})
+			return
+		}
+		if cursor != "" {
+			if filter.Cursor, err = decodeCursor(cursor); err != nil || filter.Cursor.Sort != filter.Sort {
+				c.JSON(400, gin.H{"error": "invalid cursor"})
+				return
+			}
+		}
+		limit := size + 1 // one more to know whether there is a next page
+		filter.Limit = &limit
+	} else {
+		page, err := strconv.Atoi(c.Query("page"))
+		if err != nil {
+			page = 1
+		}
+		if page < 1 {
+			page = 1
+		}
+		offset := (page - 1) * size
+		filter.Limit = &size
+		filter.Offset = &offset
+	}
+	// 总数需要额外的查询，cursor 模式默认不返回
+	withTotal := c.DefaultQuery("count", strconv.FormatBool(!cursorMode)) == "true"
 
 	if unread {
 		filter.Unread = &unread
@@ -265,14 +446,32 @@ func (svc *Service) listItems(c *gin.Context, feeds ...*Feed) {
 		todayTime := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()).UTC()
 		filter.PubDate = &todayTime
 	}
-	if query != "" {
-		filter.SearchQuery = &query
+	if err := ParseQuery(query, filter, time.Now()); err != nil {
+		var queryErr *QueryError
+		if errors.As(err, &queryErr) {
+			c.JSON(400, gin.H{"error": err.Error(), "position": queryErr.Pos})
+			return
+		}
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if labels := c.QueryArray("labels"); len(labels) > 0 {
+		filter.Labels = labels
+	}
+	filter.Authors = append(filter.Authors, c.QueryArray("authors")...)
+	filter.Categories = append(filter.Categories, c.QueryArray("categories")...)
+	if c.Query("collapse") == "true" {
+		filter.Collapse = true
 	}
 
-	total, err := svc.db.CountItems(ctx, filter)
-	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
-		return
+	pagination := gin.H{"size": size}
+	if withTotal {
+		total, err := svc.db.CountItems(ctx, filter)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		pagination["total"] = total
 	}
 
 	// 获取分页数据
@@ -282,14 +481,20 @@ func (svc *Service) listItems(c *gin.Context, feeds ...*Feed) {
 		return
 	}
 
-	c.JSON(200, gin.H{
-		"items": items,
-		"pagination": gin.H{
-			"total": total,
-			"page":  getPageFromOffset(filter.Offset, filter.Limit),
-			"size":  getPageSize(filter.Limit),
-		},
-	})
+	signEnclosures(items...)
+
+	if !cursorMode {
+		pagination["page"] = getPageFromOffset(filter.Offset, filter.Limit)
+		c.JSON(200, gin.H{"items": items, "pagination": pagination})
+		return
+	}
+
+	var nextCursor *string
+	if len(items) > size {
+		items = items[:size]
+		nextCursor = lo.ToPtr(encodeCursor(items[size-1], filter.Sort))
+	}
+	c.JSON(200, gin.H{"items": items, "next_cursor": nextCursor, "pagination": pagination})
 }
 
 func (svc *Service) GetItem(c *gin.Context) {
@@ -303,11 +508,15 @@ func (svc *Service) GetItem(c *gin.Context) {
 	log := logrus.WithField("item_id", itemID)
 
 	item, err := svc.db.GetItem(ctx, itemID)
-	if err != nil {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "item not found"})
+		return
+	} else if err != nil {
 		log.WithError(err).Error("get item error")
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
+	signEnclosures(item)
 
 	c.JSON(200, gin.H{"item": item})
 }
@@ -323,9 +532,14 @@ func (svc *Service) UpdateItem(c *gin.Context) {
 	log := logrus.WithField("item_id", itemID)
 
 	req := new(struct {
-		Read    *bool `json:"read,omitempty"`
-		Starred *bool `json:"starred,omitempty"`
-		Liked   *bool `json:"liked,omitempty"`
+		Read    *bool     `json:"read,omitempty"`
+		Starred *bool     `json:"starred,omitempty"`
+		Liked   *bool     `json:"liked,omitempty"`
+		Note    *string   `json:"note,omitempty"`
+		Labels  *[]string `json:"labels,omitempty"`  // 替换文章的全部标签
+		Cluster bool      `json:"cluster,omitempty"` // 已读状态同步到同一簇的重复文章
+
+		Position *int `json:"position,omitempty"` // 播放进度，单位秒
 	})
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -333,12 +547,28 @@ func (svc *Service) UpdateItem(c *gin.Context) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Position != nil && *req.Position < 0 {
+		c.JSON(400, gin.H{"error": "position must not be negative"})
+		return
+	}
+	if req.Labels != nil {
+		labels := lo.Map(*req.Labels, func(label string, _ int) string { return strings.TrimSpace(label) })
+		req.Labels = &labels
+	}
 
-	if err := svc.db.UpdateItem(ctx, itemID, req.Read, req.Starred, req.Liked); err != nil {
+	update := &ItemUpdate{Read: req.Read, Starred: req.Starred, Liked: req.Liked, Note: req.Note, Labels: req.Labels, Position: req.Position}
+	if err := svc.db.UpdateItem(ctx, itemID, update); err != nil {
 		log.WithError(err).Error("update item error")
 		c.JSON(500, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Cluster && req.Read != nil {
+		if err := svc.markClusterRead(ctx, itemID, *req.Read); err != nil {
+			log.WithError(err).Error("mark cluster read error")
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
 
 	c.JSON(200, gin.H{"success": true})
 }
@@ -346,6 +576,11 @@ func (svc *Service) UpdateItem(c *gin.Context) {
 // authMiddleware 是一个Gin中间件，用于验证请求中的JWT令牌
 func (svc *Service) authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if authConfig.ProxyHeader != "" {
+			svc.proxyAuth(c)
+			return
+		}
+
 		if !authConfig.Enabled {
 			// 如果认证未启用，直接放行所有请求
 			c.Next()
@@ -377,11 +612,63 @@ func (svc *Service) authMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		c.Set("user", defaultUser)
 		c.Next()
 	}
 }
 
+// proxyAuth 信任反向代理传入的用户头，仅接受来自可信代理的请求
+func (svc *Service) proxyAuth(c *gin.Context) {
+	if !isTrustedProxy(c.Request) {
+		logrus.WithField("remote_addr", c.Request.RemoteAddr).Warn("request from untrusted proxy")
+		c.JSON(403, gin.H{"error": "untrusted proxy"})
+		c.Abort()
+		return
+	}
+
+	name := strings.TrimSpace(c.GetHeader(authConfig.ProxyHeader))
+	if name == "" {
+		c.JSON(401, gin.H{"error": "authorization required"})
+		c.Abort()
+		return
+	}
+
+	if err := svc.ensureUser(c.Request.Context(), name); err != nil {
+		logrus.WithField("user", name).WithError(err).Error("provision user error")
+		c.JSON(500, gin.H{"error": err.Error()})
+		c.Abort()
+		return
+	}
+
+	c.Set("user", name)
+	c.Next()
+}
+
+// ensureUser creates the user on first sight.
+func (svc *Service) ensureUser(ctx context.Context, name string) error {
+	if _, ok := svc.users.Load(name); ok {
+		return nil
+	}
+
+	_, err := svc.db.GetUser(ctx, name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		logrus.WithField("user", name).Info("create user")
+		err = svc.db.SaveUser(ctx, &User{Name: name})
+	}
+	if err != nil {
+		return err
+	}
+
+	svc.users.Store(name, struct{}{})
+	return nil
+}
+
 func (svc *Service) Login(c *gin.Context) {
+	if authConfig.ProxyHeader != "" {
+		c.JSON(400, gin.H{"error": "login is handled by the reverse proxy"})
+		return
+	}
+
 	// 如果认证未启用，直接返回成功
 	if !authConfig.Enabled {
 		c.JSON(200, gin.H{"token": "", "auth_required": false})
@@ -390,6 +677,7 @@ func (svc *Service) Login(c *gin.Context) {
 
 	req := new(struct {
 		Password string `json:"password"`
+		OTP      string `json:"otp"` // TOTP 验证码或恢复码
 	})
 	if err := c.BindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": "invalid request"})
@@ -402,6 +690,28 @@ func (svc *Service) Login(c *gin.Context) {
 		return
 	}
 
+	// 开启 2FA 后需要第二因素
+	user, err := svc.db.GetUser(c.Request.Context(), defaultUser)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		logrus.WithError(err).Error("get user error")
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err == nil && user.TOTPEnabled {
+		if req.OTP == "" {
+			c.JSON(401, gin.H{"error": "second factor required", "otp_required": true})
+			return
+		}
+		if valid, err := svc.checkSecondFactor(c.Request.Context(), user, req.OTP); err != nil {
+			logrus.WithError(err).Error("check second factor error")
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		} else if !valid {
+			c.JSON(401, gin.H{"error": "invalid code", "otp_required": true})
+			return
+		}
+	}
+
 	// 生成JWT令牌
 	token, err := generateToken()
 	if err != nil {
@@ -415,5 +725,10 @@ func (svc *Service) Login(c *gin.Context) {
 
 // AuthStatus 返回当前的认证状态
 func (svc *Service) AuthStatus(c *gin.Context) {
+	if authConfig.ProxyHeader != "" {
+		// 由反向代理完成登录，前端无需展示登录页
+		c.JSON(200, gin.H{"auth_required": false, "auth_mode": "proxy"})
+		return
+	}
 	c.JSON(200, gin.H{"auth_required": authConfig.Enabled})
 }
@@ -0,0 +1,1168 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp/totp"
+	"github.com/samber/lo"
+)
+
+// testAPI is the http handler of a service backed by a MemoryDB seeded with seedDB.
+type testAPI struct {
+	*Service
+	handler http.Handler
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	downloadConfig.Dir = t.TempDir()
+	iconConfig.Dir = t.TempDir()
+	backupConfig.Dir = t.TempDir()
+	setAuth(t, false, "")
+
+	db := NewMemoryDB()
+	seedDB(t, context.Background(), db)
+	svc := newService(db)
+	return &testAPI{Service: svc, handler: svc.router()}
+}
+
+// setAuth configures password or, when proxyHeader is set, reverse-proxy authentication
+// for the test. The password is "secret" and the trusted proxy is the default RemoteAddr of httptest.
+func setAuth(t *testing.T, enabled bool, proxyHeader string) {
+	saved := authConfig
+	t.Cleanup(func() { authConfig = saved })
+
+	hash := sha256.Sum256([]byte("secret"))
+	authConfig.Enabled = enabled
+	authConfig.JwtSecret = []byte("test secret")
+	authConfig.PwdHash = hex.EncodeToString(hash[:])
+	authConfig.ProxyHeader = proxyHeader
+	authConfig.TrustedProxies = []*net.IPNet{{IP: net.IPv4(192, 0, 2, 0), Mask: net.CIDRMask(24, 32)}}
+}
+
+// do sends a request, body is sent as JSON unless it is a string, header holds name/value pairs.
+func (api *testAPI) do(t *testing.T, method, target string, body any, header ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var r io.Reader
+	switch body := body.(type) {
+	case nil:
+	case string:
+		r = strings.NewReader(body)
+	default:
+		data, err := json.Marshal(body)
+		check(t, err)
+		r = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, target, r)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return api.send(req)
+}
+
+// upload posts data as the file field of a multipart form.
+func (api *testAPI) upload(t *testing.T, target, filename string, data []byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	f, err := form.CreateFormFile("file", filename)
+	check(t, err)
+	_, err = f.Write(data)
+	check(t, err)
+	check(t, form.Close())
+
+	req := httptest.NewRequest(http.MethodPost, target, &buf)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return api.send(req)
+}
+
+func (api *testAPI) send(req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	api.handler.ServeHTTP(w, req)
+	return w
+}
+
+func decode[T any](t *testing.T, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decode %q: %v", w.Body, err)
+	}
+	return v
+}
+
+func status(t *testing.T, w *httptest.ResponseRecorder, code int) {
+	t.Helper()
+	if w.Code != code {
+		t.Fatalf("got status %d, want %d: %s", w.Code, code, w.Body)
+	}
+}
+
+type itemsResponse struct {
+	Items      []*Item `json:"items"`
+	NextCursor *string `json:"next_cursor"`
+	Pagination struct {
+		Size  int    `json:"size"`
+		Page  int    `json:"page"`
+		Total *int64 `json:"total"`
+	} `json:"pagination"`
+}
+
+type errorResponse struct {
+	Error    string `json:"error"`
+	Position *int   `json:"position"`
+}
+
+var (
+	starRule = gin.H{
+		"name":       "star go",
+		"conditions": []RuleCondition{{Field: "title", Op: "contains", Value: "go"}},
+		"actions":    []RuleAction{{Type: "star"}},
+	}
+	minifluxExport = `{"entries": [{"title": "Saved", "url": "https://saved.example.com/1", "status": "read", "starred": true,
+		"feed": {"title": "Saved", "feed_url": "https://saved.example.com/feed", "category": {"title": "Later"}}}]}`
+	opmlExport = `<opml version="2.0"><body>
+		<outline text="Reading"><outline text="Blog" xmlUrl="https://blog.example.com/feed" category="tech"/></outline>
+		<outline text="Alpha" xmlUrl="https://example.com/feed"/>
+	</body></opml>`
+)
+
+// apiTests run each against a new seeded service with authentication disabled.
+// When err is set, it is the expected error of the response.
+var apiTests = []struct {
+	name   string
+	setup  func(t *testing.T, ctx context.Context, db DB)
+	method string
+	path   string
+	body   any
+	code   int
+	err    string
+	check  func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder)
+}{
+	// feeds
+	{name: "list feeds", method: "GET", path: "/api/feeds", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		resp := decode[struct {
+			Feeds      []*ListFeedResult `json:"feeds"`
+			Tags       []*ListTagResult  `json:"tags"`
+			Folders    []map[string]any  `json:"folders"`
+			SmartFeeds []map[string]any  `json:"smart_feeds"`
+		}](t, w)
+		equal(t, len(resp.Feeds), 2)
+		equal(t, len(resp.Tags), 3)
+		equal(t, len(resp.Folders), 1)
+		equal(t, len(resp.SmartFeeds), 0)
+	}},
+	{name: "list feeds with smart feeds", method: "GET", path: "/api/feeds", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveSmartFeed(ctx, &SmartFeed{ID: "smart-go", Name: "Go", Query: "go"}))
+			check(t, db.SaveSmartFeed(ctx, &SmartFeed{ID: "smart-read", Name: "Read", Position: 1, Query: "is:read"}))
+			check(t, db.UpdateItem(ctx, "a2", &ItemUpdate{Read: lo.ToPtr(true)}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			smartFeeds := decode[struct {
+				SmartFeeds []*ListSmartFeedResult `json:"smart_feeds"`
+			}](t, w).SmartFeeds
+			counts := lo.Map(smartFeeds, func(f *ListSmartFeedResult, _ int) int64 { return f.UnreadCount })
+			// read items are not counted as unread
+			equal(t, counts, []int64{2, 0})
+		}},
+	{name: "list all items", method: "GET", path: "/api/feed/all", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		resp := decode[itemsResponse](t, w)
+		equal(t, ids(resp.Items), []string{"a3", "a1", "a2", "b1", "b2"})
+		equal(t, resp.Pagination.Page, 1)
+		equal(t, lo.FromPtr(resp.Pagination.Total), 5)
+	}},
+	{name: "list items by tag", method: "GET", path: "/api/feed/all?tags=news&size=1&page=2", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		resp := decode[itemsResponse](t, w)
+		equal(t, ids(resp.Items), []string{"b2"})
+		equal(t, resp.Pagination.Page, 2)
+		equal(t, lo.FromPtr(resp.Pagination.Total), 2)
+	}},
+	{name: "search items", method: "GET", path: "/api/feed/all?q=release+feed:alpha", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		equal(t, ids(decode[itemsResponse](t, w).Items), []string{"a1"})
+	}},
+	{name: "invalid query", method: "GET", path: "/api/feed/all?q=%22go", code: 400, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		equal(t, lo.FromPtr(decode[errorResponse](t, w).Position), 0)
+	}},
+	{name: "invalid sort", method: "GET", path: "/api/feed/all?sort=title", code: 400, err: `invalid sort: "title"`},
+	{name: "cursor pagination", method: "GET", path: "/api/feed/all?size=2&cursor=", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		var got []string
+		for page := decode[itemsResponse](t, w); ; {
+			equal(t, page.Pagination.Total, nil)
+			got = append(got, ids(page.Items)...)
+			if page.NextCursor == nil {
+				break
+			}
+			w := api.do(t, "GET", "/api/feed/all?size=2&cursor="+*page.NextCursor, nil)
+			status(t, w, 200)
+			page = decode[itemsResponse](t, w)
+		}
+		equal(t, got, []string{"a3", "a1", "a2", "b1", "b2"})
+	}},
+	{name: "cursor with unsupported sort", method: "GET", path: "/api/feed/all?sort=feed&cursor=", code: 400, err: "cursor pagination is not supported with sort feed"},
+	{name: "invalid cursor", method: "GET", path: "/api/feed/all?cursor=garbage", code: 400, err: "invalid cursor"},
+	{name: "list feed items", method: "GET", path: "/api/feed/a?unread=true", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		equal(t, ids(decode[itemsResponse](t, w).Items), []string{"a3", "a1", "a2"})
+	}},
+	{name: "list items of missing feed", method: "GET", path: "/api/feed/missing", code: 404, err: "feed not found"},
+	{name: "list smart feed items", method: "GET", path: "/api/feed/smart-go", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveSmartFeed(ctx, &SmartFeed{ID: "smart-go", Name: "Go", Query: "go", Sort: SortOldest}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			equal(t, ids(decode[itemsResponse](t, w).Items), []string{"b1", "a1"})
+		}},
+	{name: "list items of missing smart feed", method: "GET", path: "/api/feed/smart-missing", code: 404, err: "smart feed not found"},
+	{name: "feed categories", method: "GET", path: "/api/feed/a/categories?limit=1", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		resp := decode[struct {
+			Categories []*ListCategoryResult `json:"categories"`
+		}](t, w)
+		equal(t, len(resp.Categories), 1)
+		equal(t, resp.Categories[0].TotalCount, 2)
+	}},
+	{name: "feed categories with invalid limit", method: "GET", path: "/api/feed/a/categories?limit=0", code: 400, err: "limit must be between 1 and 100"},
+	{name: "categories of missing feed", method: "GET", path: "/api/feed/missing/categories", code: 404, err: "feed not found"},
+	{name: "feed icon", method: "GET", path: "/api/feed/a/icon", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			feed, err := db.GetFeed(ctx, "a")
+			check(t, err)
+			feed.IconPath, feed.IconType, feed.IconUpdatedAt = iconPath("a"), "image/png", lo.ToPtr(testBase)
+			check(t, os.WriteFile(feed.IconPath, []byte("png"), 0o644))
+			check(t, db.SaveFeed(ctx, feed))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			equal(t, w.Header().Get("Content-Type"), "image/png")
+			equal(t, w.Header().Get("X-Content-Type-Options"), "nosniff")
+			equal(t, w.Body.String(), "png")
+		}},
+	{name: "feed without icon", method: "GET", path: "/api/feed/a/icon", code: 404, err: "feed has no icon"},
+	{name: "icon of missing feed", method: "GET", path: "/api/feed/missing/icon", code: 404, err: "feed not found"},
+	{name: "add feed", method: "POST", path: "/api/feed", code: 200,
+		body: gin.H{"url": "https://example.org/feed", "custom_title": " Mine ", "cron": "*/30 * * * *", "suspended": true, "tags": []string{"go"}, "folder_id": "dev", "download_quota_mb": 10},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			feed := decode[struct {
+				Feed *Feed `json:"feed"`
+			}](t, w).Feed
+			equal(t, feed.ID, Hash("https://example.org/feed"))
+			equal(t, feed.Title, "Mine")
+			stored, err := api.db.GetFeed(context.Background(), feed.ID)
+			check(t, err)
+			equal(t, []any{stored.Link, stored.Tags, stored.Suspended, stored.FolderID, stored.DownloadQuotaMB}, []any{"https://example.org/feed", []string{"go"}, true, "dev", 10})
+		}},
+	{name: "add feed with invalid json", method: "POST", path: "/api/feed", body: "{", code: 400},
+	{name: "add feed with invalid url", method: "POST", path: "/api/feed", body: gin.H{"url": "ftp://example.org/feed", "cron": "@hourly"}, code: 400, err: "invalid feed url schema"},
+	{name: "add feed with invalid cron", method: "POST", path: "/api/feed", body: gin.H{"url": "https://example.org/feed", "cron": "hourly"}, code: 400, err: "invalid schedule spec"},
+	{name: "add feed to missing folder", method: "POST", path: "/api/feed", body: gin.H{"url": "https://example.org/feed", "cron": "@hourly", "folder_id": "missing"}, code: 400, err: "folder not found"},
+	{name: "update feed", method: "PUT", path: "/api/feed/a", code: 200,
+		body: gin.H{"url": "https://example.com/feed.xml", "custom_title": "Renamed", "cron": "@hourly", "tags": []string{"x"}, "suspended": true},
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			feed, err := db.GetFeed(ctx, "a")
+			check(t, err)
+			feed.RetentionMaxItems, feed.DownloadQuotaMB = 5, 10
+			check(t, db.SaveFeed(ctx, feed))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			feed, err := api.db.GetFeed(context.Background(), "a")
+			check(t, err)
+			equal(t, []any{feed.Title, feed.Link, feed.Tags, feed.Suspended}, []any{"Renamed", "https://example.com/feed.xml", []string{"x"}, true})
+			// left out, so kept
+			equal(t, []any{feed.RetentionMaxItems, feed.FolderID, feed.DownloadQuotaMB}, []any{5, "dev", 10})
+		}},
+	{name: "update feed with invalid json", method: "PUT", path: "/api/feed/a", body: "[]", code: 400},
+	{name: "update feed to missing folder", method: "PUT", path: "/api/feed/a", body: gin.H{"folder_id": "missing"}, code: 400, err: "folder not found"},
+	{name: "update missing feed", method: "PUT", path: "/api/feed/missing", body: gin.H{"url": "https://example.org/feed"}, code: 404, err: "feed not found"},
+	{name: "delete feed", method: "DELETE", path: "/api/feed/a", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		_, err := api.db.GetFeed(context.Background(), "a")
+		notFound(t, err)
+		_, err = api.db.GetItem(context.Background(), "a1")
+		notFound(t, err)
+	}},
+
+	// rules
+	{name: "list rules", method: "GET", path: "/api/rules", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveRule(ctx, &Rule{ID: "r1", Name: "Rule", Enabled: true}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			rules := decode[struct {
+				Rules []*Rule `json:"rules"`
+			}](t, w).Rules
+			equal(t, len(rules), 1)
+		}},
+	{name: "add rule", method: "POST", path: "/api/rule", body: starRule, code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		rule := decode[struct {
+			Rule *Rule `json:"rule"`
+		}](t, w).Rule
+		stored, err := api.db.GetRule(context.Background(), rule.ID)
+		check(t, err)
+		equal(t, []any{stored.Name, stored.Enabled}, []any{"star go", true})
+	}},
+	{name: "add rule without condition", method: "POST", path: "/api/rule", body: gin.H{"actions": []RuleAction{{Type: "star"}}}, code: 400, err: "rule has no condition"},
+	{name: "add rule with invalid action", method: "POST", path: "/api/rule", body: gin.H{"conditions": starRule["conditions"], "actions": []RuleAction{{Type: "fly"}}}, code: 400, err: `invalid action "fly"`},
+	{name: "test rule", method: "POST", path: "/api/rule/test?limit=1", body: starRule, code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		resp := decode[struct {
+			Matched int     `json:"matched"`
+			Items   []*Item `json:"items"`
+		}](t, w)
+		equal(t, resp.Matched, 2)
+		equal(t, len(resp.Items), 1)
+		// nothing is applied
+		item, err := api.db.GetItem(context.Background(), "a1")
+		check(t, err)
+		equal(t, item.Starred, false)
+	}},
+	{name: "test invalid rule", method: "POST", path: "/api/rule/test", body: gin.H{"match": "some"}, code: 400, err: `invalid match "some"`},
+	{name: "update rule", method: "PUT", path: "/api/rule/r1", body: lo.Assign(starRule, gin.H{"enabled": false}), code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveRule(ctx, &Rule{ID: "r1", Name: "Rule", Enabled: true}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			rule, err := api.db.GetRule(context.Background(), "r1")
+			check(t, err)
+			equal(t, []any{rule.Name, rule.Enabled, len(rule.Actions)}, []any{"star go", false, 1})
+		}},
+	{name: "update rule with invalid rule", method: "PUT", path: "/api/rule/r1", body: gin.H{"name": "Rule"}, code: 400,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveRule(ctx, &Rule{ID: "r1", Name: "Rule", Enabled: true}))
+		}},
+	{name: "update missing rule", method: "PUT", path: "/api/rule/missing", body: starRule, code: 404, err: "rule not found"},
+	{name: "delete rule", method: "DELETE", path: "/api/rule/r1", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveRule(ctx, &Rule{ID: "r1", Name: "Rule"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			_, err := api.db.GetRule(context.Background(), "r1")
+			notFound(t, err)
+		}},
+	{name: "delete missing rule", method: "DELETE", path: "/api/rule/missing", code: 404, err: "rule not found"},
+	{name: "apply rule", method: "POST", path: "/api/rule/r1/apply", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveRule(ctx, &Rule{ID: "r1", Name: "Rule", Enabled: true, FeedIDs: []string{"a"},
+				Conditions: []RuleCondition{{Field: "title", Op: "contains", Value: "go"}}, Actions: []RuleAction{{Type: "star"}}}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			result := decode[struct {
+				Result *RuleApplyResult `json:"result"`
+			}](t, w).Result
+			equal(t, *result, RuleApplyResult{Matched: 1, Updated: 1})
+			item, err := api.db.GetItem(context.Background(), "a1")
+			check(t, err)
+			equal(t, item.Starred, true)
+		}},
+	{name: "apply invalid rule", method: "POST", path: "/api/rule/r1/apply", code: 400, err: "rule has no condition",
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveRule(ctx, &Rule{ID: "r1", Name: "Rule", Actions: []RuleAction{{Type: "star"}}}))
+		}},
+	{name: "apply missing rule", method: "POST", path: "/api/rule/missing/apply", code: 404, err: "rule not found"},
+
+	// items
+	{name: "get item", method: "GET", path: "/api/item/a1", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		item := decode[struct {
+			Item *Item `json:"item"`
+		}](t, w).Item
+		equal(t, item.Title, "Go release")
+		equal(t, len(item.Enclosures), 2)
+		equal(t, strings.HasPrefix(item.Enclosures[0].StreamURL, "/media/e1?expires="), true)
+	}},
+	{name: "get missing item", method: "GET", path: "/api/item/missing", code: 404, err: "item not found"},
+	{name: "update item", method: "PATCH", path: "/api/item/a1", body: gin.H{"read": true, "starred": true, "note": "note", "labels": []string{" later "}, "position": 30}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			item, err := api.db.GetItem(context.Background(), "a1")
+			check(t, err)
+			equal(t, []any{item.Read, item.Starred, item.Liked, item.Note, item.Labels, item.Position}, []any{true, true, false, "note", []string{"later"}, 30})
+			// not the other items of the cluster
+			item, err = api.db.GetItem(context.Background(), "b1")
+			check(t, err)
+			equal(t, item.Read, false)
+		}},
+	{name: "mark cluster read", method: "PATCH", path: "/api/item/a1", body: gin.H{"read": true, "cluster": true}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			item, err := api.db.GetItem(context.Background(), "b1")
+			check(t, err)
+			equal(t, item.Read, true)
+		}},
+	{name: "update item with negative position", method: "PATCH", path: "/api/item/a1", body: gin.H{"position": -1}, code: 400, err: "position must not be negative"},
+	{name: "update item with invalid json", method: "PATCH", path: "/api/item/a1", body: `{"read": "yes"}`, code: 400},
+	{name: "list item cluster", method: "GET", path: "/api/item/b1/cluster", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		resp := decode[struct {
+			ClusterID string  `json:"cluster_id"`
+			Items     []*Item `json:"items"`
+		}](t, w)
+		equal(t, resp.ClusterID, "a1")
+		equal(t, ids(resp.Items), []string{"b1", "a1"})
+	}},
+	{name: "list cluster of missing item", method: "GET", path: "/api/item/missing/cluster", code: 404, err: "item not found"},
+	{name: "list item highlights", method: "GET", path: "/api/item/a1/highlights", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveHighlight(ctx, &Highlight{ID: "h1", ItemID: "a1", Quote: "notes"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			highlights := decode[struct {
+				Highlights []*Highlight `json:"highlights"`
+			}](t, w).Highlights
+			equal(t, len(highlights), 1)
+			// anchored in the item text
+			equal(t, []int{highlights[0].Start, highlights[0].End}, []int{8, 13})
+		}},
+	{name: "list highlights of missing item", method: "GET", path: "/api/item/missing/highlights", code: 404, err: "item not found"},
+	{name: "add highlight", method: "POST", path: "/api/item/a1/highlights", body: gin.H{"start": 0, "end": 7, "comment": "why"}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			highlight := decode[struct {
+				Highlight *Highlight `json:"highlight"`
+			}](t, w).Highlight
+			equal(t, []string{highlight.Quote, highlight.Prefix, highlight.Suffix, highlight.Comment}, []string{"release", "", " notes", "why"})
+			_, err := api.db.GetHighlight(context.Background(), highlight.ID)
+			check(t, err)
+		}},
+	{name: "add highlight not in item", method: "POST", path: "/api/item/a1/highlights", body: gin.H{"quote": "missing"}, code: 400, err: "quote not found in item"},
+	{name: "add highlight to missing item", method: "POST", path: "/api/item/missing/highlights", body: gin.H{"quote": "notes"}, code: 404, err: "item not found"},
+
+	// smart feeds
+	{name: "add smart feed", method: "POST", path: "/api/smart-feed", body: gin.H{"name": " Go ", "query": "go is:unread", "tags": []string{"tech"}, "days": 7}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			smartFeed := decode[struct {
+				SmartFeed *SmartFeed `json:"smart_feed"`
+			}](t, w).SmartFeed
+			equal(t, strings.HasPrefix(smartFeed.ID, smartFeedPrefix), true)
+			equal(t, []any{smartFeed.Name, smartFeed.Sort, smartFeed.Days}, []any{"Go", SortNewest, 7})
+			_, err := api.db.GetSmartFeed(context.Background(), smartFeed.ID)
+			check(t, err)
+		}},
+	{name: "add smart feed without name", method: "POST", path: "/api/smart-feed", body: gin.H{"name": " "}, code: 400, err: "name required"},
+	{name: "add smart feed with invalid sort", method: "POST", path: "/api/smart-feed", body: gin.H{"name": "Go", "sort": "title"}, code: 400, err: `invalid sort: "title"`},
+	{name: "add smart feed with negative days", method: "POST", path: "/api/smart-feed", body: gin.H{"name": "Go", "days": -1}, code: 400, err: "days must not be negative"},
+	{name: "add smart feed with invalid query", method: "POST", path: "/api/smart-feed", body: gin.H{"name": "Go", "query": "is:"}, code: 400},
+	{name: "update smart feed", method: "PUT", path: "/api/smart-feed/smart-go", body: gin.H{"name": "Rust", "query": "rust"}, code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveSmartFeed(ctx, &SmartFeed{ID: "smart-go", Name: "Go", Query: "go"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			smartFeed, err := api.db.GetSmartFeed(context.Background(), "smart-go")
+			check(t, err)
+			equal(t, []string{smartFeed.Name, smartFeed.Query}, []string{"Rust", "rust"})
+		}},
+	{name: "update missing smart feed", method: "PUT", path: "/api/smart-feed/smart-missing", body: gin.H{"name": "Go"}, code: 404, err: "smart feed not found"},
+	{name: "delete smart feed", method: "DELETE", path: "/api/smart-feed/smart-go", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveSmartFeed(ctx, &SmartFeed{ID: "smart-go", Name: "Go"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			_, err := api.db.GetSmartFeed(context.Background(), "smart-go")
+			notFound(t, err)
+		}},
+	{name: "delete missing smart feed", method: "DELETE", path: "/api/smart-feed/smart-missing", code: 404, err: "smart feed not found"},
+
+	// output feeds
+	{name: "list output feeds", method: "GET", path: "/api/output-feeds", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveOutputFeed(ctx, &OutputFeed{ID: "out", Name: "Out", Token: "token"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			outputFeeds := decode[struct {
+				OutputFeeds []*OutputFeed `json:"output_feeds"`
+			}](t, w).OutputFeeds
+			equal(t, len(outputFeeds), 1)
+			equal(t, outputFeeds[0].Token, "token")
+		}},
+	{name: "add output feed", method: "POST", path: "/api/output-feed", body: gin.H{"name": "Tech", "tags": []string{"tech"}, "limit": 10}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			out := decode[struct {
+				OutputFeed *OutputFeed `json:"output_feed"`
+			}](t, w).OutputFeed
+			equal(t, out.Token != "", true)
+			stored, err := api.db.FindOutputFeed(context.Background(), out.Token)
+			check(t, err)
+			equal(t, []any{stored.Name, stored.Tags, stored.Limit}, []any{"Tech", []string{"tech"}, 10})
+		}},
+	{name: "add output feed without name", method: "POST", path: "/api/output-feed", body: gin.H{}, code: 400, err: "name required"},
+	{name: "add output feed with invalid limit", method: "POST", path: "/api/output-feed", body: gin.H{"name": "Tech", "limit": outputFeedMaxLimit + 1}, code: 400},
+	{name: "add output feed with invalid query", method: "POST", path: "/api/output-feed", body: gin.H{"name": "Tech", "query": "before:never"}, code: 400},
+	{name: "add output feed of missing smart feed", method: "POST", path: "/api/output-feed", body: gin.H{"name": "Tech", "smart_feed_id": "smart-missing"}, code: 400, err: "smart feed not found"},
+	{name: "update output feed", method: "PUT", path: "/api/output-feed/out", body: gin.H{"name": "Renamed", "starred": true}, code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveOutputFeed(ctx, &OutputFeed{ID: "out", Name: "Out", Token: "token"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			out, err := api.db.GetOutputFeed(context.Background(), "out")
+			check(t, err)
+			equal(t, []any{out.Name, out.Starred, out.Token}, []any{"Renamed", true, "token"})
+		}},
+	{name: "update missing output feed", method: "PUT", path: "/api/output-feed/missing", body: gin.H{"name": "Out"}, code: 404, err: "output feed not found"},
+	{name: "rotate output feed token", method: "POST", path: "/api/output-feed/out/token", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveOutputFeed(ctx, &OutputFeed{ID: "out", Name: "Out", Token: "token"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			_, err := api.db.FindOutputFeed(context.Background(), "token")
+			notFound(t, err)
+			out, err := api.db.GetOutputFeed(context.Background(), "out")
+			check(t, err)
+			equal(t, out.Token != "" && out.Token != "token", true)
+		}},
+	{name: "rotate token of missing output feed", method: "POST", path: "/api/output-feed/missing/token", code: 404, err: "output feed not found"},
+	{name: "delete output feed", method: "DELETE", path: "/api/output-feed/out", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveOutputFeed(ctx, &OutputFeed{ID: "out", Name: "Out", Token: "token"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			_, err := api.db.GetOutputFeed(context.Background(), "out")
+			notFound(t, err)
+		}},
+	{name: "delete missing output feed", method: "DELETE", path: "/api/output-feed/missing", code: 404, err: "output feed not found"},
+	{name: "serve output feed", method: "GET", path: "/feeds/out/token.rss", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveOutputFeed(ctx, &OutputFeed{ID: "out", Name: "Out", Token: "token", Tags: []string{"news"}}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			equal(t, w.Header().Get("Content-Type"), outputContentTypes[".rss"])
+			equal(t, strings.Contains(w.Body.String(), "Weather"), true)
+			equal(t, strings.Contains(w.Body.String(), "Go release<"), false)
+
+			w = api.do(t, "GET", "/feeds/out/token.rss", nil, "If-None-Match", w.Header().Get("ETag"))
+			status(t, w, http.StatusNotModified)
+		}},
+	{name: "serve output feed behind a proxy", method: "GET", path: "/feeds/out/token.atom", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveOutputFeed(ctx, &OutputFeed{ID: "out", Name: "Out", Token: "token"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			equal(t, strings.Contains(w.Body.String(), `"http://example.com/feeds/out/token.atom"`), true)
+
+			// forwarded headers are honoured from trusted proxies only
+			forwarded := []string{"X-Forwarded-Proto", "https", "X-Forwarded-Host", "feeds.example.org"}
+			w = api.do(t, "GET", "/feeds/out/token.atom", nil, forwarded...)
+			equal(t, strings.Contains(w.Body.String(), `"https://feeds.example.org/feeds/out/token.atom"`), true)
+			req := httptest.NewRequest("GET", "/feeds/out/token.atom", nil)
+			req.RemoteAddr = "198.51.100.1:1234"
+			req.Header.Set("X-Forwarded-Host", "evil.example.org")
+			w = api.send(req)
+			equal(t, strings.Contains(w.Body.String(), "evil.example.org"), false)
+		}},
+	{name: "serve output feed with unknown format", method: "GET", path: "/feeds/out/token.html", code: 404, err: "output feed not found"},
+	{name: "serve output feed with unknown token", method: "GET", path: "/feeds/out/missing.json", code: 404, err: "output feed not found"},
+
+	// folders
+	{name: "list folders", method: "GET", path: "/api/folders", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		folders := decode[struct {
+			Folders []struct {
+				ID          string `json:"id"`
+				UnreadCount int    `json:"unread_count"`
+			} `json:"folders"`
+		}](t, w).Folders
+		equal(t, len(folders), 1)
+		equal(t, []any{folders[0].ID, folders[0].UnreadCount}, []any{"dev", 3})
+	}},
+	{name: "list folder items", method: "GET", path: "/api/folder/dev", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		equal(t, ids(decode[itemsResponse](t, w).Items), []string{"a3", "a1", "a2"})
+	}},
+	{name: "list items of missing folder", method: "GET", path: "/api/folder/missing", code: 404, err: "folder not found"},
+	{name: "add folder", method: "POST", path: "/api/folder", body: gin.H{"name": " Go ", "parent_id": "dev"}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			folder := decode[struct {
+				Folder *Folder `json:"folder"`
+			}](t, w).Folder
+			stored, err := api.db.GetFolder(context.Background(), folder.ID)
+			check(t, err)
+			equal(t, []string{stored.Name, stored.ParentID}, []string{"Go", "dev"})
+		}},
+	{name: "add folder without name", method: "POST", path: "/api/folder", body: gin.H{"name": ""}, code: 400, err: "name required"},
+	{name: "add folder to missing parent", method: "POST", path: "/api/folder", body: gin.H{"name": "Go", "parent_id": "missing"}, code: 400, err: "parent folder not found"},
+	{name: "add existing folder", method: "POST", path: "/api/folder", body: gin.H{"name": "Dev"}, code: 409, err: "folder already exists"},
+	{name: "update folder", method: "PUT", path: "/api/folder/dev", body: gin.H{"name": "Code", "position": 2}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			folder, err := api.db.GetFolder(context.Background(), "dev")
+			check(t, err)
+			equal(t, []any{folder.Name, folder.Position}, []any{"Code", 2})
+		}},
+	{name: "move folder into itself", method: "PUT", path: "/api/folder/dev", body: gin.H{"name": "Dev", "parent_id": "dev"}, code: 400, err: "folder cannot be moved into itself"},
+	{name: "update missing folder", method: "PUT", path: "/api/folder/missing", body: gin.H{"name": "Dev"}, code: 404, err: "folder not found"},
+	{name: "delete folder", method: "DELETE", path: "/api/folder/dev", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		feed, err := api.db.GetFeed(context.Background(), "a")
+		check(t, err)
+		equal(t, feed.FolderID, "")
+	}},
+	{name: "delete missing folder", method: "DELETE", path: "/api/folder/missing", code: 404, err: "folder not found"},
+
+	// opml
+	{name: "export opml", method: "GET", path: "/api/opml", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		equal(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/x-opml"), true)
+		equal(t, strings.Contains(w.Body.String(), `xmlUrl="https://news.example.com/feed"`), true)
+	}},
+	{name: "import opml without file", method: "POST", path: "/api/opml", code: 400, err: "opml file required"},
+
+	// tags
+	{name: "list tags", method: "GET", path: "/api/tags", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		tags := decode[struct {
+			Tags []*ListTagResult `json:"tags"`
+		}](t, w).Tags
+		equal(t, sorted(lo.Map(tags, func(tag *ListTagResult, _ int) string { return tag.Name })), []string{"go", "news", "tech"})
+	}},
+	{name: "order tags", method: "PUT", path: "/api/tags/order", body: gin.H{"tags": []string{"tech", "news", "go"}}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			tags, err := api.db.ListTags(context.Background())
+			check(t, err)
+			equal(t, lo.Map(tags, func(tag *ListTagResult, _ int) string { return tag.Name }), []string{"tech", "news", "go"})
+		}},
+	{name: "order tags with unknown tag", method: "PUT", path: "/api/tags/order", body: gin.H{"tags": []string{"tech", "missing"}}, code: 400, err: `unknown tag "missing"`},
+	{name: "order tags with invalid json", method: "PUT", path: "/api/tags/order", body: `{"tags": "go"}`, code: 400},
+	{name: "rename tag", method: "PUT", path: "/api/tag/tech", body: gin.H{"name": "technology"}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			feed, err := api.db.GetFeed(context.Background(), "a")
+			check(t, err)
+			equal(t, sorted(feed.Tags), []string{"go", "technology"})
+		}},
+	{name: "rename tag without name", method: "PUT", path: "/api/tag/tech", body: gin.H{"name": " "}, code: 400, err: "name required"},
+	{name: "rename tag to existing tag", method: "PUT", path: "/api/tag/tech", body: gin.H{"name": "news"}, code: 409},
+	{name: "rename missing tag", method: "PUT", path: "/api/tag/missing", body: gin.H{"name": "other"}, code: 404, err: "tag not found"},
+	{name: "set tag color", method: "PATCH", path: "/api/tag/tech", body: gin.H{"color": "#FF8800"}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			tags, err := api.db.ListTags(context.Background())
+			check(t, err)
+			tag, _ := lo.Find(tags, func(tag *ListTagResult) bool { return tag.Name == "tech" })
+			equal(t, tag.Color, "#ff8800")
+		}},
+	{name: "set invalid tag color", method: "PATCH", path: "/api/tag/tech", body: gin.H{"color": "orange"}, code: 400, err: "color must be #rrggbb"},
+	{name: "set color of missing tag", method: "PATCH", path: "/api/tag/missing", body: gin.H{"color": ""}, code: 404, err: "tag not found"},
+	{name: "merge tag", method: "POST", path: "/api/tag/news/merge", body: gin.H{"into": "tech"}, code: 200,
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			feed, err := api.db.GetFeed(context.Background(), "b")
+			check(t, err)
+			equal(t, feed.Tags, []string{"tech"})
+		}},
+	{name: "merge tag into itself", method: "POST", path: "/api/tag/news/merge", body: gin.H{"into": "news"}, code: 400, err: "into must be another tag"},
+	{name: "merge missing tag", method: "POST", path: "/api/tag/missing/merge", body: gin.H{"into": "news"}, code: 404, err: "tag not found"},
+	{name: "delete tag", method: "DELETE", path: "/api/tag/news", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		feed, err := api.db.GetFeed(context.Background(), "b")
+		check(t, err)
+		equal(t, len(feed.Tags), 0)
+	}},
+	{name: "delete missing tag", method: "DELETE", path: "/api/tag/missing", code: 404, err: "tag not found"},
+
+	// labels
+	{name: "list labels", method: "GET", path: "/api/labels", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.UpdateItem(ctx, "a1", &ItemUpdate{Labels: &[]string{"later"}}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			labels := decode[struct {
+				Labels []*ListLabelResult `json:"labels"`
+			}](t, w).Labels
+			equal(t, len(labels), 1)
+			equal(t, []any{labels[0].Name, labels[0].TotalCount}, []any{"later", int64(1)})
+		}},
+
+	// downloads
+	{name: "list downloads", method: "GET", path: "/api/downloads?feed_id=a", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		resp := decode[struct {
+			Downloads []*Enclosure       `json:"downloads"`
+			Usage     map[string]float64 `json:"usage"`
+		}](t, w)
+		equal(t, len(resp.Downloads), 0)
+		equal(t, len(resp.Usage), 0)
+	}},
+	{name: "download missing enclosure", method: "POST", path: "/api/enclosure/missing/download", code: 404, err: "enclosure not found"},
+	{name: "delete download not downloaded", method: "DELETE", path: "/api/enclosure/e1/download", code: 200},
+	{name: "delete download of missing enclosure", method: "DELETE", path: "/api/enclosure/missing/download", code: 404, err: "enclosure not found"},
+	{name: "stream without signature", method: "GET", path: "/media/e1", code: 403, err: "invalid or expired signature"},
+	{name: "stream with expired signature", method: "GET", path: "/media/e1?expires=1&signature=" + streamSignature("e1", 1), code: 403, err: "invalid or expired signature"},
+
+	// highlights
+	{name: "list highlights", method: "GET", path: "/api/highlights?size=1", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveHighlight(ctx, &Highlight{ID: "h1", ItemID: "a1", Quote: "notes"}))
+			check(t, db.SaveHighlight(ctx, &Highlight{ID: "h2", ItemID: "b2", Quote: "forecast"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			resp := decode[struct {
+				Highlights []*ListHighlightResult `json:"highlights"`
+				Pagination struct {
+					Total int64 `json:"total"`
+				} `json:"pagination"`
+			}](t, w)
+			equal(t, resp.Pagination.Total, 2)
+			equal(t, len(resp.Highlights), 1)
+			equal(t, resp.Highlights[0].ItemTitle != "", true)
+		}},
+	{name: "update highlight", method: "PATCH", path: "/api/highlight/h1", body: gin.H{"comment": "noted"}, code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveHighlight(ctx, &Highlight{ID: "h1", ItemID: "a1", Quote: "notes"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			highlight, err := api.db.GetHighlight(context.Background(), "h1")
+			check(t, err)
+			equal(t, highlight.Comment, "noted")
+		}},
+	{name: "update highlight with invalid json", method: "PATCH", path: "/api/highlight/h1", body: `{"comment": 1}`, code: 400},
+	{name: "update missing highlight", method: "PATCH", path: "/api/highlight/missing", body: gin.H{}, code: 404, err: "highlight not found"},
+	{name: "delete highlight", method: "DELETE", path: "/api/highlight/h1", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			check(t, db.SaveHighlight(ctx, &Highlight{ID: "h1", ItemID: "a1", Quote: "notes"}))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			_, err := api.db.GetHighlight(context.Background(), "h1")
+			notFound(t, err)
+		}},
+	{name: "delete missing highlight", method: "DELETE", path: "/api/highlight/missing", code: 404, err: "highlight not found"},
+
+	// admin
+	{name: "purge items dry run", method: "POST", path: "/api/admin/purge?dry_run=true", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			feed, err := db.GetFeed(ctx, "a")
+			check(t, err)
+			feed.RetentionMaxItems = 1
+			check(t, db.SaveFeed(ctx, feed))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			resp := decode[struct {
+				DryRun bool           `json:"dry_run"`
+				Total  int            `json:"total"`
+				Feeds  []*PurgeResult `json:"feeds"`
+			}](t, w)
+			equal(t, []any{resp.DryRun, resp.Total, len(resp.Feeds)}, []any{true, 2, 1})
+			_, err := api.db.GetItem(context.Background(), "a2")
+			check(t, err)
+		}},
+	{name: "purge items", method: "POST", path: "/api/admin/purge", code: 200,
+		setup: func(t *testing.T, ctx context.Context, db DB) {
+			feed, err := db.GetFeed(ctx, "a")
+			check(t, err)
+			feed.RetentionMaxItems = 1
+			check(t, db.SaveFeed(ctx, feed))
+		},
+		check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+			equal(t, decode[struct {
+				Total int `json:"total"`
+			}](t, w).Total, 2)
+			_, err := api.db.GetItem(context.Background(), "a2")
+			notFound(t, err)
+		}},
+	// the in-memory database has nothing to back up
+	{name: "backup", method: "POST", path: "/api/admin/backup", code: 500, err: "nothing to back up in ephemeral mode"},
+
+	// export and import
+	{name: "import without file", method: "POST", path: "/api/import", code: 400, err: "archive file required"},
+	{name: "import starred without file", method: "POST", path: "/api/import/starred", code: 400, err: "export file required"},
+
+	// two-factor authentication needs password login
+	{name: "two-factor status", method: "GET", path: "/api/2fa", code: 400, err: "two-factor authentication requires password login"},
+	{name: "set up two-factor", method: "POST", path: "/api/2fa/setup", code: 400, err: "two-factor authentication requires password login"},
+	{name: "verify two-factor", method: "POST", path: "/api/2fa/verify", body: gin.H{"code": "123456"}, code: 400, err: "two-factor authentication requires password login"},
+	{name: "disable two-factor", method: "DELETE", path: "/api/2fa", body: gin.H{"code": "123456"}, code: 400, err: "two-factor authentication requires password login"},
+
+	// authentication disabled
+	{name: "auth status", method: "GET", path: "/api/auth-status", code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		equal(t, w.Body.String(), `{"auth_required":false}`)
+	}},
+	{name: "login", method: "POST", path: "/api/login", body: gin.H{}, code: 200, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		equal(t, w.Body.String(), `{"auth_required":false,"token":""}`)
+	}},
+	{name: "preflight", method: "OPTIONS", path: "/api/feeds", code: 204, check: func(t *testing.T, api *testAPI, w *httptest.ResponseRecorder) {
+		equal(t, w.Header().Get("Access-Control-Allow-Origin"), "*")
+	}},
+}
+
+func TestAPI(t *testing.T) {
+	for _, tt := range apiTests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI(t)
+			if tt.setup != nil {
+				tt.setup(t, context.Background(), api.db)
+			}
+			w := api.do(t, tt.method, tt.path, tt.body)
+			status(t, w, tt.code)
+			if tt.err != "" {
+				equal(t, decode[errorResponse](t, w).Error, tt.err)
+			}
+			if tt.check != nil {
+				tt.check(t, api, w)
+			}
+		})
+	}
+}
+
+func TestAPIAuth(t *testing.T) {
+	api := newTestAPI(t)
+	setAuth(t, true, "")
+
+	w := api.do(t, "GET", "/api/auth-status", nil)
+	status(t, w, 200)
+	equal(t, w.Body.String(), `{"auth_required":true}`)
+
+	for _, header := range [][]string{
+		nil,
+		{"Authorization", "Token abc"},
+		{"Authorization", "Bearer "},
+		{"Authorization", "Bearer abc"},
+	} {
+		w := api.do(t, "GET", "/api/feeds", nil, header...)
+		status(t, w, 401)
+	}
+
+	w = api.do(t, "POST", "/api/login", "{")
+	status(t, w, 400)
+	w = api.do(t, "POST", "/api/login", gin.H{"password": "wrong"})
+	status(t, w, 401)
+	equal(t, decode[errorResponse](t, w).Error, "invalid password")
+
+	w = api.do(t, "POST", "/api/login", gin.H{"password": "secret"})
+	status(t, w, 200)
+	token := decode[struct {
+		Token string `json:"token"`
+	}](t, w).Token
+	w = api.do(t, "GET", "/api/feeds", nil, "Authorization", "Bearer "+token)
+	status(t, w, 200)
+
+	// a token signed with another secret
+	authConfig.JwtSecret = []byte("other secret")
+	w = api.do(t, "GET", "/api/feeds", nil, "Authorization", "Bearer "+token)
+	status(t, w, 401)
+	equal(t, decode[errorResponse](t, w).Error, "invalid or expired token")
+
+	// output feeds and streams have their own credentials
+	check(t, api.db.SaveOutputFeed(context.Background(), &OutputFeed{ID: "out", Name: "Out", Token: "token"}))
+	status(t, api.do(t, "GET", "/feeds/out/token.atom", nil), 200)
+	status(t, api.do(t, "GET", "/media/e1", nil), 403)
+}
+
+func TestAPITwoFactor(t *testing.T) {
+	api := newTestAPI(t)
+	setAuth(t, true, "")
+	token, err := generateToken()
+	check(t, err)
+	bearer := []string{"Authorization", "Bearer " + token}
+
+	w := api.do(t, "GET", "/api/2fa", nil, bearer...)
+	status(t, w, 200)
+	equal(t, w.Body.String(), `{"enabled":false,"recovery_codes_left":0}`)
+	// disabling is a no-op until it is enabled
+	w = api.do(t, "DELETE", "/api/2fa", gin.H{}, bearer...)
+	status(t, w, 200)
+	w = api.do(t, "POST", "/api/2fa/verify", gin.H{"code": "123456"}, bearer...)
+	status(t, w, 409)
+
+	w = api.do(t, "POST", "/api/2fa/setup", nil, bearer...)
+	status(t, w, 200)
+	setup := decode[struct {
+		Secret     string `json:"secret"`
+		OtpauthURL string `json:"otpauth_url"`
+		QR         string `json:"qr"`
+	}](t, w)
+	equal(t, strings.HasPrefix(setup.OtpauthURL, "otpauth://totp/"), true)
+	equal(t, strings.HasPrefix(setup.QR, "data:image/png;base64,"), true)
+
+	w = api.do(t, "POST", "/api/2fa/verify", "{", bearer...)
+	status(t, w, 400)
+	w = api.do(t, "POST", "/api/2fa/verify", gin.H{"code": "000000x"}, bearer...)
+	status(t, w, 401)
+	code, err := totp.GenerateCode(setup.Secret, time.Now())
+	check(t, err)
+	w = api.do(t, "POST", "/api/2fa/verify", gin.H{"code": code}, bearer...)
+	status(t, w, 200)
+	recoveryCodes := decode[struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}](t, w).RecoveryCodes
+	equal(t, len(recoveryCodes), recoveryCodeCount)
+	status(t, api.do(t, "POST", "/api/2fa/setup", nil, bearer...), 409)
+
+	// login asks for the second factor
+	w = api.do(t, "POST", "/api/login", gin.H{"password": "secret"})
+	status(t, w, 401)
+	equal(t, w.Body.String(), `{"error":"second factor required","otp_required":true}`)
+	w = api.do(t, "POST", "/api/login", gin.H{"password": "secret", "otp": "000000x"})
+	status(t, w, 401)
+	status(t, api.do(t, "POST", "/api/login", gin.H{"password": "secret", "otp": code}), 200)
+	// recovery codes can only be used once
+	status(t, api.do(t, "POST", "/api/login", gin.H{"password": "secret", "otp": recoveryCodes[0]}), 200)
+	status(t, api.do(t, "POST", "/api/login", gin.H{"password": "secret", "otp": recoveryCodes[0]}), 401)
+
+	w = api.do(t, "GET", "/api/2fa", nil, bearer...)
+	status(t, w, 200)
+	equal(t, w.Body.String(), `{"enabled":true,"recovery_codes_left":9}`)
+
+	w = api.do(t, "DELETE", "/api/2fa", gin.H{"code": recoveryCodes[0]}, bearer...)
+	status(t, w, 401)
+	w = api.do(t, "DELETE", "/api/2fa", gin.H{"code": recoveryCodes[1]}, bearer...)
+	status(t, w, 200)
+	equal(t, w.Body.String(), `{"enabled":false}`)
+	status(t, api.do(t, "POST", "/api/login", gin.H{"password": "secret"}), 200)
+}
+
+func TestAPIProxyAuth(t *testing.T) {
+	api := newTestAPI(t)
+	setAuth(t, false, "Remote-User")
+
+	w := api.do(t, "GET", "/api/auth-status", nil)
+	status(t, w, 200)
+	equal(t, w.Body.String(), `{"auth_mode":"proxy","auth_required":false}`)
+	w = api.do(t, "POST", "/api/login", gin.H{"password": "secret"})
+	status(t, w, 400)
+	equal(t, decode[errorResponse](t, w).Error, "login is handled by the reverse proxy")
+
+	w = api.do(t, "GET", "/api/feeds", nil)
+	status(t, w, 401)
+	equal(t, decode[errorResponse](t, w).Error, "authorization required")
+
+	status(t, api.do(t, "GET", "/api/feeds", nil, "Remote-User", "alice"), 200)
+	_, err := api.db.GetUser(context.Background(), "alice")
+	check(t, err)
+	// two-factor authentication is left to the proxy
+	status(t, api.do(t, "GET", "/api/2fa", nil, "Remote-User", "alice"), 400)
+
+	req := httptest.NewRequest("GET", "/api/feeds", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header.Set("Remote-User", "alice")
+	w = api.send(req)
+	status(t, w, 403)
+	equal(t, decode[errorResponse](t, w).Error, "untrusted proxy")
+}
+
+// feedServer serves an RSS feed with two items, an enclosure of the first one,
+// and a homepage declaring an svg icon before /favicon.ico.
+func feedServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	mux.HandleFunc("/feed", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		io.WriteString(w, `<?xml version="1.0"?><rss version="2.0"><channel><title>Upstream</title><link>`+srv.URL+`</link>
+			<item><title>First</title><link>`+srv.URL+`/first</link><guid>first</guid><pubDate>Mon, 01 Jan 2024 10:00:00 GMT</pubDate>
+				<enclosure url="`+srv.URL+`/first.mp3" type="audio/mpeg" length="10"/></item>
+			<item><title>Second</title><link>`+srv.URL+`/second?id=2&amp;utm_source=rss#top</link><guid>second</guid><pubDate>Tue, 02 Jan 2024 10:00:00 GMT</pubDate></item>
+		</channel></rss>`)
+	})
+	mux.HandleFunc("/first.mp3", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		http.ServeContent(w, r, "first.mp3", testBase, strings.NewReader("0123456789"))
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `<html><head><link rel="icon" href="/icon.svg"></head></html>`)
+	})
+	mux.HandleFunc("/icon.svg", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		io.WriteString(w, `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`)
+	})
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		io.WriteString(w, "\x89PNG\r\n\x1a\n")
+	})
+	return srv
+}
+
+func TestAPIAddFeed(t *testing.T) {
+	api := newTestAPI(t)
+	srv := feedServer(t)
+
+	w := api.do(t, "POST", "/api/feed", gin.H{"url": srv.URL + "/feed", "cron": "@hourly"})
+	status(t, w, 200)
+	feed := decode[struct {
+		Feed *Feed `json:"feed"`
+	}](t, w).Feed
+	equal(t, []string{feed.Title, feed.UpstreamTitle}, []string{"Upstream", "Upstream"})
+	// svg icons are skipped
+	w = api.do(t, "GET", "/api/feed/"+feed.ID+"/icon", nil)
+	status(t, w, 200)
+	equal(t, w.Header().Get("Content-Type"), "image/png")
+	_, subscribed := api.crons[feed.ID]
+	equal(t, subscribed, true)
+
+	w = api.do(t, "GET", "/api/feed/"+feed.ID, nil)
+	status(t, w, 200)
+	items := decode[itemsResponse](t, w).Items
+	equal(t, lo.Map(items, func(item *Item, _ int) string { return item.Title }), []string{"Second", "First"})
+	// tracking parameters and fragments are left out of the canonical link
+	equal(t, items[0].CanonicalLink, srv.URL+"/second?id=2")
+
+	// suspending the feed unsubscribes it
+	w = api.do(t, "PUT", "/api/feed/"+feed.ID, gin.H{"url": feed.Link, "cron": "@hourly", "suspended": true})
+	status(t, w, 200)
+	_, subscribed = api.crons[feed.ID]
+	equal(t, subscribed, false)
+
+	// refresh fetches again, the items are not duplicated
+	w = api.do(t, "GET", "/api/feed/"+feed.ID+"?refresh=true", nil)
+	status(t, w, 200)
+	equal(t, len(decode[itemsResponse](t, w).Items), 2)
+}
+
+func TestAPIEnclosures(t *testing.T) {
+	api := newTestAPI(t)
+	srv := feedServer(t)
+	ctx := context.Background()
+	check(t, api.db.AddItem(ctx, &Item{
+		ID: "c1", FeedID: "a", Title: "Episode",
+		Enclosures: []*Enclosure{
+			{ID: "e4", ItemID: "c1", FeedID: "a", URL: srv.URL + "/first.mp3", Type: "audio/mpeg", Length: 10},
+			{ID: "e5", ItemID: "c1", FeedID: "a", Position: 1, URL: srv.URL + "/", Type: "audio/mpeg"},
+		},
+	}))
+
+	w := api.do(t, "GET", "/api/item/c1", nil)
+	status(t, w, 200)
+	enclosures := decode[struct {
+		Item *Item `json:"item"`
+	}](t, w).Item.Enclosures
+	streamURL := enclosures[0].StreamURL
+
+	// proxied from upstream, range requests included
+	w = api.do(t, "GET", streamURL, nil)
+	status(t, w, 200)
+	equal(t, w.Body.String(), "0123456789")
+	equal(t, []string{w.Header().Get("Content-Type"), w.Header().Get("X-Content-Type-Options")}, []string{"audio/mpeg", "nosniff"})
+	// other content is served as a download, whatever the feed claims
+	w = api.do(t, "GET", enclosures[1].StreamURL, nil)
+	status(t, w, 200)
+	equal(t, []string{w.Header().Get("Content-Type"), w.Header().Get("Content-Disposition")}, []string{"application/octet-stream", "attachment"})
+	w = api.do(t, "GET", streamURL, nil, "Range", "bytes=2-4")
+	status(t, w, http.StatusPartialContent)
+	equal(t, w.Body.String(), "234")
+	equal(t, w.Header().Get("Content-Range"), "bytes 2-4/10")
+	status(t, api.do(t, "HEAD", streamURL, nil), 200)
+	status(t, api.do(t, "GET", strings.Replace(streamURL, "/media/e4", "/media/e1", 1), nil), 403)
+
+	// downloads run in the background
+	status(t, api.do(t, "POST", "/api/enclosure/e4/download", nil), http.StatusAccepted)
+	waitDownload(t, "e4")
+	enclosure, err := api.db.GetEnclosure(ctx, "e4")
+	check(t, err)
+	equal(t, enclosure.Size, 10)
+	equal(t, enclosure.DownloadedAt != nil, true)
+	status(t, api.do(t, "POST", "/api/enclosure/e4/download", nil), 200)
+
+	w = api.do(t, "GET", "/api/downloads", nil)
+	status(t, w, 200)
+	downloads := decode[struct {
+		Downloads []*Enclosure `json:"downloads"`
+		Usage     map[string]int64
+	}](t, w)
+	equal(t, len(downloads.Downloads), 1)
+	equal(t, downloads.Usage, map[string]int64{"a": 10})
+
+	// the local copy is served once upstream is gone
+	srv.Close()
+	w = api.do(t, "GET", streamURL, nil, "Range", "bytes=8-")
+	status(t, w, http.StatusPartialContent)
+	equal(t, w.Body.String(), "89")
+
+	w = api.do(t, "DELETE", "/api/enclosure/e4/download", nil)
+	status(t, w, 200)
+	enclosure, err = api.db.GetEnclosure(ctx, "e4")
+	check(t, err)
+	equal(t, enclosure.DownloadedAt, nil)
+	entries, err := os.ReadDir(filepath.Join(downloadConfig.Dir, "a"))
+	if err == nil {
+		equal(t, len(entries), 0)
+	}
+
+	// upstream is unreachable
+	status(t, api.do(t, "POST", "/api/enclosure/e4/download", nil), http.StatusAccepted)
+	waitDownload(t, "e4")
+	enclosure, err = api.db.GetEnclosure(ctx, "e4")
+	check(t, err)
+	equal(t, enclosure.DownloadedAt, nil)
+	w = api.do(t, "GET", streamURL, nil)
+	status(t, w, 502)
+	// the signature is valid but the enclosure is gone
+	check(t, api.db.DeleteItems(ctx, "c1"))
+	w = api.do(t, "GET", streamURL, nil)
+	status(t, w, 404)
+	equal(t, decode[errorResponse](t, w).Error, "enclosure not found")
+}
+
+// waitDownload waits for the background download of the enclosure to end.
+func waitDownload(t *testing.T, enclosureID string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, busy := downloading.Load(enclosureID); !busy {
+			return
+		}
+	}
+	t.Fatalf("download of %s did not end", enclosureID)
+}
+
+func TestAPIImport(t *testing.T) {
+	api := newTestAPI(t)
+	ctx := context.Background()
+	check(t, api.db.UpdateItem(ctx, "a1", &ItemUpdate{Starred: lo.ToPtr(true), Labels: &[]string{"later"}}))
+
+	w := api.do(t, "GET", "/api/export?content=true", nil)
+	status(t, w, 200)
+	equal(t, w.Header().Get("Content-Type"), "application/zip")
+	archive := w.Body.Bytes()
+	_, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	check(t, err)
+
+	// into an empty service
+	empty := newService(NewMemoryDB())
+	other := &testAPI{Service: empty, handler: empty.router()}
+	w = other.upload(t, "/api/import", "nexa.zip", archive)
+	status(t, w, 200)
+	result := decode[struct {
+		Result *ImportResult `json:"result"`
+	}](t, w).Result
+	equal(t, []int{result.FeedsCreated, result.ItemsCreated}, []int{2, 5})
+	item, err := other.db.GetItem(ctx, "a1")
+	check(t, err)
+	equal(t, []any{item.Starred, item.Labels}, []any{true, []string{"later"}})
+	// imported again, nothing is duplicated
+	w = other.upload(t, "/api/import", "nexa.zip", archive)
+	status(t, w, 200)
+	result = decode[struct {
+		Result *ImportResult `json:"result"`
+	}](t, w).Result
+	equal(t, []int{result.FeedsCreated, result.FeedsMerged, result.ItemsCreated, result.ItemsMerged}, []int{0, 2, 0, 5})
+
+	w = api.upload(t, "/api/import", "nexa.zip", []byte("not a zip"))
+	status(t, w, 400)
+
+	// opml
+	w = api.upload(t, "/api/opml", "feeds.opml", []byte(opmlExport))
+	status(t, w, 200)
+	result = decode[struct {
+		Result *ImportResult `json:"result"`
+	}](t, w).Result
+	equal(t, []int{result.FoldersCreated, result.FeedsCreated, result.FeedsMerged}, []int{1, 1, 1})
+	w = api.upload(t, "/api/opml", "feeds.opml", []byte("<opml"))
+	status(t, w, 400)
+	w = api.upload(t, "/api/opml", "feeds.opml", []byte(`<opml version="2.0"><body>
+		<outline text="Other" xmlUrl="https://other.example.com/feed"/><outline text="Local" xmlUrl="file:///etc/passwd"/>
+	</body></opml>`))
+	status(t, w, 400)
+	equal(t, decode[errorResponse](t, w).Error, "invalid feed url schema: file:///etc/passwd")
+	_, err = api.db.GetFeed(ctx, Hash("https://other.example.com/feed"))
+	notFound(t, err)
+
+	// starred items of another reader
+	w = api.upload(t, "/api/import/starred", "starred.json", []byte(minifluxExport))
+	status(t, w, 200)
+	result = decode[struct {
+		Result *ImportResult `json:"result"`
+	}](t, w).Result
+	equal(t, []int{result.FoldersCreated, result.FeedsCreated, result.ItemsCreated}, []int{1, 1, 1})
+	w = api.upload(t, "/api/import/starred?format=netnewswire", "starred.json", []byte(minifluxExport))
+	status(t, w, 400)
+	equal(t, decode[errorResponse](t, w).Error, `unsupported export format: "netnewswire"`)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// The account archive is a zip of JSON Lines files, one record per line,
+// so that it can be produced and consumed as a stream and merged idempotently.
+const (
+	archiveFormat  = "nexa-archive"
+	archiveVersion = 1
+
+	archiveManifest = "manifest.json"
+	archiveFolders  = "folders.jsonl" // parents before children, absent from older archives
+	archiveFeeds    = "feeds.jsonl"
+	archiveItems    = "items.jsonl"
+
+	// defaultFeedCron is used for feeds imported without a schedule.
+	defaultFeedCron = "@every 30m"
+)
+
+type ArchiveManifest struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Content    bool      `json:"content"` // whether item content is included
+}
+
+type ImportResult struct {
+	FoldersCreated int `json:"folders_created"`
+	FeedsCreated   int `json:"feeds_created"`
+	FeedsMerged    int `json:"feeds_merged"`
+	ItemsCreated   int `json:"items_created"`
+	ItemsMerged    int `json:"items_merged"`
+}
+
+// exportArchive writes feeds with their tags and items with their flags to w.
+func (svc *Service) exportArchive(ctx context.Context, w io.Writer, withContent bool) error {
+	zw := zip.NewWriter(w)
+	now := time.Now().UTC()
+	create := func(name string) (io.Writer, error) {
+		return zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+	}
+
+	f, err := create(archiveManifest)
+	if err != nil {
+		return err
+	}
+	manifest := &ArchiveManifest{Format: archiveFormat, Version: archiveVersion, ExportedAt: now, Content: withContent}
+	if err := json.NewEncoder(f).Encode(manifest); err != nil {
+		return err
+	}
+
+	folders, err := svc.db.ListFolders(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list folders error")
+	}
+	if f, err = create(archiveFolders); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for nodes := folderTree(folders, nil); len(nodes) > 0; {
+		next := []*ListFolderResult{}
+		for _, node := range nodes {
+			if err := enc.Encode(node.Folder); err != nil {
+				return err
+			}
+			next = append(next, node.Children...)
+		}
+		nodes = next
+	}
+
+	feeds, err := svc.db.FilterFeeds(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "list feeds error")
+	}
+	if f, err = create(archiveFeeds); err != nil {
+		return err
+	}
+	enc = json.NewEncoder(f)
+	for _, feed := range feeds {
+		if err := enc.Encode(feed.Feed); err != nil {
+			return err
+		}
+	}
+
+	if f, err = create(archiveItems); err != nil {
+		return err
+	}
+	enc = json.NewEncoder(f)
+	const pageSize = 200
+	for _, feed := range feeds {
+		for offset := 0; ; offset += pageSize {
+			limit, offset := pageSize, offset
+			items, err := svc.db.FilterItems(ctx, &ItemFilter{FeedIDs: []string{feed.ID}, Limit: &limit, Offset: &offset})
+			if err != nil {
+				return errors.Wrapf(err, "list items of feed %s error", feed.ID)
+			}
+			for _, item := range items {
+				if !withContent {
+					item.Content = ""
+				}
+				if err := enc.Encode(item); err != nil {
+					return err
+				}
+			}
+			if len(items) < pageSize {
+				break
+			}
+		}
+	}
+
+	return zw.Close()
+}
+
+// importArchive merges an archive into the database, feeds are matched by link and
+// items by id, guid or link, so importing the same archive twice changes nothing.
+func (svc *Service) importArchive(ctx context.Context, r io.ReaderAt, size int64) (*ImportResult, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid archive")
+	}
+	files := lo.SliceToMap(zr.File, func(f *zip.File) (string, *zip.File) { return f.Name, f })
+
+	manifest := new(ArchiveManifest)
+	if err := readArchiveFile(files[archiveManifest], func(dec *json.Decoder) error { return dec.Decode(manifest) }); err != nil {
+		return nil, errors.Wrap(err, "read manifest error")
+	} else if manifest.Format != archiveFormat || manifest.Version > archiveVersion {
+		return nil, fmt.Errorf("unsupported archive %s version %d", manifest.Format, manifest.Version)
+	}
+
+	existing, err := svc.db.FilterFeeds(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "list feeds error")
+	}
+	feedsByLink := lo.SliceToMap(existing, func(feed *ListFeedResult) (string, *Feed) { return feed.Link, feed.Feed })
+
+	result := new(ImportResult)
+	folderIDs := make(map[string]string) // archive folder id -> local folder id
+	if files[archiveFolders] != nil {
+		index, err := newFolderIndex(ctx, svc.db)
+		if err != nil {
+			return nil, err
+		}
+		err = readArchiveFile(files[archiveFolders], func(dec *json.Decoder) error {
+			for dec.More() {
+				folder := new(Folder)
+				if err := dec.Decode(folder); err != nil {
+					return err
+				}
+				local, err := index.ensure(ctx, folderIDs[folder.ParentID], folder.Name)
+				if err != nil {
+					return err
+				}
+				folderIDs[folder.ID] = local.ID
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "import folders error")
+		}
+		result.FoldersCreated = index.created
+	}
+
+	feedIDs := make(map[string]string) // archive feed id -> local feed id
+	err = readArchiveFile(files[archiveFeeds], func(dec *json.Decoder) error {
+		for dec.More() {
+			feed := new(Feed)
+			if err := dec.Decode(feed); err != nil {
+				return err
+			}
+			archiveID := feed.ID // importFeed sets the local id
+			feed.FolderID = folderIDs[feed.FolderID]
+			local, err := svc.importFeed(ctx, feed, feedsByLink[feed.Link])
+			if err != nil {
+				return err
+			}
+			if feedsByLink[feed.Link] != nil {
+				result.FeedsMerged++
+			} else {
+				result.FeedsCreated++
+			}
+			feedsByLink[local.Link] = local
+			feedIDs[archiveID] = local.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "import feeds error")
+	}
+
+	err = readArchiveFile(files[archiveItems], func(dec *json.Decoder) error {
+		for dec.More() {
+			item := new(Item)
+			if err := dec.Decode(item); err != nil {
+				return err
+			}
+			feedID, ok := feedIDs[item.FeedID]
+			if !ok {
+				continue // item of a feed missing from the archive
+			}
+			item.FeedID = feedID
+			created, err := svc.mergeItem(ctx, item)
+			if err != nil {
+				return err
+			}
+			if created {
+				result.ItemsCreated++
+			} else {
+				result.ItemsMerged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "import items error")
+	}
+
+	return result, nil
+}
+
+func readArchiveFile(f *zip.File, read func(dec *json.Decoder) error) error {
+	if f == nil {
+		return errors.New("file missing from archive")
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return read(json.NewDecoder(bufio.NewReader(rc)))
+}
+
+// importFeed creates the feed, or merges its tags into the existing feed with the same link,
+// which is also moved to the folder of the feed unless it is already in a folder.
+func (svc *Service) importFeed(ctx context.Context, feed, existing *Feed) (*Feed, error) {
+	if existing != nil {
+		missing := lo.Without(feed.Tags, existing.Tags...)
+		move := existing.FolderID == "" && feed.FolderID != ""
+		if len(missing) == 0 && !move {
+			return existing, nil
+		}
+		existing.Tags = append(slices.Clone(existing.Tags), missing...)
+		if move {
+			existing.FolderID = feed.FolderID
+		}
+		return existing, svc.db.SaveFeed(ctx, existing)
+	}
+
+	feed.ID = Hash(feed.Link)
+	if feed.Cron == "" {
+		feed.Cron = defaultFeedCron
+	}
+	if err := svc.db.SaveFeed(ctx, feed); err != nil {
+		return nil, err
+	}
+	if !feed.Suspended {
+		svc.subscribe(feed)
+	}
+	return feed, nil
+}
+
+// mergeItem stores the item unless it already exists, in which case flags set in either are kept,
+// labels are merged and the note is only set when the existing item has none.
+func (svc *Service) mergeItem(ctx context.Context, item *Item) (created bool, err error) {
+	existing, err := svc.db.GetItem(ctx, item.ID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		existing, err = svc.db.FindItem(ctx, item.FeedID, item.GUID, item.Link)
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if item.CreatedAt.IsZero() {
+			item.CreatedAt = time.Now()
+		}
+		return true, svc.db.SaveItem(ctx, item)
+	} else if err != nil {
+		return false, err
+	}
+
+	update := &ItemUpdate{}
+	if (item.Read && !existing.Read) || (item.Starred && !existing.Starred) || (item.Liked && !existing.Liked) {
+		update.Read = lo.ToPtr(existing.Read || item.Read)
+		update.Starred = lo.ToPtr(existing.Starred || item.Starred)
+		update.Liked = lo.ToPtr(existing.Liked || item.Liked)
+	}
+	if missing := lo.Without(item.Labels, existing.Labels...); len(missing) > 0 {
+		update.Labels = lo.ToPtr(append(slices.Clone(existing.Labels), missing...))
+	}
+	if existing.Note == "" && item.Note != "" {
+		update.Note = &item.Note
+	}
+	if *update == (ItemUpdate{}) {
+		return false, nil
+	}
+	return false, svc.db.UpdateItem(ctx, existing.ID, update)
+}
+
+// Export 导出订阅、标签和文章状态，content=true 时包含文章内容
+func (svc *Service) Export(c *gin.Context) {
+	withContent := c.Query("content") == "true"
+	filename := fmt.Sprintf("nexa-%s.zip", time.Now().Format("20060102-150405"))
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if err := svc.exportArchive(c.Request.Context(), c.Writer, withContent); err != nil {
+		// the response is already streaming, nothing else can be reported to the client
+		logrus.WithError(err).Error("export archive error")
+	}
+}
+
+// Import 导入 Export 生成的归档，重复导入不会产生重复数据
+func (svc *Service) Import(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(400, gin.H{"error": "archive file required"})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	// zip needs random access, spool the upload to disk
+	tmp, err := os.CreateTemp("", "nexa-import-*.zip")
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, f)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := svc.importArchive(ctx, tmp, size)
+	if err != nil {
+		logrus.WithError(err).Warn("import archive error")
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"result": result})
+}
@@ -5,17 +5,30 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/sirupsen/logrus"
 )
 
+// defaultUser is the account used by password authentication,
+// which only knows a single user.
+const defaultUser = "admin"
+
 var authConfig struct {
 	Enabled   bool
 	JwtSecret []byte
 	PwdHash   string
+
+	// ProxyHeader enables reverse-proxy authentication (Authelia, oauth2-proxy, ...):
+	// the user name is taken from this header, but only on requests coming from TrustedProxies.
+	// X-Forwarded-* headers are likewise only honoured from TrustedProxies.
+	ProxyHeader    string
+	TrustedProxies []*net.IPNet
 }
 
 // 初始化认证配置
@@ -34,9 +47,71 @@ func init() {
 		hash := sha256.Sum256([]byte(pwd))
 		authConfig.PwdHash = hex.EncodeToString(hash[:])
 		logrus.Info("Authentication enabled")
-	} else {
+	} else if os.Getenv("NEXA_AUTH_PROXY_HEADER") == "" {
 		logrus.Info("Authentication disabled (no password set)")
 	}
+
+	proxies, err := parseCIDRs(os.Getenv("NEXA_TRUSTED_PROXIES"))
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid NEXA_TRUSTED_PROXIES")
+	}
+	authConfig.TrustedProxies = proxies
+
+	if header := os.Getenv("NEXA_AUTH_PROXY_HEADER"); header != "" {
+		if len(proxies) == 0 {
+			logrus.Fatal("NEXA_AUTH_PROXY_HEADER requires NEXA_TRUSTED_PROXIES to be set")
+		}
+		authConfig.ProxyHeader = http.CanonicalHeaderKey(header)
+		logrus.Infof("Reverse-proxy authentication enabled (header %s)", authConfig.ProxyHeader)
+	}
+}
+
+// parseCIDRs parses a comma separated list of CIDRs, bare IPs are treated as single hosts.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip: %s", part)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrustedProxy reports whether the direct peer of the request is one of the trusted proxies.
+// RemoteAddr is used on purpose, X-Forwarded-For is controlled by the client.
+func isTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range authConfig.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // 验证密码是否正确
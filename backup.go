@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var backupConfig struct {
+	Dir  string // backups are written to this directory
+	Cron string // schedule of automatic backups, disabled when empty
+	Keep int    // number of backups kept by rotation
+}
+
+func init() {
+	backupConfig.Dir = os.Getenv("NEXA_BACKUP_DIR")
+	if backupConfig.Dir == "" {
+		backupConfig.Dir = "data/backups"
+	}
+	backupConfig.Cron = os.Getenv("NEXA_BACKUP_CRON")
+	backupConfig.Keep, _ = strconv.Atoi(os.Getenv("NEXA_BACKUP_KEEP"))
+	if backupConfig.Keep <= 0 {
+		backupConfig.Keep = 7
+	}
+}
+
+const backupPrefix = "nexa-"
+
+// backup takes an online snapshot of the database into the backup directory and rotates old ones.
+func (svc *Service) backup(ctx context.Context) (string, error) {
+	if err := os.MkdirAll(backupConfig.Dir, 0o755); err != nil {
+		return "", err
+	}
+	// UTC with nanoseconds, so that names sort chronologically and backups in the same second differ
+	dst := filepath.Join(backupConfig.Dir, backupPrefix+time.Now().UTC().Format("20060102-150405.000000000Z")+".db")
+	if err := svc.db.Backup(ctx, dst); err != nil {
+		return "", err
+	}
+	logrus.Infof("database backed up to %s", dst)
+
+	if err := rotateBackups(backupConfig.Dir, backupConfig.Keep); err != nil {
+		logrus.WithError(err).Error("rotate backups error")
+	}
+	return dst, nil
+}
+
+// rotateBackups removes the oldest backups so that at most keep of them are left.
+func rotateBackups(dir string, keep int) error {
+	names, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*.db"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names) // the timestamp in the name sorts chronologically
+	for len(names) > keep {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		logrus.Infof("removed old backup %s", names[0])
+		names = names[1:]
+	}
+	return nil
+}
+
+func (svc *Service) initBackup() {
+	if backupConfig.Cron == "" {
+		return
+	}
+	_, err := svc.cron.AddFunc(backupConfig.Cron, func() {
+		if _, err := svc.backup(context.Background()); err != nil {
+			logrus.WithError(err).Error("scheduled backup error")
+		}
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid NEXA_BACKUP_CRON")
+	}
+}
+
+// Backup 在线备份数据库，download=true 时直接下载备份文件
+func (svc *Service) Backup(c *gin.Context) {
+	path, err := svc.backup(c.Request.Context())
+	if err != nil {
+		logrus.WithError(err).Error("backup error")
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if c.Query("download") == "true" {
+		c.FileAttachment(path, filepath.Base(path))
+		return
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"path": path, "size": stat.Size()})
+}
+
+// restoreCommand implements `nexa restore <file>`, it replaces the SQLite database by a backup.
+// The server must not be running.
+func restoreCommand(src string) error {
+	ctx := context.Background()
+	dsn := os.Getenv("NEXA_DSN")
+	if dsn == "" {
+		dsn = "data/nexa.db"
+	} else if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return errors.New("restore only supports SQLite, use pg_restore for PostgreSQL")
+	}
+
+	backup, err := NewSQLiteDB("file:" + src + "?mode=ro")
+	if err != nil {
+		return errors.Wrap(err, "open backup error")
+	}
+	var check string
+	if err := backup.db.WithContext(ctx).Raw("PRAGMA integrity_check").Scan(&check).Error; err != nil {
+		return errors.Wrap(err, "check backup error")
+	} else if check != "ok" {
+		return fmt.Errorf("backup is corrupted: %s", check)
+	}
+	if !backup.db.Migrator().HasTable(&Feed{}) {
+		return errors.New("backup is not a nexa database")
+	}
+	version, err := backup.SchemaVersion(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get backup schema version error")
+	}
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("backup schema version %d is newer than supported version %d", version, latestSchemaVersion())
+	}
+	if sqlDB, err := backup.db.DB(); err == nil {
+		sqlDB.Close()
+	}
+
+	path, _, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	if _, err := os.Stat(path); err == nil {
+		saved := fmt.Sprintf("%s.pre-restore-%s.bak", path, time.Now().Format("20060102150405"))
+		if err := copyFile(path, saved); err != nil {
+			return errors.Wrap(err, "save current database error")
+		}
+		fmt.Printf("current database saved to %s\n", saved)
+	}
+	if err := copyFile(src, path); err != nil {
+		return errors.Wrap(err, "copy backup error")
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		os.Remove(path + suffix)
+	}
+
+	fmt.Printf("restored %s (schema version %d), pending migrations run on next start\n", src, version)
+	return nil
+}
+
+// copyFile copies src to a temporary file next to dst and renames it, so dst is never half written.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
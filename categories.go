@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"gorm.io/gorm"
+)
+
+// ListFeedCategories 列出订阅中文章最多的上游分类，limit 默认 20，最多 100
+func (svc *Service) ListFeedCategories(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if err != nil || limit < 1 || limit > 100 {
+		c.JSON(400, gin.H{"error": "limit must be between 1 and 100"})
+		return
+	}
+	feed, err := svc.db.GetFeed(ctx, c.Param("feed_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "feed not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	categories, err := svc.db.TopCategories(ctx, feed.ID, limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"categories": categories})
+}
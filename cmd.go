@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const usage = `usage:
+  nexa [--ephemeral]        start the server, --ephemeral keeps all data in memory
+  nexa migrate status|up    show or apply pending schema migrations
+  nexa restore <file>       replace the SQLite database by a backup, the server must be stopped
+  nexa 2fa reset [user]     disable two-factor authentication of a user`
+
+// runCommand 执行管理命令
+func runCommand(args []string) error {
+	switch args[0] {
+	case "migrate":
+		if len(args) < 2 {
+			return errors.New(usage)
+		}
+		return migrateCommand(args[1])
+	case "restore":
+		if len(args) < 2 {
+			return errors.New(usage)
+		}
+		return restoreCommand(args[1])
+	case "2fa":
+		if len(args) < 2 || args[1] != "reset" {
+			return errors.New(usage)
+		}
+		name := defaultUser
+		if len(args) > 2 {
+			name = args[2]
+		}
+		return resetTwoFactor(name)
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	default:
+		return errors.New(usage)
+	}
+}
+
+func resetTwoFactor(name string) error {
+	ctx := context.Background()
+	db, err := openDB()
+	if err != nil {
+		return errors.Wrap(err, "open db error")
+	}
+
+	user, err := db.GetUser(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "get user %s error", name)
+	}
+	user.ResetTwoFactor()
+	if err := db.SaveUser(ctx, user); err != nil {
+		return errors.Wrap(err, "save user error")
+	}
+
+	fmt.Printf("two-factor authentication of %s has been reset\n", name)
+	return nil
+}
@@ -0,0 +1,879 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// dbBackends are the implementations every test of dbTests runs against,
+// PostgreSQL is tested when NEXA_TEST_POSTGRES_DSN is set to a postgres:// url.
+var dbBackends = []struct {
+	name string
+	open func(t *testing.T) DB
+}{
+	{"memory", func(t *testing.T) DB { return NewMemoryDB() }},
+	{"sqlite", openTestSQLite},
+	{"postgres", openTestPostgres},
+}
+
+func openTestSQLite(t *testing.T) DB {
+	db, err := NewSQLiteDB(":memory:")
+	check(t, err)
+	sqlDB, err := db.db.DB()
+	check(t, err)
+	// each connection to :memory: opens another database
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+	db.db = db.db.Session(&gorm.Session{Logger: logger.Discard})
+	check(t, db.Migrate(context.Background()))
+	return db
+}
+
+// openTestPostgres migrates a new schema, dropped after the test.
+func openTestPostgres(t *testing.T) DB {
+	dsn := os.Getenv("NEXA_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("NEXA_TEST_POSTGRES_DSN is not set")
+	}
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Skipf("postgres is not available: %v", err)
+	}
+	schema := fmt.Sprintf("nexa_test_%d", time.Now().UnixNano())
+	check(t, admin.Exec("CREATE SCHEMA "+schema).Error)
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	u, err := url.Parse(dsn)
+	check(t, err)
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	db, err := NewPostgresDB(u.String())
+	check(t, err)
+	sqlDB, err := db.db.DB()
+	check(t, err)
+	t.Cleanup(func() { sqlDB.Close() })
+	db.db = db.db.Session(&gorm.Session{Logger: logger.Discard})
+	check(t, db.Migrate(context.Background()))
+	return db
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func equal[T any](t *testing.T, got, want T) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func notFound(t *testing.T, err error) {
+	t.Helper()
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("got error %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
+
+func ids(items []*Item) []string {
+	return lo.Map(items, func(item *Item, _ int) string { return item.ID })
+}
+
+func sorted(s []string) []string {
+	s = slices.Clone(s)
+	slices.Sort(s)
+	return s
+}
+
+var testBase = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// seedDB stores two feeds with their items, newest first a3 (no pub_date), a1, a2, b1 and b2.
+// b1 is a duplicate of a1 from another feed.
+func seedDB(t *testing.T, ctx context.Context, db DB) {
+	t.Helper()
+	check(t, db.SaveFolder(ctx, &Folder{ID: "dev", Name: "Dev"}))
+	check(t, db.SaveFeed(ctx, &Feed{ID: "a", Title: "Alpha", Link: "https://example.com/feed", Tags: []string{"tech", "go"}, FolderID: "dev"}))
+	check(t, db.SaveFeed(ctx, &Feed{ID: "b", Title: "Beta", Link: "https://news.example.com/feed", Tags: []string{"news"}}))
+
+	cst := time.FixedZone("CST", 8*3600)
+	check(t, db.AddItem(ctx,
+		&Item{
+			ID: "a1", FeedID: "a", Title: "Go release", Description: "release notes", Author: "Alice",
+			Authors:    []*ItemAuthor{{Name: "Alice", Email: "alice@example.com"}},
+			Categories: []string{"Go", "Release"},
+			PubDate:    lo.ToPtr(testBase.AddDate(0, 0, 3)),
+			GUID:       "guid-a1", Link: "https://example.com/a1", CanonicalLink: "https://example.com/a1",
+			Enclosures: []*Enclosure{
+				{ID: "e1", ItemID: "a1", FeedID: "a", Position: 0, URL: "https://example.com/a1.mp3", Type: "audio/mpeg"},
+				{ID: "e2", ItemID: "a1", FeedID: "a", Position: 1, URL: "https://example.com/a1.jpg", Type: "image/jpeg"},
+			},
+		},
+		&Item{
+			ID: "a2", FeedID: "a", Title: "Rust news", Description: "about rust", Author: "Bob",
+			Authors:    []*ItemAuthor{{Name: "Bob"}},
+			Categories: []string{"GO"},
+			PubDate:    lo.ToPtr(testBase.AddDate(0, 0, 2).In(cst)),
+			Link:       "https://example.com/a2",
+			Enclosures: []*Enclosure{{ID: "e3", ItemID: "a2", FeedID: "a", URL: "https://example.com/a2.mp3", Type: "audio/mpeg"}},
+		},
+		&Item{ID: "a3", FeedID: "a", Title: "Untitled", Content: "draft", Link: "https://example.com/a3"},
+		&Item{
+			ID: "b1", FeedID: "b", Title: "Go release roundup", Description: "release",
+			Authors:    []*ItemAuthor{{Name: "Carol"}},
+			Categories: []string{"World"},
+			PubDate:    lo.ToPtr(testBase.AddDate(0, 0, 1)),
+			Link:       "https://news.example.com/b1?utm_source=x", CanonicalLink: "https://example.com/a1", ClusterID: "a1",
+		},
+		&Item{
+			ID: "b2", FeedID: "b", Title: "Weather", Description: "release of the forecast",
+			PubDate: lo.ToPtr(testBase), Link: "https://news.example.com/b2",
+		},
+	))
+}
+
+var dbTests = []struct {
+	name string
+	test func(t *testing.T, ctx context.Context, db DB)
+}{
+	{"feeds", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		feed, err := db.GetFeed(ctx, "a")
+		check(t, err)
+		equal(t, feed.Title, "Alpha")
+		equal(t, feed.FolderID, "dev")
+		equal(t, sorted(feed.Tags), []string{"go", "tech"})
+		_, err = db.GetFeed(ctx, "missing")
+		notFound(t, err)
+
+		feeds, err := db.FilterFeeds(ctx, nil)
+		check(t, err)
+		slices.SortFunc(feeds, func(x, y *ListFeedResult) int { return strings.Compare(x.ID, y.ID) })
+		equal(t, len(feeds), 2)
+		equal(t, []int{feeds[0].TotalCount, feeds[0].UnreadCount, feeds[0].StarredCount}, []int{3, 3, 0})
+		equal(t, sorted(feeds[1].Tags), []string{"news"})
+
+		feeds, err = db.FilterFeeds(ctx, []string{"news"})
+		check(t, err)
+		equal(t, lo.Map(feeds, func(feed *ListFeedResult, _ int) string { return feed.ID }), []string{"b"})
+
+		// saving replaces the tags
+		feed.Tags = []string{"go", ""}
+		check(t, db.SaveFeed(ctx, feed))
+		feed, err = db.GetFeed(ctx, "a")
+		check(t, err)
+		equal(t, feed.Tags, []string{"go"})
+	}},
+	{"delete feed", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.SaveHighlight(ctx, &Highlight{ID: "h1", ItemID: "a1", Quote: "release"}))
+		check(t, db.DeleteFeed(ctx, "a"))
+		_, err := db.GetFeed(ctx, "a")
+		notFound(t, err)
+		_, err = db.GetItem(ctx, "a1")
+		notFound(t, err)
+		_, err = db.GetHighlight(ctx, "h1")
+		notFound(t, err)
+		enclosures, err := db.FilterEnclosures(ctx, &EnclosureFilter{})
+		check(t, err)
+		equal(t, len(enclosures), 0)
+		tags, err := db.ListTags(ctx)
+		check(t, err)
+		equal(t, lo.Map(tags, func(tag *ListTagResult, _ int) string { return tag.Name }), []string{"news"})
+	}},
+	{"update feed", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		now := time.Now().UTC().Truncate(time.Second)
+		check(t, db.UpdateFeed(ctx, "a", &FeedUpdate{
+			UpstreamTitle: lo.ToPtr("Alpha Blog"),
+			SiteURL:       lo.ToPtr("https://example.com/"),
+			Language:      lo.ToPtr("en"),
+			IconPath:      lo.ToPtr("data/icons/a"),
+			IconCheckedAt: &now,
+		}))
+		feed, err := db.GetFeed(ctx, "a")
+		check(t, err)
+		equal(t, []string{feed.Title, feed.UpstreamTitle, feed.SiteURL, feed.Language, feed.IconPath}, []string{"Alpha Blog", "Alpha Blog", "https://example.com/", "en", "data/icons/a"})
+		equal(t, feed.IconCheckedAt != nil && feed.IconCheckedAt.Equal(now), true)
+		equal(t, feed.Link, "https://example.com/feed") // left untouched
+		equal(t, sorted(feed.Tags), []string{"go", "tech"})
+
+		// a custom title is kept
+		feed.CustomTitle, feed.Title = "Mine", "Mine"
+		check(t, db.SaveFeed(ctx, feed))
+		check(t, db.UpdateFeed(ctx, "a", &FeedUpdate{UpstreamTitle: lo.ToPtr("Alpha Blog 2")}))
+		feed, err = db.GetFeed(ctx, "a")
+		check(t, err)
+		equal(t, []string{feed.Title, feed.UpstreamTitle}, []string{"Mine", "Alpha Blog 2"})
+
+		check(t, db.UpdateFeed(ctx, "missing", &FeedUpdate{SiteURL: lo.ToPtr("x")}))
+		check(t, db.UpdateFeed(ctx, "a", &FeedUpdate{}))
+	}},
+	{"tags", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.UpdateItem(ctx, "b1", &ItemUpdate{Read: lo.ToPtr(true), Starred: lo.ToPtr(true)}))
+		check(t, db.SetTagColor(ctx, "news", "#ff0000"))
+		notFound(t, db.SetTagColor(ctx, "missing", "#ff0000"))
+		check(t, db.SetTagOrder(ctx, []string{"tech", "news"}))
+
+		tags, err := db.ListTags(ctx)
+		check(t, err)
+		equal(t, lo.Map(tags, func(tag *ListTagResult, _ int) string { return tag.Name }), []string{"go", "tech", "news"})
+		news := tags[2]
+		equal(t, []any{news.Position, news.Color, news.TotalCount, news.UnreadCount, news.StarredCount}, []any{2, "#ff0000", int64(2), int64(1), int64(1)})
+
+		notFound(t, db.RenameTag(ctx, "missing", "x", false))
+		equal(t, db.RenameTag(ctx, "tech", "go", false), ErrTagExists)
+		check(t, db.RenameTag(ctx, "news", "world", false))
+		check(t, db.RenameTag(ctx, "tech", "go", true))
+		tags, err = db.ListTags(ctx)
+		check(t, err)
+		equal(t, lo.Map(tags, func(tag *ListTagResult, _ int) string { return tag.Name + tag.Color }), []string{"go", "world#ff0000"})
+
+		check(t, db.DeleteTag(ctx, "go"))
+		notFound(t, db.DeleteTag(ctx, "go"))
+		feed, err := db.GetFeed(ctx, "a")
+		check(t, err)
+		equal(t, len(feed.Tags), 0)
+	}},
+	{"items", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		item, err := db.GetItem(ctx, "a1")
+		check(t, err)
+		equal(t, item.Title, "Go release")
+		equal(t, item.ClusterID, "a1")
+		equal(t, item.PubDate.Equal(testBase.AddDate(0, 0, 3)), true)
+		equal(t, lo.Map(item.Enclosures, func(e *Enclosure, _ int) string { return e.ID }), []string{"e1", "e2"})
+		equal(t, lo.Map(item.Authors, func(a *ItemAuthor, _ int) string { return a.Name + " " + a.Email }), []string{"Alice alice@example.com"})
+		equal(t, item.Categories, []string{"Go", "Release"})
+		_, err = db.GetItem(ctx, "missing")
+		notFound(t, err)
+
+		// adding a stored item keeps it, the details it lacks are added
+		check(t, db.UpdateItem(ctx, "a2", &ItemUpdate{Starred: lo.ToPtr(true)}))
+		check(t, db.AddItem(ctx, &Item{ID: "a2", FeedID: "a", Title: "Changed", Authors: []*ItemAuthor{{Name: "Bob"}, {Name: "Dave"}}, Categories: []string{"Rust"}}))
+		item, err = db.GetItem(ctx, "a2")
+		check(t, err)
+		equal(t, []any{item.Title, item.Starred}, []any{"Rust news", true})
+		equal(t, lo.Map(item.Authors, func(a *ItemAuthor, _ int) string { return a.Name }), []string{"Bob", "Dave"})
+		equal(t, item.Categories, []string{"GO", "Rust"})
+
+		existing, err := db.ExistingItemIDs(ctx, []string{"a1", "missing", "b2"})
+		check(t, err)
+		equal(t, sorted(existing), []string{"a1", "b2"})
+
+		item, err = db.FindItem(ctx, "", "guid-a1", "")
+		check(t, err)
+		equal(t, item.ID, "a1")
+		item, err = db.FindItem(ctx, "b", "", "https://news.example.com/b2")
+		check(t, err)
+		equal(t, item.ID, "b2")
+		_, err = db.FindItem(ctx, "b", "guid-a1", "")
+		notFound(t, err)
+		_, err = db.FindItem(ctx, "", "", "")
+		notFound(t, err)
+	}},
+	{"update item", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.UpdateItem(ctx, "a1", &ItemUpdate{
+			Read: lo.ToPtr(true), Starred: lo.ToPtr(true), Liked: lo.ToPtr(true),
+			Note: lo.ToPtr("to read again"), Labels: &[]string{"later", "go", "later", ""}, Position: lo.ToPtr(42),
+		}))
+		check(t, db.UpdateItem(ctx, "b1", &ItemUpdate{Labels: &[]string{"later"}}))
+		item, err := db.GetItem(ctx, "a1")
+		check(t, err)
+		equal(t, []any{item.Read, item.Starred, item.Liked, item.Note, item.Position}, []any{true, true, true, "to read again", 42})
+		equal(t, item.Labels, []string{"go", "later"})
+
+		// nil fields are left unchanged
+		check(t, db.UpdateItem(ctx, "a1", &ItemUpdate{Read: lo.ToPtr(false)}))
+		item, err = db.GetItem(ctx, "a1")
+		check(t, err)
+		equal(t, []any{item.Read, item.Starred, item.Note}, []any{false, true, "to read again"})
+		equal(t, item.Labels, []string{"go", "later"})
+
+		labels, err := db.ListLabels(ctx)
+		check(t, err)
+		equal(t, lo.Map(labels, func(label *ListLabelResult, _ int) string {
+			return fmt.Sprintf("%s %d/%d/%d", label.Name, label.TotalCount, label.UnreadCount, label.StarredCount)
+		}), []string{"go 1/1/1", "later 2/2/1"})
+
+		check(t, db.UpdateItem(ctx, "a1", &ItemUpdate{Labels: &[]string{}}))
+		item, err = db.GetItem(ctx, "a1")
+		check(t, err)
+		equal(t, len(item.Labels), 0)
+	}},
+	{"save item", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		item, err := db.GetItem(ctx, "a1")
+		check(t, err)
+		item.Title = "Go 2 release"
+		item.Authors = []*ItemAuthor{{Name: "Eve"}}
+		item.Categories = []string{"Go2"}
+		item.Labels = []string{"later"}
+		item.Enclosures = append(item.Enclosures, &Enclosure{ID: "e4", ItemID: "a1", FeedID: "a", Position: 2, URL: "https://example.com/a1.ogg"})
+		check(t, db.SaveItem(ctx, item))
+		item, err = db.GetItem(ctx, "a1")
+		check(t, err)
+		equal(t, item.Title, "Go 2 release")
+		equal(t, lo.Map(item.Authors, func(a *ItemAuthor, _ int) string { return a.Name }), []string{"Eve"})
+		equal(t, item.Categories, []string{"Go2"})
+		equal(t, item.Labels, []string{"later"})
+		equal(t, lo.Map(item.Enclosures, func(e *Enclosure, _ int) string { return e.ID }), []string{"e1", "e2", "e4"})
+
+		check(t, db.SaveItem(ctx, &Item{ID: "c1", FeedID: "b", Title: "Saved", CreatedAt: time.Now()}))
+		item, err = db.GetItem(ctx, "c1")
+		check(t, err)
+		equal(t, []string{item.Title, item.ClusterID}, []string{"Saved", "c1"})
+	}},
+	{"filter items", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.UpdateItem(ctx, "a1", &ItemUpdate{Read: lo.ToPtr(true), Starred: lo.ToPtr(true), Labels: &[]string{"later"}}))
+		check(t, db.UpdateItem(ctx, "b2", &ItemUpdate{Liked: lo.ToPtr(true)}))
+
+		for _, tt := range []struct {
+			name   string
+			filter ItemFilter
+			want   []string
+		}{
+			{"all", ItemFilter{}, []string{"a1", "a2", "a3", "b1", "b2"}},
+			{"feeds", ItemFilter{FeedIDs: []string{"b"}}, []string{"b1", "b2"}},
+			{"tags", ItemFilter{Tags: []string{"tech", "missing"}}, []string{"a1", "a2", "a3"}},
+			{"folders", ItemFilter{FolderIDs: []string{"dev"}}, []string{"a1", "a2", "a3"}},
+			{"feed titles", ItemFilter{FeedTitles: []string{"beta"}}, []string{"b1", "b2"}},
+			{"feed title ids", ItemFilter{FeedTitles: []string{"a"}}, []string{"a1", "a2", "a3"}},
+			{"labels", ItemFilter{Labels: []string{"later"}}, []string{"a1"}},
+			{"author names", ItemFilter{Authors: []string{"BOB", "carol"}}, []string{"a2", "b1"}},
+			{"author emails", ItemFilter{Authors: []string{"Alice@Example.com"}}, []string{"a1"}},
+			{"categories", ItemFilter{Categories: []string{"go"}}, []string{"a1", "a2"}},
+			{"clusters", ItemFilter{ClusterIDs: []string{"a1"}}, []string{"a1", "b1"}},
+			{"unread", ItemFilter{Unread: lo.ToPtr(true)}, []string{"a2", "a3", "b1", "b2"}},
+			{"read", ItemFilter{Unread: lo.ToPtr(false)}, []string{"a1"}},
+			{"starred", ItemFilter{Starred: lo.ToPtr(true)}, []string{"a1"}},
+			{"liked", ItemFilter{Liked: lo.ToPtr(true)}, []string{"b2"}},
+			{"published since", ItemFilter{PubDate: lo.ToPtr(testBase.AddDate(0, 0, 2))}, []string{"a1", "a2"}},
+			{"published before", ItemFilter{PubBefore: lo.ToPtr(testBase.AddDate(0, 0, 2))}, []string{"b1", "b2"}},
+			{"published before in another zone", ItemFilter{PubBefore: lo.ToPtr(testBase.AddDate(0, 0, 2).In(time.FixedZone("PST", -8*3600)))}, []string{"b1", "b2"}},
+			{"search", ItemFilter{SearchQuery: lo.ToPtr("release")}, []string{"a1", "b1", "b2"}},
+			{"collapse", ItemFilter{Collapse: true}, []string{"a1", "a2", "a3", "b2"}},
+			{"collapse unread", ItemFilter{Collapse: true, Unread: lo.ToPtr(true)}, []string{"a2", "a3", "b1", "b2"}},
+		} {
+			t.Run(tt.name, func(t *testing.T) {
+				items, err := db.FilterItems(ctx, &tt.filter)
+				check(t, err)
+				equal(t, sorted(ids(items)), tt.want)
+				count, err := db.CountItems(ctx, &tt.filter)
+				check(t, err)
+				equal(t, count, int64(len(tt.want)))
+			})
+		}
+	}},
+	{"paginate items", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		items, err := db.FilterItems(ctx, &ItemFilter{FeedIDs: []string{"b"}, Limit: lo.ToPtr(1), Offset: lo.ToPtr(1)})
+		check(t, err)
+		equal(t, ids(items), []string{"b2"})
+	}},
+	{"search query", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		// a second author
+		check(t, db.AddItem(ctx, &Item{ID: "a2", FeedID: "a", Authors: []*ItemAuthor{{Name: "Bob"}, {Name: "Dave"}}}))
+		now := testBase.AddDate(0, 0, 10)
+		for _, tt := range []struct {
+			query string
+			want  []string
+		}{
+			{"release", []string{"a1", "b1", "b2"}},
+			{"title:release", []string{"a1", "b1"}},
+			{"release -title:roundup", []string{"a1", "b2"}},
+			{"content:draft", []string{"a3"}},
+			{"author:alice", []string{"a1"}},
+			{"author:dave", []string{"a2"}},
+			{"feed:alpha -author:dave", []string{"a1", "a3"}},
+			{"link:news.example.com", []string{"b1", "b2"}},
+			{"feed:alpha category:GO", []string{"a1", "a2"}},
+			{"tag:news after:2024-01-02", []string{"b1"}},
+			{"before:9d", []string{"b2"}},
+			{`"100%"`, []string{}},
+		} {
+			t.Run(tt.query, func(t *testing.T) {
+				filter := new(ItemFilter)
+				check(t, ParseQuery(tt.query, filter, now))
+				items, err := db.FilterItems(ctx, filter)
+				check(t, err)
+				equal(t, sorted(ids(items)), sorted(tt.want))
+			})
+		}
+	}},
+	{"sort items", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.UpdateItem(ctx, "a1", &ItemUpdate{Read: lo.ToPtr(true)}))
+		for _, tt := range []struct {
+			filter ItemFilter
+			want   []string
+		}{
+			{ItemFilter{}, []string{"a3", "a1", "a2", "b1", "b2"}},
+			{ItemFilter{Sort: SortNewest}, []string{"a3", "a1", "a2", "b1", "b2"}},
+			{ItemFilter{Sort: SortOldest}, []string{"b2", "b1", "a2", "a1", "a3"}},
+			{ItemFilter{Sort: SortCreatedAt}, []string{"b2", "b1", "a3", "a2", "a1"}},
+			{ItemFilter{Sort: SortFeed}, []string{"a3", "a1", "a2", "b1", "b2"}},
+			{ItemFilter{Sort: SortUnread}, []string{"a3", "a2", "b1", "b2", "a1"}},
+			{ItemFilter{Sort: SortRelevance, SearchQuery: lo.ToPtr("release")}, []string{"a1", "b1", "b2"}},
+			{ItemFilter{Sort: SortRelevance, Terms: []SearchTerm{{Text: "release"}, {Field: TermContent, Text: "forecast", Exclude: true}}}, []string{"a1", "b1"}},
+			{ItemFilter{Sort: SortNewest, Limit: lo.ToPtr(2), Offset: lo.ToPtr(1)}, []string{"a1", "a2"}},
+		} {
+			t.Run(string(tt.filter.Sort), func(t *testing.T) {
+				items, err := db.FilterItems(ctx, &tt.filter)
+				check(t, err)
+				equal(t, ids(items), tt.want)
+			})
+		}
+	}},
+	{"cursor pagination", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		for _, sort := range []ItemSort{SortNewest, SortOldest, SortCreatedAt} {
+			t.Run(string(sort), func(t *testing.T) {
+				all, err := db.FilterItems(ctx, &ItemFilter{Sort: sort})
+				check(t, err)
+				var got []string
+				filter := &ItemFilter{Sort: sort, Limit: lo.ToPtr(2)}
+				for page := 0; page < len(all); page++ {
+					items, err := db.FilterItems(ctx, filter)
+					check(t, err)
+					if len(items) == 0 {
+						break
+					}
+					got = append(got, ids(items)...)
+					filter.Cursor, err = decodeCursor(encodeCursor(items[len(items)-1], sort))
+					check(t, err)
+				}
+				equal(t, got, ids(all))
+
+				// the time of the cursor may be in any location
+				cursor, err := decodeCursor(encodeCursor(all[1], sort))
+				check(t, err)
+				cursor.Time = cursor.Time.In(time.FixedZone("CST", 8*3600))
+				items, err := db.FilterItems(ctx, &ItemFilter{Sort: sort, Cursor: cursor})
+				check(t, err)
+				equal(t, ids(items), ids(all[2:]))
+			})
+		}
+	}},
+	{"duplicate candidates", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		candidates, err := db.DuplicateCandidates(ctx, time.Now().Add(-time.Hour), nil)
+		check(t, err)
+		equal(t, sorted(ids(candidates)), []string{"a1", "a2", "a3", "b1", "b2"})
+		b1, _ := lo.Find(candidates, func(item *Item) bool { return item.ID == "b1" })
+		equal(t, []string{b1.FeedID, b1.CanonicalLink, b1.ClusterID}, []string{"b", "https://example.com/a1", "a1"})
+
+		candidates, err = db.DuplicateCandidates(ctx, time.Now().Add(time.Hour), []string{"https://example.com/a1", ""})
+		check(t, err)
+		equal(t, sorted(ids(candidates)), []string{"a1", "b1"})
+	}},
+	{"purgeable items", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.AddItem(ctx,
+			&Item{ID: "a4", FeedID: "a", Title: "Starred", PubDate: lo.ToPtr(testBase.Add(-time.Hour))},
+			&Item{ID: "a5", FeedID: "a", Title: "Liked", PubDate: lo.ToPtr(testBase.Add(-2 * time.Hour))},
+			&Item{ID: "a6", FeedID: "a", Title: "Labeled", PubDate: lo.ToPtr(testBase.Add(-3 * time.Hour))},
+			&Item{ID: "a7", FeedID: "a", Title: "Annotated", PubDate: lo.ToPtr(testBase.Add(-4 * time.Hour))},
+			&Item{ID: "a8", FeedID: "a", Title: "Highlighted", PubDate: lo.ToPtr(testBase.Add(-5 * time.Hour))},
+			&Item{ID: "a9", FeedID: "a", Title: "Listed", PubDate: lo.ToPtr(testBase.Add(-6 * time.Hour))},
+			&Item{ID: "a10", FeedID: "a", Title: "Old", PubDate: lo.ToPtr(testBase.Add(-7 * time.Hour))},
+		))
+		check(t, db.UpdateItem(ctx, "a4", &ItemUpdate{Starred: lo.ToPtr(true)}))
+		check(t, db.UpdateItem(ctx, "a5", &ItemUpdate{Liked: lo.ToPtr(true)}))
+		check(t, db.UpdateItem(ctx, "a6", &ItemUpdate{Labels: &[]string{"keep"}}))
+		check(t, db.UpdateItem(ctx, "a7", &ItemUpdate{Note: lo.ToPtr("keep")}))
+		check(t, db.SaveHighlight(ctx, &Highlight{ID: "h1", ItemID: "a8", Quote: "Highlighted"}))
+		check(t, db.MarkInFeed(ctx, "a", []string{"a9"}))
+
+		items, err := db.PurgeableItems(ctx, "a", 0, nil)
+		check(t, err)
+		equal(t, ids(items), []string{"a10", "a2", "a1", "a3"})
+		items, err = db.PurgeableItems(ctx, "a", 2, nil)
+		check(t, err)
+		equal(t, ids(items), []string{"a10", "a2"})
+		items, err = db.PurgeableItems(ctx, "a", 0, lo.ToPtr(testBase.AddDate(0, 0, 2).Add(time.Minute).In(time.FixedZone("CST", 8*3600))))
+		check(t, err)
+		equal(t, ids(items), []string{"a10", "a2"})
+
+		// items no longer listed can be purged
+		check(t, db.MarkInFeed(ctx, "a", nil))
+		items, err = db.PurgeableItems(ctx, "a", 0, lo.ToPtr(testBase))
+		check(t, err)
+		equal(t, ids(items), []string{"a10", "a9"})
+		items, err = db.PurgeableItems(ctx, "b", 1, nil)
+		check(t, err)
+		equal(t, ids(items), []string{"b2"})
+	}},
+	{"delete items", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.UpdateItem(ctx, "a1", &ItemUpdate{Labels: &[]string{"later"}}))
+		check(t, db.SaveHighlight(ctx, &Highlight{ID: "h1", ItemID: "a1", Quote: "release"}))
+		check(t, db.DeleteItems(ctx, "a1", "b2", "missing"))
+		items, err := db.FilterItems(ctx, &ItemFilter{})
+		check(t, err)
+		equal(t, sorted(ids(items)), []string{"a2", "a3", "b1"})
+		_, err = db.GetHighlight(ctx, "h1")
+		notFound(t, err)
+		labels, err := db.ListLabels(ctx)
+		check(t, err)
+		equal(t, len(labels), 0)
+		enclosures, err := db.FilterEnclosures(ctx, &EnclosureFilter{})
+		check(t, err)
+		equal(t, lo.Map(enclosures, func(e *Enclosure, _ int) string { return e.ID }), []string{"e3"})
+		categories, err := db.TopCategories(ctx, "a", 10)
+		check(t, err)
+		equal(t, lo.Map(categories, func(c *ListCategoryResult, _ int) int64 { return c.TotalCount }), []int64{1})
+	}},
+	{"top categories", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.UpdateItem(ctx, "a2", &ItemUpdate{Starred: lo.ToPtr(true), Read: lo.ToPtr(true)}))
+		categories, err := db.TopCategories(ctx, "a", 10)
+		check(t, err)
+		equal(t, len(categories), 2)
+		// Go and GO are counted together
+		equal(t, strings.EqualFold(categories[0].Name, "go"), true)
+		equal(t, []int64{categories[0].TotalCount, categories[0].UnreadCount, categories[0].StarredCount}, []int64{2, 1, 1})
+		equal(t, categories[1].Name, "Release")
+
+		categories, err = db.TopCategories(ctx, "a", 1)
+		check(t, err)
+		equal(t, len(categories), 1)
+		categories, err = db.TopCategories(ctx, "missing", 10)
+		check(t, err)
+		equal(t, len(categories), 0)
+	}},
+	{"highlights", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.SaveHighlight(ctx, &Highlight{ID: "h1", ItemID: "a1", Quote: "Go", Start: 0, End: 2, CreatedAt: testBase}))
+		check(t, db.SaveHighlight(ctx, &Highlight{ID: "h2", ItemID: "a1", Quote: "release", Start: 3, End: 10, CreatedAt: testBase.Add(time.Hour)}))
+		check(t, db.SaveHighlight(ctx, &Highlight{ID: "h3", ItemID: "b1", Quote: "roundup", CreatedAt: testBase.Add(2 * time.Hour)}))
+
+		highlights, err := db.FilterHighlights(ctx, &HighlightFilter{})
+		check(t, err)
+		equal(t, lo.Map(highlights, func(h *Highlight, _ int) string { return h.ID }), []string{"h3", "h2", "h1"})
+		highlights, err = db.FilterHighlights(ctx, &HighlightFilter{ItemIDs: []string{"a1"}, Limit: lo.ToPtr(1), Offset: lo.ToPtr(1)})
+		check(t, err)
+		equal(t, lo.Map(highlights, func(h *Highlight, _ int) string { return h.ID }), []string{"h1"})
+		count, err := db.CountHighlights(ctx, &HighlightFilter{ItemIDs: []string{"a1"}})
+		check(t, err)
+		equal(t, count, int64(2))
+
+		highlight, err := db.GetHighlight(ctx, "h2")
+		check(t, err)
+		equal(t, []any{highlight.ItemID, highlight.Quote, highlight.Start, highlight.End}, []any{"a1", "release", 3, 10})
+		highlight.Comment, highlight.Orphaned = "nice", true
+		check(t, db.SaveHighlight(ctx, highlight))
+		highlight, err = db.GetHighlight(ctx, "h2")
+		check(t, err)
+		equal(t, []any{highlight.Comment, highlight.Orphaned}, []any{"nice", true})
+
+		check(t, db.DeleteHighlight(ctx, "h2"))
+		notFound(t, db.DeleteHighlight(ctx, "h2"))
+		_, err = db.GetHighlight(ctx, "h2")
+		notFound(t, err)
+	}},
+	{"rules", func(t *testing.T, ctx context.Context, db DB) {
+		check(t, db.SaveRule(ctx, &Rule{ID: "r1", Name: "second", Enabled: true, Position: 2,
+			Conditions: []RuleCondition{{Field: "title", Op: "contains", Value: "go"}},
+			Actions:    []RuleAction{{Type: "label", Value: "go"}},
+		}))
+		check(t, db.SaveRule(ctx, &Rule{ID: "r2", Name: "first", Position: 1, FeedIDs: []string{"a"}, Tags: []string{"tech"}, Match: "any",
+			Conditions: []RuleCondition{{Field: "age", Op: "older_than", Value: "7d"}},
+			Actions:    []RuleAction{{Type: "read"}},
+		}))
+		rules, err := db.ListRules(ctx)
+		check(t, err)
+		equal(t, lo.Map(rules, func(rule *Rule, _ int) string { return rule.ID }), []string{"r2", "r1"})
+
+		rule, err := db.GetRule(ctx, "r2")
+		check(t, err)
+		equal(t, rule.FeedIDs, []string{"a"})
+		equal(t, rule.Tags, []string{"tech"})
+		equal(t, rule.Conditions, []RuleCondition{{Field: "age", Op: "older_than", Value: "7d"}})
+		equal(t, rule.Actions, []RuleAction{{Type: "read"}})
+		equal(t, rule.CreatedAt.IsZero(), false)
+
+		rule.Position = 3
+		check(t, db.SaveRule(ctx, rule))
+		rules, err = db.ListRules(ctx)
+		check(t, err)
+		equal(t, lo.Map(rules, func(rule *Rule, _ int) string { return rule.ID }), []string{"r1", "r2"})
+
+		check(t, db.DeleteRule(ctx, "r1"))
+		notFound(t, db.DeleteRule(ctx, "r1"))
+		_, err = db.GetRule(ctx, "r1")
+		notFound(t, err)
+	}},
+	{"smart feeds", func(t *testing.T, ctx context.Context, db DB) {
+		check(t, db.SaveSmartFeed(ctx, &SmartFeed{ID: "s1", Name: "Unread Go", Tags: []string{"go"}, Labels: []string{"later"}, Query: "title:go", Unread: true, Days: 7, Sort: SortOldest}))
+		check(t, db.SaveSmartFeed(ctx, &SmartFeed{ID: "s2", Name: "Alpha", FeedIDs: []string{"a"}}))
+		smartFeeds, err := db.ListSmartFeeds(ctx)
+		check(t, err)
+		equal(t, lo.Map(smartFeeds, func(f *SmartFeed, _ int) string { return f.ID }), []string{"s2", "s1"})
+
+		smartFeed, err := db.GetSmartFeed(ctx, "s1")
+		check(t, err)
+		equal(t, []any{smartFeed.Tags, smartFeed.Labels, smartFeed.Query, smartFeed.Unread, smartFeed.Days, smartFeed.Sort},
+			[]any{[]string{"go"}, []string{"later"}, "title:go", true, 7, SortOldest})
+
+		check(t, db.DeleteSmartFeed(ctx, "s1"))
+		notFound(t, db.DeleteSmartFeed(ctx, "s1"))
+		_, err = db.GetSmartFeed(ctx, "s1")
+		notFound(t, err)
+	}},
+	{"output feeds", func(t *testing.T, ctx context.Context, db DB) {
+		check(t, db.SaveOutputFeed(ctx, &OutputFeed{ID: "o1", Name: "Starred", Token: "t1", Starred: true, Limit: 20}))
+		check(t, db.SaveOutputFeed(ctx, &OutputFeed{ID: "o2", Name: "Go", Token: "t2", SmartFeedID: "s1", Tags: []string{"go"}}))
+		outputFeeds, err := db.ListOutputFeeds(ctx)
+		check(t, err)
+		equal(t, lo.Map(outputFeeds, func(f *OutputFeed, _ int) string { return f.ID }), []string{"o2", "o1"})
+
+		outputFeed, err := db.FindOutputFeed(ctx, "t2")
+		check(t, err)
+		equal(t, []any{outputFeed.ID, outputFeed.SmartFeedID, outputFeed.Tags}, []any{"o2", "s1", []string{"go"}})
+		_, err = db.FindOutputFeed(ctx, "missing")
+		notFound(t, err)
+
+		outputFeed, err = db.GetOutputFeed(ctx, "o1")
+		check(t, err)
+		outputFeed.Token = "t3"
+		check(t, db.SaveOutputFeed(ctx, outputFeed))
+		_, err = db.FindOutputFeed(ctx, "t1")
+		notFound(t, err)
+		outputFeed, err = db.FindOutputFeed(ctx, "t3")
+		check(t, err)
+		equal(t, []any{outputFeed.ID, outputFeed.Starred, outputFeed.Limit}, []any{"o1", true, 20})
+
+		check(t, db.DeleteOutputFeed(ctx, "o1"))
+		notFound(t, db.DeleteOutputFeed(ctx, "o1"))
+		_, err = db.GetOutputFeed(ctx, "o1")
+		notFound(t, err)
+	}},
+	{"enclosures", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		enclosureIDs := func(filter *EnclosureFilter) []string {
+			t.Helper()
+			enclosures, err := db.FilterEnclosures(ctx, filter)
+			check(t, err)
+			return lo.Map(enclosures, func(e *Enclosure, _ int) string { return e.ID })
+		}
+		equal(t, enclosureIDs(&EnclosureFilter{}), []string{"e3", "e1", "e2"})
+		equal(t, enclosureIDs(&EnclosureFilter{ItemIDs: []string{"a1"}}), []string{"e1", "e2"})
+		equal(t, enclosureIDs(&EnclosureFilter{FeedIDs: []string{"b"}}), []string{})
+
+		enclosure, err := db.GetEnclosure(ctx, "e1")
+		check(t, err)
+		equal(t, []any{enclosure.ItemID, enclosure.URL, enclosure.Type}, []any{"a1", "https://example.com/a1.mp3", "audio/mpeg"})
+		_, err = db.GetEnclosure(ctx, "missing")
+		notFound(t, err)
+
+		enclosure.Path, enclosure.Size, enclosure.DownloadedAt = "data/enclosures/a/e1.mp3", 1024, lo.ToPtr(time.Now())
+		check(t, db.SaveEnclosure(ctx, enclosure))
+		equal(t, enclosureIDs(&EnclosureFilter{Downloaded: lo.ToPtr(true)}), []string{"e1"})
+		equal(t, enclosureIDs(&EnclosureFilter{Downloaded: lo.ToPtr(false)}), []string{"e3", "e2"})
+
+		// adding the item again keeps the local copy
+		check(t, db.AddItem(ctx, &Item{ID: "a1", FeedID: "a", Enclosures: []*Enclosure{{ID: "e1", ItemID: "a1", FeedID: "a", URL: "https://example.com/a1.mp3"}}}))
+		enclosure, err = db.GetEnclosure(ctx, "e1")
+		check(t, err)
+		equal(t, []any{enclosure.Path, enclosure.Size}, []any{"data/enclosures/a/e1.mp3", int64(1024)})
+	}},
+	{"folders", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.SaveFolder(ctx, &Folder{ID: "go", Name: "Go", ParentID: "dev", Position: 1}))
+		check(t, db.SaveFolder(ctx, &Folder{ID: "news", Name: "News"}))
+		folders, err := db.ListFolders(ctx)
+		check(t, err)
+		equal(t, lo.Map(folders, func(f *Folder, _ int) string { return f.ID }), []string{"dev", "news", "go"})
+
+		feed, err := db.GetFeed(ctx, "b")
+		check(t, err)
+		feed.FolderID = "go"
+		check(t, db.SaveFeed(ctx, feed))
+		items, err := db.FilterItems(ctx, &ItemFilter{FolderIDs: []string{"go"}})
+		check(t, err)
+		equal(t, sorted(ids(items)), []string{"b1", "b2"})
+
+		// subfolders and feeds move to the parent
+		check(t, db.DeleteFolder(ctx, "dev"))
+		notFound(t, db.DeleteFolder(ctx, "dev"))
+		_, err = db.GetFolder(ctx, "dev")
+		notFound(t, err)
+		folder, err := db.GetFolder(ctx, "go")
+		check(t, err)
+		equal(t, folder.ParentID, "")
+		feed, err = db.GetFeed(ctx, "a")
+		check(t, err)
+		equal(t, feed.FolderID, "")
+		check(t, db.DeleteFolder(ctx, "go"))
+		feed, err = db.GetFeed(ctx, "b")
+		check(t, err)
+		equal(t, feed.FolderID, "")
+	}},
+	{"users", func(t *testing.T, ctx context.Context, db DB) {
+		_, err := db.GetUser(ctx, "admin")
+		notFound(t, err)
+		check(t, db.SaveUser(ctx, &User{Name: "admin", TOTPSecret: "secret", TOTPEnabled: true, RecoveryCodes: []string{"c1", "c2"}}))
+		user, err := db.GetUser(ctx, "admin")
+		check(t, err)
+		equal(t, []any{user.TOTPSecret, user.TOTPEnabled, user.RecoveryCodes}, []any{"secret", true, []string{"c1", "c2"}})
+		equal(t, user.CreatedAt.IsZero(), false)
+
+		user.ResetTwoFactor()
+		check(t, db.SaveUser(ctx, user))
+		user, err = db.GetUser(ctx, "admin")
+		check(t, err)
+		equal(t, []any{user.TOTPSecret, user.TOTPEnabled, len(user.RecoveryCodes)}, []any{"", false, 0})
+	}},
+	{"maintenance", func(t *testing.T, ctx context.Context, db DB) {
+		seedDB(t, ctx, db)
+		check(t, db.Optimize(ctx))
+
+		path := filepath.Join(t.TempDir(), "backup.db")
+		err := db.Backup(ctx, path)
+		if _, ok := db.(*SQLiteDB); !ok {
+			equal(t, err != nil, true)
+			return
+		}
+		check(t, err)
+		backup, err := NewSQLiteDB(path)
+		check(t, err)
+		backup.db = backup.db.Session(&gorm.Session{Logger: logger.Discard})
+		version, err := backup.SchemaVersion(ctx)
+		check(t, err)
+		equal(t, version, latestSchemaVersion())
+		item, err := backup.GetItem(ctx, "a1")
+		check(t, err)
+		equal(t, item.Title, "Go release")
+
+		// backups taken in the same second do not collide
+		backupConfig.Dir = t.TempDir()
+		svc := &Service{db: db}
+		first, err := svc.backup(ctx)
+		check(t, err)
+		second, err := svc.backup(ctx)
+		check(t, err)
+		equal(t, first != second, true)
+		equal(t, strings.HasSuffix(first, "Z.db"), true)
+	}},
+	{"migrations", func(t *testing.T, ctx context.Context, db DB) {
+		sqlDB, ok := db.(SQLDB)
+		if !ok {
+			t.Skip("no schema")
+		}
+		version, err := sqlDB.SchemaVersion(ctx)
+		check(t, err)
+		equal(t, version, latestSchemaVersion())
+		pending, err := sqlDB.PendingMigrations(ctx)
+		check(t, err)
+		equal(t, len(pending), 0)
+		check(t, sqlDB.Migrate(ctx))
+	}},
+	{"purge", func(t *testing.T, ctx context.Context, db DB) {
+		downloadConfig.Dir = t.TempDir()
+		seedDB(t, ctx, db)
+		feed, err := db.GetFeed(ctx, "a")
+		check(t, err)
+		feed.RetentionMaxItems = 1
+		check(t, db.SaveFeed(ctx, feed))
+		check(t, db.UpdateItem(ctx, "a2", &ItemUpdate{Starred: lo.ToPtr(true)}))
+
+		svc := &Service{db: db}
+		results, err := svc.purge(ctx, true)
+		check(t, err)
+		equal(t, len(results), 1)
+		equal(t, ids(results[0].Items), []string{"a1"})
+		_, err = svc.purge(ctx, false)
+		check(t, err)
+		items, err := db.FilterItems(ctx, &ItemFilter{FeedIDs: []string{"a"}})
+		check(t, err)
+		equal(t, ids(items), []string{"a3", "a2"})
+	}},
+	{"apply rule", func(t *testing.T, ctx context.Context, db DB) {
+		downloadConfig.Dir = t.TempDir()
+		seedDB(t, ctx, db)
+		_, err := compileRule(&Rule{Name: "empty", Actions: []RuleAction{{Type: "delete"}}})
+		equal(t, err != nil, true)
+
+		check(t, db.UpdateItem(ctx, "b1", &ItemUpdate{Starred: lo.ToPtr(true)}))
+		check(t, db.SaveHighlight(ctx, &Highlight{ID: "h1", ItemID: "b2", Quote: "forecast"}))
+		rule, err := compileRule(&Rule{Name: "releases", Enabled: true, Tags: []string{"news"},
+			Conditions: []RuleCondition{{Field: "content", Op: "contains", Value: "release"}},
+			Actions:    []RuleAction{{Type: "delete"}},
+		})
+		check(t, err)
+		svc := &Service{db: db}
+		result, err := svc.applyRule(ctx, rule)
+		check(t, err)
+		equal(t, *result, RuleApplyResult{Matched: 2, Protected: 2})
+
+		rule, err = compileRule(&Rule{Name: "label", Enabled: true,
+			Conditions: []RuleCondition{{Field: "title", Op: "contains", Value: "release"}},
+			Actions:    []RuleAction{{Type: "label", Value: "go"}, {Type: "read"}},
+		})
+		check(t, err)
+		result, err = svc.applyRule(ctx, rule)
+		check(t, err)
+		equal(t, *result, RuleApplyResult{Matched: 2, Updated: 2})
+		items, err := db.FilterItems(ctx, &ItemFilter{Labels: []string{"go"}, Unread: lo.ToPtr(false)})
+		check(t, err)
+		equal(t, sorted(ids(items)), []string{"a1", "b1"})
+	}},
+	{"adopt imported items", func(t *testing.T, ctx context.Context, db DB) {
+		check(t, db.SaveFeed(ctx, &Feed{ID: "a", Title: "Alpha"}))
+		check(t, db.AddItem(ctx,
+			&Item{ID: importedItemID("guid-1", "https://example.com/1"), FeedID: "a", GUID: "guid-1", Link: "https://example.com/1"},
+			&Item{ID: importedItemID("", "https://example.com/2"), FeedID: "a", Link: "https://example.com/2"},
+		))
+		fetched := []*Item{
+			{ID: "f1", FeedID: "a", GUID: "guid-1", Link: "https://example.com/1",
+				Enclosures: []*Enclosure{{ID: enclosureID("f1", "https://example.com/1.mp3"), ItemID: "f1", URL: "https://example.com/1.mp3"}}},
+			{ID: "f2", FeedID: "a", GUID: "guid-2", Link: "https://example.com/2"},
+			{ID: "f3", FeedID: "a", GUID: "guid-3", Link: "https://example.com/2"},
+			{ID: "f4", FeedID: "a", Link: "https://example.com/4"},
+		}
+		svc := &Service{db: db}
+		check(t, svc.adoptImportedItems(ctx, fetched))
+		equal(t, ids(fetched), []string{importedItemID("guid-1", ""), importedItemID("", "https://example.com/2"), "f3", "f4"})
+		equal(t, fetched[0].Enclosures[0].ItemID, fetched[0].ID)
+		equal(t, fetched[0].Enclosures[0].ID, enclosureID(fetched[0].ID, "https://example.com/1.mp3"))
+	}},
+}
+
+func TestDB(t *testing.T) {
+	for _, backend := range dbBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			for _, tt := range dbTests {
+				t.Run(tt.name, func(t *testing.T) {
+					tt.test(t, context.Background(), backend.open(t))
+				})
+			}
+		})
+	}
+}
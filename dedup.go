@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"gorm.io/gorm"
+)
+
+var dedupConfig struct {
+	WindowDays int // new items are compared to the items fetched in the last N days
+	Distance   int // most differing bits between the simhashes of near duplicates
+}
+
+func init() {
+	dedupConfig.WindowDays, _ = strconv.Atoi(os.Getenv("NEXA_DEDUP_WINDOW_DAYS"))
+	if dedupConfig.WindowDays <= 0 {
+		dedupConfig.WindowDays = 3
+	}
+	dedupConfig.Distance = 3
+	if distance, err := strconv.Atoi(os.Getenv("NEXA_DEDUP_DISTANCE")); err == nil {
+		dedupConfig.Distance = distance
+	}
+}
+
+// shorter texts get no simhash, they collide too easily
+const simHashMinWords = 8
+
+// simHash is the 64 bits SimHash of the words of the title and text of the item,
+// near duplicate texts get hashes differing by a few bits. It is 0 for short texts.
+func simHash(item *Item) int64 {
+	words := strings.FieldsFunc(strings.ToLower(item.Title+" "+string(itemText(item))), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) < simHashMinWords {
+		return 0
+	}
+	var weights [64]int
+	for _, word := range words {
+		h := fnv.New64a()
+		h.Write([]byte(word))
+		sum := h.Sum64()
+		for bit := range weights {
+			if sum&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	var hash uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			hash |= 1 << bit
+		}
+	}
+	return int64(hash)
+}
+
+// nearDuplicate reports whether the simhashes are close enough for the items to be the same story.
+func nearDuplicate(a, b int64) bool {
+	return a != 0 && b != 0 && bits.OnesCount64(uint64(a^b)) <= dedupConfig.Distance
+}
+
+// clusterItems sets the simhash and cluster of new items, their canonical links are set by normalizeLinks.
+// An item joins the cluster of an earlier item with the same canonical link,
+// or of a near duplicate from another feed, otherwise it starts its own cluster.
+func (svc *Service) clusterItems(ctx context.Context, items []*Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	for _, item := range items {
+		item.SimHash = simHash(item)
+	}
+
+	since := time.Now().AddDate(0, 0, -dedupConfig.WindowDays)
+	candidates, err := svc.db.DuplicateCandidates(ctx, since, lo.Map(items, func(item *Item, _ int) string { return item.CanonicalLink }))
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		match, found := lo.Find(candidates, func(candidate *Item) bool {
+			return item.CanonicalLink != "" && candidate.CanonicalLink == item.CanonicalLink
+		})
+		if !found {
+			match, found = lo.Find(candidates, func(candidate *Item) bool {
+				return candidate.FeedID != item.FeedID && nearDuplicate(candidate.SimHash, item.SimHash)
+			})
+		}
+		item.ClusterID = item.ID
+		if found {
+			item.ClusterID = lo.CoalesceOrEmpty(match.ClusterID, match.ID)
+		}
+		candidates = append(candidates, item)
+	}
+	return nil
+}
+
+// markClusterRead sets the read state of the other items of the cluster of the item.
+func (svc *Service) markClusterRead(ctx context.Context, itemID string, read bool) error {
+	item, err := svc.db.GetItem(ctx, itemID)
+	if err != nil {
+		return errors.Wrap(err, "get item error")
+	}
+	duplicates, err := svc.db.FilterItems(ctx, &ItemFilter{ClusterIDs: []string{item.ClusterID}, Unread: lo.ToPtr(read)})
+	if err != nil {
+		return errors.Wrap(err, "list cluster items error")
+	}
+	for _, duplicate := range duplicates {
+		if err := svc.db.UpdateItem(ctx, duplicate.ID, &ItemUpdate{Read: &read}); err != nil {
+			return errors.Wrapf(err, "update item %s error", duplicate.ID)
+		}
+	}
+	return nil
+}
+
+// ListItemCluster 列出与文章同一簇的所有文章，包括它自己
+func (svc *Service) ListItemCluster(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	item, err := svc.db.GetItem(ctx, c.Param("item_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "item not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	items, err := svc.db.FilterItems(ctx, &ItemFilter{ClusterIDs: []string{item.ClusterID}, Sort: SortOldest})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	signEnclosures(items...)
+	c.JSON(200, gin.H{"cluster_id": item.ClusterID, "items": items})
+}
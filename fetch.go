@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/mmcdole/gofeed"
+	"github.com/samber/lo"
 )
 
 var httpClient *http.Client
@@ -50,6 +52,29 @@ func FetchFeed(ctx context.Context, feed *Feed) (*gofeed.Feed, error) {
 	return gofeed.NewParser().ParseString(string(sanitizeXML(body)))
 }
 
+// parseAuthors returns the distinct authors of the item, named by their email when they have no name.
+func parseAuthors(raw *gofeed.Item) []*ItemAuthor {
+	authors := []*ItemAuthor{}
+	for _, person := range raw.Authors {
+		if person == nil {
+			continue
+		}
+		author := &ItemAuthor{Name: strings.TrimSpace(person.Name), Email: strings.TrimSpace(person.Email)}
+		author.Name = lo.CoalesceOrEmpty(author.Name, author.Email)
+		if author.Name == "" || lo.ContainsBy(authors, func(a *ItemAuthor) bool { return strings.EqualFold(a.Name, author.Name) }) {
+			continue
+		}
+		authors = append(authors, author)
+	}
+	return authors
+}
+
+// parseCategories returns the non empty categories of the item, distinct ignoring case.
+func parseCategories(raw *gofeed.Item) []string {
+	categories := lo.Compact(lo.Map(raw.Categories, func(category string, _ int) string { return strings.TrimSpace(category) }))
+	return lo.UniqBy(categories, strings.ToLower)
+}
+
 func sanitizeXML(content []byte) []byte {
 	// Remove ASCII control characters except for whitespace
 	sanitized := make([]byte, 0, len(content))
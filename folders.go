@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ListFolderResult is a folder with its subfolders, counts include the whole subtree.
+type ListFolderResult struct {
+	*Folder
+	FeedIDs      []string            `json:"feed_ids"` // feeds directly in the folder
+	Children     []*ListFolderResult `json:"children"`
+	UnreadCount  int                 `json:"unread_count"`
+	StarredCount int                 `json:"starred_count"`
+	TotalCount   int                 `json:"total_count"`
+}
+
+// folderTree nests the folders and rolls the counts of their feeds up to the root folders.
+func folderTree(folders []*Folder, feeds []*ListFeedResult) []*ListFolderResult {
+	nodes := make(map[string]*ListFolderResult, len(folders))
+	for _, folder := range folders {
+		nodes[folder.ID] = &ListFolderResult{Folder: folder, FeedIDs: []string{}, Children: []*ListFolderResult{}}
+	}
+	for _, feed := range feeds {
+		if node := nodes[feed.FolderID]; node != nil {
+			node.FeedIDs = append(node.FeedIDs, feed.ID)
+			node.UnreadCount += feed.UnreadCount
+			node.StarredCount += feed.StarredCount
+			node.TotalCount += feed.TotalCount
+		}
+	}
+
+	roots := []*ListFolderResult{}
+	for _, folder := range folders { // folders are sorted, children keep that order
+		if parent := nodes[folder.ParentID]; parent != nil {
+			parent.Children = append(parent.Children, nodes[folder.ID])
+		} else {
+			roots = append(roots, nodes[folder.ID])
+		}
+	}
+
+	var rollUp func(node *ListFolderResult)
+	rollUp = func(node *ListFolderResult) {
+		for _, child := range node.Children {
+			rollUp(child)
+			node.UnreadCount += child.UnreadCount
+			node.StarredCount += child.StarredCount
+			node.TotalCount += child.TotalCount
+		}
+	}
+	for _, root := range roots {
+		rollUp(root)
+	}
+	return roots
+}
+
+// folderSubtree returns the id of the folder and of all its descendants.
+func folderSubtree(folders []*Folder, folderID string) []string {
+	ids := []string{folderID}
+	for i := 0; i < len(ids); i++ {
+		for _, folder := range folders {
+			if folder.ParentID == ids[i] && !slices.Contains(ids, folder.ID) {
+				ids = append(ids, folder.ID)
+			}
+		}
+	}
+	return ids
+}
+
+func newFolderID(parentID, name string) string {
+	return Hash(fmt.Sprintf("folder:%s/%s@%d", parentID, name, time.Now().UnixNano()))
+}
+
+// folderIndex finds folders by parent and name, creating the missing ones,
+// it is used to map nested OPML outlines and reader categories to folders.
+type folderIndex struct {
+	db      DB
+	folders map[string]*Folder // parent id + "/" + name -> folder
+	created int
+}
+
+func newFolderIndex(ctx context.Context, db DB) (*folderIndex, error) {
+	folders, err := db.ListFolders(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "list folders error")
+	}
+	return &folderIndex{
+		db:      db,
+		folders: lo.SliceToMap(folders, func(folder *Folder) (string, *Folder) { return folder.ParentID + "/" + folder.Name, folder }),
+	}, nil
+}
+
+func (idx *folderIndex) ensure(ctx context.Context, parentID, name string) (*Folder, error) {
+	key := parentID + "/" + name
+	if folder, ok := idx.folders[key]; ok {
+		return folder, nil
+	}
+	folder := &Folder{ID: newFolderID(parentID, name), Name: name, ParentID: parentID}
+	if err := idx.db.SaveFolder(ctx, folder); err != nil {
+		return nil, err
+	}
+	idx.folders[key] = folder
+	idx.created++
+	return folder, nil
+}
+
+// checkFolder responds 400 unless folderID is empty or an existing folder.
+func (svc *Service) checkFolder(c *gin.Context, folderID string) bool {
+	if folderID == "" {
+		return true
+	}
+	if _, err := svc.db.GetFolder(c.Request.Context(), folderID); errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(400, gin.H{"error": "folder not found"})
+		return false
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// ListFolders 列出文件夹树，未读数包含所有子文件夹
+func (svc *Service) ListFolders(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	folders, err := svc.db.ListFolders(ctx)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	feeds, err := svc.db.FilterFeeds(ctx, nil)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{"folders": folderTree(folders, feeds)})
+}
+
+// ListFolderItems 列出文件夹及其所有子文件夹中订阅的文章
+func (svc *Service) ListFolderItems(c *gin.Context) {
+	ctx := c.Request.Context()
+	folderID := c.Param("folder_id")
+
+	folders, err := svc.db.ListFolders(ctx)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !lo.ContainsBy(folders, func(folder *Folder) bool { return folder.ID == folderID }) {
+		c.JSON(404, gin.H{"error": "folder not found"})
+		return
+	}
+	feedsResult, err := svc.db.FilterFeeds(ctx, nil)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	subtree := folderSubtree(folders, folderID)
+	feeds := lo.FilterMap(feedsResult, func(feed *ListFeedResult, _ int) (*Feed, bool) {
+		return feed.Feed, slices.Contains(subtree, feed.FolderID)
+	})
+	svc.listItems(c, &ItemFilter{FolderIDs: subtree}, feeds)
+}
+
+type folderRequest struct {
+	Name     string `json:"name"`
+	ParentID string `json:"parent_id"`
+	Position int    `json:"position"`
+}
+
+// validateFolder checks that the folder can be saved with the requested name and parent:
+// the parent exists, no sibling has the same name, and the folder is not moved into its own subtree.
+func (svc *Service) validateFolder(ctx context.Context, folderID string, req *folderRequest) (int, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return 400, errors.New("name required")
+	}
+	folders, err := svc.db.ListFolders(ctx)
+	if err != nil {
+		return 500, err
+	}
+	if req.ParentID != "" && !lo.ContainsBy(folders, func(folder *Folder) bool { return folder.ID == req.ParentID }) {
+		return 400, errors.New("parent folder not found")
+	}
+	if folderID != "" && slices.Contains(folderSubtree(folders, folderID), req.ParentID) {
+		return 400, errors.New("folder cannot be moved into itself")
+	}
+	if lo.ContainsBy(folders, func(folder *Folder) bool {
+		return folder.ID != folderID && folder.ParentID == req.ParentID && folder.Name == req.Name
+	}) {
+		return 409, errors.New("folder already exists")
+	}
+	return 200, nil
+}
+
+// AddFolder 创建文件夹，parent_id 为空时创建在根目录
+func (svc *Service) AddFolder(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	req := new(folderRequest)
+	if err := c.BindJSON(req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if code, err := svc.validateFolder(ctx, "", req); err != nil {
+		c.JSON(code, gin.H{"error": err.Error()})
+		return
+	}
+
+	folder := &Folder{ID: newFolderID(req.ParentID, req.Name), Name: req.Name, ParentID: req.ParentID, Position: req.Position}
+	if err := svc.db.SaveFolder(ctx, folder); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"folder": folder})
+}
+
+// UpdateFolder 重命名或移动文件夹
+func (svc *Service) UpdateFolder(c *gin.Context) {
+	ctx := c.Request.Context()
+	folderID := c.Param("folder_id")
+
+	req := new(folderRequest)
+	if err := c.BindJSON(req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	folder, err := svc.db.GetFolder(ctx, folderID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "folder not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if code, err := svc.validateFolder(ctx, folderID, req); err != nil {
+		c.JSON(code, gin.H{"error": err.Error()})
+		return
+	}
+
+	folder.Name, folder.ParentID, folder.Position = req.Name, req.ParentID, req.Position
+	if err := svc.db.SaveFolder(ctx, folder); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"folder": folder})
+}
+
+// DeleteFolder 删除文件夹，其中的子文件夹和订阅移动到上一级
+func (svc *Service) DeleteFolder(c *gin.Context) {
+	err := svc.db.DeleteFolder(c.Request.Context(), c.Param("folder_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "folder not found"})
+		return
+	} else if err != nil {
+		logrus.WithError(err).Error("delete folder error")
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
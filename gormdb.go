@@ -0,0 +1,1021 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// gormDB implements DB on top of gorm, the SQL backends embed it
+// and only differ in dialect specific parts like full text search.
+type gormDB struct {
+	db *gorm.DB
+}
+
+func (s *gormDB) isPostgres() bool {
+	return s.db.Dialector.Name() == "postgres"
+}
+
+func (s *gormDB) SaveFeed(ctx context.Context, feed *Feed) error {
+	tx := s.db.WithContext(ctx).Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := tx.Save(feed).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Delete(&Tag{}, "feed_id = ?", feed.ID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	tags := make([]Tag, 0, len(feed.Tags))
+	for _, tagName := range feed.Tags {
+		if tagName != "" {
+			tags = append(tags, Tag{FeedID: feed.ID, Name: tagName})
+		}
+	}
+	if len(tags) > 0 {
+		if err := tx.CreateInBatches(tags, len(tags)).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
+
+func (s *gormDB) UpdateFeed(ctx context.Context, feedID string, update *FeedUpdate) error {
+	updates := make(map[string]any)
+	if update.UpstreamTitle != nil {
+		updates["upstream_title"] = *update.UpstreamTitle
+		updates["title"] = gorm.Expr("CASE WHEN custom_title = '' THEN ? ELSE title END", *update.UpstreamTitle)
+	}
+	for column, value := range map[string]*string{
+		"site_url":    update.SiteURL,
+		"description": update.Description,
+		"image":       update.Image,
+		"language":    update.Language,
+		"generator":   update.Generator,
+		"copyright":   update.Copyright,
+		"icon_path":   update.IconPath,
+		"icon_type":   update.IconType,
+	} {
+		if value != nil {
+			updates[column] = *value
+		}
+	}
+	for column, value := range map[string]*time.Time{
+		"last_build_date": update.LastBuildDate,
+		"icon_updated_at": update.IconUpdatedAt,
+		"icon_checked_at": update.IconCheckedAt,
+	} {
+		if value != nil {
+			updates[column] = *value
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	return s.db.WithContext(ctx).Model(&Feed{}).Where("id = ?", feedID).Updates(updates).Error
+}
+
+func (s *gormDB) GetFeed(ctx context.Context, feedID string) (*Feed, error) {
+	feed := new(Feed)
+	err := s.db.WithContext(ctx).First(feed, "id = ?", feedID).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []Tag
+	if err := s.db.WithContext(ctx).Where("feed_id = ?", feedID).Find(&tags).Error; err != nil {
+		return nil, err
+	}
+
+	feed.Tags = make([]string, len(tags))
+	for i, tag := range tags {
+		feed.Tags[i] = tag.Name
+	}
+
+	return feed, nil
+}
+
+func (s *gormDB) DeleteFeed(ctx context.Context, feedID string) error {
+	tx := s.db.WithContext(ctx).Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	feedItems := tx.Model(&Item{}).Select("id").Where("feed_id = ?", feedID)
+	if err := tx.Where("item_id IN (?)", feedItems).Delete(&ItemLabel{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("item_id IN (?)", feedItems).Delete(&Highlight{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("item_id IN (?)", feedItems).Delete(&ItemAuthor{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Where("item_id IN (?)", feedItems).Delete(&ItemCategory{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(&Enclosure{}, "feed_id = ?", feedID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(&Item{}, "feed_id = ?", feedID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(&Feed{}, "id = ?", feedID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Delete(&Tag{}, "feed_id = ?", feedID).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// itemCounts aggregates the items joined to each group.
+const itemCounts = "COUNT(items.id) AS total_count, " +
+	"COUNT(CASE WHEN NOT items.read THEN 1 END) AS unread_count, " +
+	"COUNT(CASE WHEN items.starred THEN 1 END) AS starred_count"
+
+func (s *gormDB) FilterFeeds(ctx context.Context, tags []string) ([]*ListFeedResult, error) {
+	feeds := []*ListFeedResult{}
+	query := s.db.WithContext(ctx).Table("feeds")
+	if len(tags) > 0 {
+		query = query.Where("feeds.id IN (?)", s.db.Model(&Tag{}).Select("feed_id").Where("name IN ?", tags))
+	}
+	err := query.
+		Select("feeds.*, " + itemCounts).
+		Joins("LEFT JOIN items ON items.feed_id = feeds.id").
+		Group("feeds.id").
+		Scan(&feeds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// load the tags of all feeds at once
+	feedIDs := lo.Map(feeds, func(feed *ListFeedResult, _ int) string { return feed.ID })
+	var feedTags []Tag
+	for _, ids := range lo.Chunk(feedIDs, 500) {
+		var chunk []Tag
+		if err := s.db.WithContext(ctx).Where("feed_id IN ?", ids).Find(&chunk).Error; err != nil {
+			return nil, err
+		}
+		feedTags = append(feedTags, chunk...)
+	}
+	tagsByFeed := lo.GroupBy(feedTags, func(tag Tag) string { return tag.FeedID })
+	for _, feed := range feeds {
+		feed.Tags = lo.Map(tagsByFeed[feed.ID], func(tag Tag, _ int) string { return tag.Name })
+	}
+	return feeds, nil
+}
+
+type ListTagResult struct {
+	Name         string `json:"name"`
+	Position     int    `json:"position"`
+	Color        string `json:"color"`
+	UnreadCount  int64  `json:"unread_count"`
+	StarredCount int64  `json:"starred_count"`
+	TotalCount   int64  `json:"total_count"`
+}
+
+func (s *gormDB) ListTags(ctx context.Context) ([]*ListTagResult, error) {
+	results := []*ListTagResult{}
+	err := s.db.WithContext(ctx).Table("tags").
+		Select("tags.name, COALESCE(tag_settings.position, 0) AS position, COALESCE(tag_settings.color, '') AS color, " + itemCounts).
+		Joins("LEFT JOIN tag_settings ON tag_settings.name = tags.name").
+		Joins("LEFT JOIN items ON items.feed_id = tags.feed_id").
+		Group("tags.name, tag_settings.position, tag_settings.color").
+		Order("position, tags.name").
+		Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *gormDB) RenameTag(ctx context.Context, from, to string, merge bool) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&Tag{}).Where("name = ?", from).Count(&count).Error; err != nil {
+			return err
+		} else if count == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if err := tx.Model(&Tag{}).Where("name = ?", to).Count(&count).Error; err != nil {
+			return err
+		} else if count > 0 && !merge {
+			return ErrTagExists
+		}
+
+		// feeds having both tags keep a single one
+		err := tx.Where("name = ? AND feed_id IN (?)", from, tx.Model(&Tag{}).Select("feed_id").Where("name = ?", to)).
+			Delete(&Tag{}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&Tag{}).Where("name = ?", from).Update("name", to).Error; err != nil {
+			return err
+		}
+
+		// the settings follow a renamed tag, a merged one takes the settings of the target
+		if count == 0 {
+			if err := tx.Delete(&TagSetting{}, "name = ?", to).Error; err != nil {
+				return err
+			}
+			return tx.Model(&TagSetting{}).Where("name = ?", from).Update("name", to).Error
+		}
+		return tx.Delete(&TagSetting{}, "name = ?", from).Error
+	})
+}
+
+func (s *gormDB) DeleteTag(ctx context.Context, name string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&Tag{}, "name = ?", name)
+		if result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Delete(&TagSetting{}, "name = ?", name).Error
+	})
+}
+
+func (s *gormDB) SetTagColor(ctx context.Context, name, color string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&Tag{}, "name = ?", name).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"color"}),
+		}).Create(&TagSetting{Name: name, Color: color}).Error
+	})
+}
+
+func (s *gormDB) SetTagOrder(ctx context.Context, names []string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i, name := range names {
+			err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "name"}},
+				DoUpdates: clause.AssignmentColumns([]string{"position"}),
+			}).Create(&TagSetting{Name: name, Position: i + 1}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *gormDB) FilterItems(ctx context.Context, filter *ItemFilter) ([]*Item, error) {
+	var items []*Item
+	query := s.filterItems(s.db.WithContext(ctx).Model(&Item{}), filter).Select("items.*")
+	query = s.sortItems(query, filter)
+
+	// pagination
+	if filter.Limit != nil {
+		query = query.Limit(*filter.Limit)
+	}
+	if filter.Offset != nil {
+		query = query.Offset(*filter.Offset)
+	}
+
+	if err := query.Find(&items).Error; err != nil {
+		return nil, err
+	}
+	return items, s.loadItemDetails(ctx, items...)
+}
+
+// loadItemDetails sets the labels, enclosures, authors and categories of the items.
+func (s *gormDB) loadItemDetails(ctx context.Context, items ...*Item) error {
+	if err := s.loadLabels(ctx, items...); err != nil {
+		return err
+	}
+	if err := s.loadEnclosures(ctx, items...); err != nil {
+		return err
+	}
+	return s.loadAuthorsAndCategories(ctx, items...)
+}
+
+func (s *gormDB) loadAuthorsAndCategories(ctx context.Context, items ...*Item) error {
+	ids := lo.Map(items, func(item *Item, _ int) string { return item.ID })
+	var authors []*ItemAuthor
+	var categories []ItemCategory
+	for _, chunk := range lo.Chunk(ids, 500) {
+		var foundAuthors []*ItemAuthor
+		if err := s.db.WithContext(ctx).Where("item_id IN ?", chunk).Order("position").Find(&foundAuthors).Error; err != nil {
+			return err
+		}
+		authors = append(authors, foundAuthors...)
+		var foundCategories []ItemCategory
+		if err := s.db.WithContext(ctx).Where("item_id IN ?", chunk).Order("name").Find(&foundCategories).Error; err != nil {
+			return err
+		}
+		categories = append(categories, foundCategories...)
+	}
+	authorsByItem := lo.GroupBy(authors, func(author *ItemAuthor) string { return author.ItemID })
+	categoriesByItem := lo.GroupBy(categories, func(category ItemCategory) string { return category.ItemID })
+	for _, item := range items {
+		item.Authors = lo.CoalesceSliceOrEmpty(authorsByItem[item.ID])
+		item.Categories = lo.Map(categoriesByItem[item.ID], func(category ItemCategory, _ int) string { return category.Name })
+	}
+	return nil
+}
+
+func (s *gormDB) loadEnclosures(ctx context.Context, items ...*Item) error {
+	ids := lo.Map(items, func(item *Item, _ int) string { return item.ID })
+	var enclosures []*Enclosure
+	for _, chunk := range lo.Chunk(ids, 500) {
+		var found []*Enclosure
+		if err := s.db.WithContext(ctx).Where("item_id IN ?", chunk).Order("position").Find(&found).Error; err != nil {
+			return err
+		}
+		enclosures = append(enclosures, found...)
+	}
+	enclosuresByItem := lo.GroupBy(enclosures, func(enclosure *Enclosure) string { return enclosure.ItemID })
+	for _, item := range items {
+		item.Enclosures = lo.CoalesceSliceOrEmpty(enclosuresByItem[item.ID])
+	}
+	return nil
+}
+
+// loadLabels sets the labels of the items.
+func (s *gormDB) loadLabels(ctx context.Context, items ...*Item) error {
+	ids := lo.Map(items, func(item *Item, _ int) string { return item.ID })
+	var labels []ItemLabel
+	for _, chunk := range lo.Chunk(ids, 500) {
+		var found []ItemLabel
+		if err := s.db.WithContext(ctx).Where("item_id IN ?", chunk).Order("name").Find(&found).Error; err != nil {
+			return err
+		}
+		labels = append(labels, found...)
+	}
+	labelsByItem := lo.GroupBy(labels, func(label ItemLabel) string { return label.ItemID })
+	for _, item := range items {
+		item.Labels = lo.Map(labelsByItem[item.ID], func(label ItemLabel, _ int) string { return label.Name })
+	}
+	return nil
+}
+
+// itemAuthorsAndCategories returns the rows of the authors and categories of the items.
+func itemAuthorsAndCategories(items ...*Item) ([]*ItemAuthor, []ItemCategory) {
+	var authors []*ItemAuthor
+	var categories []ItemCategory
+	for _, item := range items {
+		for i, author := range item.Authors {
+			author.ItemID, author.Position = item.ID, i
+			authors = append(authors, author)
+		}
+		for _, name := range lo.Uniq(lo.Compact(item.Categories)) {
+			categories = append(categories, ItemCategory{ItemID: item.ID, Name: name})
+		}
+	}
+	return authors, categories
+}
+
+// saveLabels replaces the labels of the item.
+func saveLabels(tx *gorm.DB, itemID string, names []string) error {
+	if err := tx.Delete(&ItemLabel{}, "item_id = ?", itemID).Error; err != nil {
+		return err
+	}
+	labels := lo.Map(lo.Uniq(lo.Compact(names)), func(name string, _ int) ItemLabel { return ItemLabel{ItemID: itemID, Name: name} })
+	if len(labels) == 0 {
+		return nil
+	}
+	return tx.Create(&labels).Error
+}
+
+// sortKey is the time items are ordered by, items without pub_date fall back to their fetch time.
+// SQLite compares times as strings, so item times are stored and compared in UTC, see utcTimes.
+const sortKey = "COALESCE(items.pub_date, items.created_at)"
+
+func (s *gormDB) sortItems(query *gorm.DB, filter *ItemFilter) *gorm.DB {
+	// id breaks ties, so the order is stable across pages
+	newest := sortKey + " DESC, items.id DESC"
+	switch filter.Sort {
+	case SortOldest:
+		query = query.Order(sortKey + " ASC, items.id ASC")
+	case SortCreatedAt:
+		query = query.Order("items.created_at DESC, items.id DESC")
+	case SortFeed:
+		query = query.Joins("LEFT JOIN feeds ON feeds.id = items.feed_id").Order("feeds.title ASC, " + newest)
+	case SortUnread:
+		query = query.Order("items.read ASC, " + newest)
+	case SortRelevance:
+		q := filter.rankText()
+		switch {
+		case q == "":
+			query = query.Order(newest)
+		case s.isPostgres():
+			query = query.Order(clause.Expr{SQL: "ts_rank(" + postgresItemSearchVector + ", plainto_tsquery('simple', ?)) DESC", Vars: []any{q}}).Order(newest)
+		default:
+			// LIKE has no score, rank title matches above matches in the body
+			query = query.Order(clause.Expr{SQL: "CASE WHEN items.title LIKE ? THEN 0 ELSE 1 END", Vars: []any{"%" + q + "%"}}).Order(newest)
+		}
+	default:
+		query = query.Order(newest)
+	}
+
+	if c := filter.Cursor; c != nil {
+		t := c.Time.UTC()
+		switch filter.Sort {
+		case SortOldest:
+			query = query.Where(sortKey+" > ? OR ("+sortKey+" = ? AND items.id > ?)", t, t, c.ID)
+		case SortCreatedAt:
+			query = query.Where("items.created_at < ? OR (items.created_at = ? AND items.id < ?)", t, t, c.ID)
+		default:
+			query = query.Where(sortKey+" < ? OR ("+sortKey+" = ? AND items.id < ?)", t, t, c.ID)
+		}
+	}
+	return query
+}
+
+func (s *gormDB) CountItems(ctx context.Context, filter *ItemFilter) (int64, error) {
+	var count int64
+	query := s.filterItems(s.db.WithContext(ctx).Model(&Item{}), filter)
+	if err := query.Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *gormDB) filterItems(query *gorm.DB, filter *ItemFilter) *gorm.DB {
+	if len(filter.FeedIDs) > 0 {
+		query = query.Where("items.feed_id in ?", filter.FeedIDs)
+	}
+	if len(filter.Tags) > 0 {
+		query = query.Where("items.feed_id in (?)", s.db.Model(&Tag{}).Distinct("feed_id").Where("name IN ?", filter.Tags))
+	}
+	if len(filter.Labels) > 0 {
+		query = query.Where("items.id in (?)", s.db.Model(&ItemLabel{}).Select("item_id").Where("name IN ?", filter.Labels))
+	}
+	if len(filter.Authors) > 0 {
+		authors := lo.Map(filter.Authors, func(author string, _ int) string { return strings.ToLower(author) })
+		query = query.Where("items.id in (?)", s.db.Model(&ItemAuthor{}).Select("item_id").Where("LOWER(name) IN ? OR LOWER(email) IN ?", authors, authors))
+	}
+	if len(filter.Categories) > 0 {
+		categories := lo.Map(filter.Categories, func(category string, _ int) string { return strings.ToLower(category) })
+		query = query.Where("items.id in (?)", s.db.Model(&ItemCategory{}).Select("item_id").Where("LOWER(name) IN ?", categories))
+	}
+	if len(filter.FolderIDs) > 0 {
+		query = query.Where("items.feed_id in (?)", s.db.Model(&Feed{}).Select("id").Where("folder_id IN ?", filter.FolderIDs))
+	}
+	if len(filter.ClusterIDs) > 0 {
+		query = query.Where("items.cluster_id IN ?", filter.ClusterIDs)
+	}
+	if filter.Unread != nil {
+		query = query.Where("items.read = ?", !*filter.Unread)
+	}
+	if len(filter.FeedTitles) > 0 {
+		titles := lo.Map(filter.FeedTitles, func(title string, _ int) string { return strings.ToLower(title) })
+		query = query.Where("items.feed_id in (?)", s.db.Model(&Feed{}).Select("id").Where("LOWER(title) IN ? OR id IN ?", titles, filter.FeedTitles))
+	}
+	if filter.PubDate != nil {
+		query = query.Where("items.pub_date >= ?", filter.PubDate.UTC())
+	}
+	if filter.PubBefore != nil {
+		query = query.Where("items.pub_date < ?", filter.PubBefore.UTC())
+	}
+	if filter.Starred != nil {
+		query = query.Where("items.starred = ?", *filter.Starred)
+	}
+	if filter.Liked != nil {
+		query = query.Where("items.liked = ?", *filter.Liked)
+	}
+	if filter.SearchQuery != nil && *filter.SearchQuery != "" {
+		query = s.search(query, *filter.SearchQuery)
+	}
+	for _, term := range filter.Terms {
+		query = s.searchTerm(query, term)
+	}
+	if filter.Collapse {
+		// the matching item with the smallest id stands for its cluster
+		inner := *filter
+		inner.Collapse = false
+		representatives := s.filterItems(s.db.Model(&Item{}), &inner).Select("MIN(items.id)").Group("items.cluster_id")
+		query = query.Where("items.id IN (?)", representatives)
+	}
+	return query
+}
+
+// termColumns are the columns a search term is matched in, by field.
+// author: terms are matched in item_authors, items.author is only the first author.
+var termColumns = map[string][]string{
+	"":          {"items.title", "items.content", "items.description"},
+	TermTitle:   {"items.title"},
+	TermContent: {"items.content", "items.description"},
+	TermLink:    {"items.link"},
+}
+
+func (s *gormDB) searchTerm(query *gorm.DB, term SearchTerm) *gorm.DB {
+	if term.Field == "" && !term.Exclude && s.isPostgres() {
+		// bare words use the full text index, as SearchQuery does
+		return query.Where(postgresItemSearchVector+" @@ plainto_tsquery('simple', ?)", term.Text)
+	}
+	like := lo.Ternary(s.isPostgres(), "ILIKE", "LIKE")
+	pattern := "%" + escapeLike(term.Text) + "%"
+	var cond string
+	var vars []any
+	if term.Field == TermAuthor {
+		cond = "items.id IN (SELECT item_id FROM item_authors WHERE name " + like + " ? ESCAPE '\\')"
+		vars = []any{pattern}
+	} else {
+		columns := termColumns[term.Field]
+		// columns are coalesced, NOT on a NULL column is NULL and would drop the item
+		conds := lo.Map(columns, func(column string, _ int) string { return "COALESCE(" + column + ", '') " + like + " ? ESCAPE '\\'" })
+		vars = lo.Map(columns, func(string, int) any { return pattern })
+		cond = "(" + strings.Join(conds, " OR ") + ")"
+	}
+	if term.Exclude {
+		cond = "NOT " + cond
+	}
+	return query.Where(cond, vars...)
+}
+
+// escapeLike escapes the wildcards of LIKE patterns.
+func escapeLike(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(s)
+}
+
+func (s *gormDB) search(query *gorm.DB, q string) *gorm.DB {
+	if s.isPostgres() {
+		return query.Where(postgresItemSearchVector+" @@ plainto_tsquery('simple', ?)", q)
+	}
+	searchTerm := "%" + q + "%"
+	return query.Where("items.title LIKE ? OR items.content LIKE ? OR items.description LIKE ?",
+		searchTerm, searchTerm, searchTerm)
+}
+
+// utcTimes sets the times of the item in UTC, SQLite stores times as strings with their offset
+// and pub_date is compared to created_at.
+func utcTimes(item *Item) {
+	item.CreatedAt = item.CreatedAt.UTC()
+	if item.PubDate != nil {
+		item.PubDate = lo.ToPtr(item.PubDate.UTC())
+	}
+	if item.UpdatedDate != nil {
+		item.UpdatedDate = lo.ToPtr(item.UpdatedDate.UTC())
+	}
+}
+
+func (s *gormDB) AddItem(ctx context.Context, items ...*Item) error {
+	now := time.Now()
+	var enclosures []*Enclosure
+	for _, item := range items {
+		item.CreatedAt = now
+		utcTimes(item)
+		item.ClusterID = lo.CoalesceOrEmpty(item.ClusterID, item.ID)
+		enclosures = append(enclosures, item.Enclosures...)
+	}
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		DoNothing: true,
+	}).CreateInBatches(items, 20).Error
+	if err != nil {
+		return err
+	}
+	// details of existing items are kept, those they lack are added
+	if len(enclosures) > 0 {
+		if err := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(enclosures, 50).Error; err != nil {
+			return err
+		}
+	}
+	authors, categories := itemAuthorsAndCategories(items...)
+	if len(authors) > 0 {
+		if err := s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(authors, 100).Error; err != nil {
+			return err
+		}
+	}
+	if len(categories) > 0 {
+		return s.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(categories, 100).Error
+	}
+	return nil
+}
+
+func (s *gormDB) ExistingItemIDs(ctx context.Context, itemIDs []string) ([]string, error) {
+	existing := []string{}
+	for _, ids := range lo.Chunk(itemIDs, 500) {
+		var found []string
+		if err := s.db.WithContext(ctx).Model(&Item{}).Where("id IN ?", ids).Pluck("id", &found).Error; err != nil {
+			return nil, err
+		}
+		existing = append(existing, found...)
+	}
+	return existing, nil
+}
+
+func (s *gormDB) DuplicateCandidates(ctx context.Context, since time.Time, links []string) ([]*Item, error) {
+	candidates := []*Item{}
+	query := s.db.WithContext(ctx).Model(&Item{}).Select("id, feed_id, canonical_link, sim_hash, cluster_id")
+	if links = lo.Compact(links); len(links) > 0 {
+		query = query.Where("created_at >= ? OR canonical_link IN ?", since.UTC(), links)
+	} else {
+		query = query.Where("created_at >= ?", since.UTC())
+	}
+	err := query.Order("created_at, id").Find(&candidates).Error
+	return candidates, err
+}
+
+func (s *gormDB) GetItem(ctx context.Context, itemID string) (*Item, error) {
+	item := new(Item)
+	if err := s.db.WithContext(ctx).First(item, "id = ?", itemID).Error; err != nil {
+		return item, err
+	}
+	return item, s.loadItemDetails(ctx, item)
+}
+
+// FindItem returns an item with the given guid or link, within the feed unless feedID is empty.
+func (s *gormDB) FindItem(ctx context.Context, feedID, guid, link string) (*Item, error) {
+	if guid == "" && link == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+	query := s.db.WithContext(ctx)
+	if feedID != "" {
+		query = query.Where("feed_id = ?", feedID)
+	}
+	match := s.db.Where("1 = 0")
+	if guid != "" {
+		match = match.Or("guid = ?", guid)
+	}
+	if link != "" {
+		match = match.Or("link = ?", link)
+	}
+	item := new(Item)
+	if err := query.Where(match).First(item).Error; err != nil {
+		return item, err
+	}
+	return item, s.loadItemDetails(ctx, item)
+}
+
+func (s *gormDB) UpdateItem(ctx context.Context, itemID string, update *ItemUpdate) error {
+	updates := make(map[string]any)
+	if update.Read != nil {
+		updates["read"] = *update.Read
+	}
+	if update.Starred != nil {
+		updates["starred"] = *update.Starred
+	}
+	if update.Liked != nil {
+		updates["liked"] = *update.Liked
+	}
+	if update.Note != nil {
+		updates["note"] = *update.Note
+	}
+	if update.Position != nil {
+		updates["position"] = *update.Position
+	}
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(&Item{}).Where("id = ?", itemID).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		if update.Labels != nil {
+			return saveLabels(tx, itemID, *update.Labels)
+		}
+		return nil
+	})
+}
+
+func (s *gormDB) SaveItem(ctx context.Context, item *Item) error {
+	utcTimes(item)
+	item.ClusterID = lo.CoalesceOrEmpty(item.ClusterID, item.ID)
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(item).Error; err != nil {
+			return err
+		}
+		if len(item.Enclosures) > 0 {
+			// enclosures already stored keep their local copy
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(item.Enclosures).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(&ItemAuthor{}, "item_id = ?", item.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&ItemCategory{}, "item_id = ?", item.ID).Error; err != nil {
+			return err
+		}
+		authors, categories := itemAuthorsAndCategories(item)
+		if len(authors) > 0 {
+			if err := tx.Create(authors).Error; err != nil {
+				return err
+			}
+		}
+		if len(categories) > 0 {
+			if err := tx.Create(categories).Error; err != nil {
+				return err
+			}
+		}
+		return saveLabels(tx, item.ID, item.Labels)
+	})
+}
+
+func (s *gormDB) MarkInFeed(ctx context.Context, feedID string, itemIDs []string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&Item{}).Where("feed_id = ? AND in_feed = ?", feedID, true).Update("in_feed", false).Error
+		if err != nil || len(itemIDs) == 0 {
+			return err
+		}
+		return tx.Model(&Item{}).Where("feed_id = ? AND id IN ?", feedID, itemIDs).Update("in_feed", true).Error
+	})
+}
+
+// PurgeableItems returns the items of the feed which are neither among the newest keepLast items
+// nor published after before. Starred, liked, labeled, annotated, highlighted and still listed items are never returned.
+func (s *gormDB) PurgeableItems(ctx context.Context, feedID string, keepLast int, before *time.Time) ([]*Item, error) {
+	var items []*Item
+	query := s.db.WithContext(ctx).Model(&Item{}).
+		Select("id", "feed_id", "title", "link", "pub_date", "created_at").
+		Where("feed_id = ? AND starred = ? AND liked = ? AND in_feed = ? AND note = ''", feedID, false, false, false).
+		Where("id NOT IN (?)", s.db.Model(&ItemLabel{}).Select("item_id")).
+		Where("id NOT IN (?)", s.db.Model(&Highlight{}).Select("item_id"))
+	if keepLast > 0 {
+		newest := s.db.Model(&Item{}).Select("id").Where("feed_id = ?", feedID).
+			Order("COALESCE(pub_date, created_at) DESC").Limit(keepLast)
+		query = query.Where("id NOT IN (?)", newest)
+	}
+	if before != nil {
+		query = query.Where("COALESCE(pub_date, created_at) < ?", before.UTC())
+	}
+	if err := query.Order("COALESCE(pub_date, created_at)").Find(&items).Error; err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (s *gormDB) DeleteItems(ctx context.Context, itemIDs ...string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, ids := range lo.Chunk(itemIDs, 500) {
+			if err := tx.Delete(&ItemLabel{}, "item_id IN ?", ids).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&Highlight{}, "item_id IN ?", ids).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&Enclosure{}, "item_id IN ?", ids).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&ItemAuthor{}, "item_id IN ?", ids).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&ItemCategory{}, "item_id IN ?", ids).Error; err != nil {
+				return err
+			}
+			if err := tx.Delete(&Item{}, "id IN ?", ids).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type ListLabelResult struct {
+	Name         string `json:"name"`
+	UnreadCount  int64  `json:"unread_count"`
+	StarredCount int64  `json:"starred_count"`
+	TotalCount   int64  `json:"total_count"`
+}
+
+func (s *gormDB) ListLabels(ctx context.Context) ([]*ListLabelResult, error) {
+	results := []*ListLabelResult{}
+	err := s.db.WithContext(ctx).Table("item_labels").
+		Select("item_labels.name, " + itemCounts).
+		Joins("JOIN items ON items.id = item_labels.item_id").
+		Group("item_labels.name").
+		Order("item_labels.name").
+		Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+type ListCategoryResult struct {
+	Name         string `json:"name"`
+	UnreadCount  int64  `json:"unread_count"`
+	StarredCount int64  `json:"starred_count"`
+	TotalCount   int64  `json:"total_count"`
+}
+
+// TopCategories counts categories differing only by case together, under the first of their names.
+func (s *gormDB) TopCategories(ctx context.Context, feedID string, limit int) ([]*ListCategoryResult, error) {
+	results := []*ListCategoryResult{}
+	err := s.db.WithContext(ctx).Table("item_categories").
+		Select("MIN(item_categories.name) AS name, "+itemCounts).
+		Joins("JOIN items ON items.id = item_categories.item_id").
+		Where("items.feed_id = ?", feedID).
+		Group("LOWER(item_categories.name)").
+		Order("total_count DESC, name").
+		Limit(limit).
+		Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *gormDB) FilterHighlights(ctx context.Context, filter *HighlightFilter) ([]*Highlight, error) {
+	highlights := []*Highlight{}
+	query := s.filterHighlights(s.db.WithContext(ctx), filter).Order("created_at DESC, id")
+	if filter.Limit != nil {
+		query = query.Limit(*filter.Limit)
+	}
+	if filter.Offset != nil {
+		query = query.Offset(*filter.Offset)
+	}
+	err := query.Find(&highlights).Error
+	return highlights, err
+}
+
+func (s *gormDB) CountHighlights(ctx context.Context, filter *HighlightFilter) (int64, error) {
+	var count int64
+	err := s.filterHighlights(s.db.WithContext(ctx).Model(&Highlight{}), filter).Count(&count).Error
+	return count, err
+}
+
+func (s *gormDB) filterHighlights(query *gorm.DB, filter *HighlightFilter) *gorm.DB {
+	if len(filter.ItemIDs) > 0 {
+		query = query.Where("item_id IN ?", filter.ItemIDs)
+	}
+	return query
+}
+
+func (s *gormDB) GetHighlight(ctx context.Context, highlightID string) (*Highlight, error) {
+	highlight := new(Highlight)
+	err := s.db.WithContext(ctx).First(highlight, "id = ?", highlightID).Error
+	return highlight, err
+}
+
+func (s *gormDB) SaveHighlight(ctx context.Context, highlight *Highlight) error {
+	return s.db.WithContext(ctx).Save(highlight).Error
+}
+
+func (s *gormDB) DeleteHighlight(ctx context.Context, highlightID string) error {
+	result := s.db.WithContext(ctx).Delete(&Highlight{}, "id = ?", highlightID)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+func (s *gormDB) ListRules(ctx context.Context) ([]*Rule, error) {
+	rules := []*Rule{}
+	err := s.db.WithContext(ctx).Order("position, created_at, id").Find(&rules).Error
+	return rules, err
+}
+
+func (s *gormDB) GetRule(ctx context.Context, ruleID string) (*Rule, error) {
+	rule := new(Rule)
+	err := s.db.WithContext(ctx).First(rule, "id = ?", ruleID).Error
+	return rule, err
+}
+
+func (s *gormDB) SaveRule(ctx context.Context, rule *Rule) error {
+	return s.db.WithContext(ctx).Save(rule).Error
+}
+
+func (s *gormDB) DeleteRule(ctx context.Context, ruleID string) error {
+	result := s.db.WithContext(ctx).Delete(&Rule{}, "id = ?", ruleID)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+func (s *gormDB) ListSmartFeeds(ctx context.Context) ([]*SmartFeed, error) {
+	smartFeeds := []*SmartFeed{}
+	err := s.db.WithContext(ctx).Order("position, name").Find(&smartFeeds).Error
+	return smartFeeds, err
+}
+
+func (s *gormDB) GetSmartFeed(ctx context.Context, smartFeedID string) (*SmartFeed, error) {
+	smartFeed := new(SmartFeed)
+	err := s.db.WithContext(ctx).First(smartFeed, "id = ?", smartFeedID).Error
+	return smartFeed, err
+}
+
+func (s *gormDB) SaveSmartFeed(ctx context.Context, smartFeed *SmartFeed) error {
+	return s.db.WithContext(ctx).Save(smartFeed).Error
+}
+
+func (s *gormDB) DeleteSmartFeed(ctx context.Context, smartFeedID string) error {
+	result := s.db.WithContext(ctx).Delete(&SmartFeed{}, "id = ?", smartFeedID)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+func (s *gormDB) FilterEnclosures(ctx context.Context, filter *EnclosureFilter) ([]*Enclosure, error) {
+	enclosures := []*Enclosure{}
+	query := s.db.WithContext(ctx).Model(&Enclosure{}).Select("enclosures.*").
+		Joins("JOIN items ON items.id = enclosures.item_id")
+	if len(filter.FeedIDs) > 0 {
+		query = query.Where("enclosures.feed_id IN ?", filter.FeedIDs)
+	}
+	if len(filter.ItemIDs) > 0 {
+		query = query.Where("enclosures.item_id IN ?", filter.ItemIDs)
+	}
+	if filter.Downloaded != nil {
+		query = query.Where(lo.Ternary(*filter.Downloaded, "enclosures.downloaded_at IS NOT NULL", "enclosures.downloaded_at IS NULL"))
+	}
+	err := query.Order(sortKey + ", items.id, enclosures.position").Find(&enclosures).Error
+	return enclosures, err
+}
+
+func (s *gormDB) GetEnclosure(ctx context.Context, enclosureID string) (*Enclosure, error) {
+	enclosure := new(Enclosure)
+	err := s.db.WithContext(ctx).First(enclosure, "id = ?", enclosureID).Error
+	return enclosure, err
+}
+
+func (s *gormDB) SaveEnclosure(ctx context.Context, enclosure *Enclosure) error {
+	return s.db.WithContext(ctx).Save(enclosure).Error
+}
+
+func (s *gormDB) ListOutputFeeds(ctx context.Context) ([]*OutputFeed, error) {
+	outputFeeds := []*OutputFeed{}
+	err := s.db.WithContext(ctx).Order("name").Find(&outputFeeds).Error
+	return outputFeeds, err
+}
+
+func (s *gormDB) GetOutputFeed(ctx context.Context, outputFeedID string) (*OutputFeed, error) {
+	outputFeed := new(OutputFeed)
+	err := s.db.WithContext(ctx).First(outputFeed, "id = ?", outputFeedID).Error
+	return outputFeed, err
+}
+
+func (s *gormDB) FindOutputFeed(ctx context.Context, token string) (*OutputFeed, error) {
+	outputFeed := new(OutputFeed)
+	err := s.db.WithContext(ctx).First(outputFeed, "token = ?", token).Error
+	return outputFeed, err
+}
+
+func (s *gormDB) SaveOutputFeed(ctx context.Context, outputFeed *OutputFeed) error {
+	return s.db.WithContext(ctx).Save(outputFeed).Error
+}
+
+func (s *gormDB) DeleteOutputFeed(ctx context.Context, outputFeedID string) error {
+	result := s.db.WithContext(ctx).Delete(&OutputFeed{}, "id = ?", outputFeedID)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+func (s *gormDB) ListFolders(ctx context.Context) ([]*Folder, error) {
+	folders := []*Folder{}
+	err := s.db.WithContext(ctx).Order("position, name").Find(&folders).Error
+	return folders, err
+}
+
+func (s *gormDB) GetFolder(ctx context.Context, folderID string) (*Folder, error) {
+	folder := new(Folder)
+	err := s.db.WithContext(ctx).First(folder, "id = ?", folderID).Error
+	return folder, err
+}
+
+func (s *gormDB) SaveFolder(ctx context.Context, folder *Folder) error {
+	return s.db.WithContext(ctx).Save(folder).Error
+}
+
+func (s *gormDB) DeleteFolder(ctx context.Context, folderID string) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		folder := new(Folder)
+		if err := tx.First(folder, "id = ?", folderID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Folder{}).Where("parent_id = ?", folderID).Update("parent_id", folder.ParentID).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Feed{}).Where("folder_id = ?", folderID).Update("folder_id", folder.ParentID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(folder).Error
+	})
+}
+
+func (s *gormDB) GetUser(ctx context.Context, name string) (*User, error) {
+	user := new(User)
+	err := s.db.WithContext(ctx).First(user, "name = ?", name).Error
+	return user, err
+}
+
+func (s *gormDB) SaveUser(ctx context.Context, user *User) error {
+	return s.db.WithContext(ctx).Save(user).Error
+}
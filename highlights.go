@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// highlightContext is the number of characters kept around the quote to tell its occurrences apart.
+const highlightContext = 32
+
+var htmlTagRegexp = regexp.MustCompile("<[^>]*>")
+
+// itemText is the plain text highlights are anchored in, the text content of the item HTML.
+func itemText(item *Item) []rune {
+	content := lo.CoalesceOrEmpty(item.Content, item.Description)
+	return []rune(html.UnescapeString(htmlTagRegexp.ReplaceAllString(content, "")))
+}
+
+// anchorHighlight finds the quote of the highlight in text and updates its position.
+// The stored position is used when it still holds the quote, otherwise the occurrence
+// whose surroundings match prefix and suffix best, then the closest one, is chosen.
+func anchorHighlight(text []rune, highlight *Highlight) bool {
+	quote := []rune(highlight.Quote)
+	if len(quote) == 0 {
+		return false
+	}
+	if highlight.Start >= 0 && highlight.End <= len(text) && highlight.End-highlight.Start == len(quote) &&
+		string(text[highlight.Start:highlight.End]) == highlight.Quote {
+		return true
+	}
+
+	s := string(text)
+	best, bestScore, bestDistance := -1, -1, 0
+	for offset := 0; ; {
+		i := strings.Index(s[offset:], highlight.Quote)
+		if i < 0 {
+			break
+		}
+		start := utf8.RuneCountInString(s[:offset+i])
+		score := commonSuffix(string(text[:start]), highlight.Prefix) + commonPrefix(string(text[start+len(quote):]), highlight.Suffix)
+		distance := max(start-highlight.Start, highlight.Start-start)
+		if score > bestScore || (score == bestScore && distance < bestDistance) {
+			best, bestScore, bestDistance = start, score, distance
+		}
+		offset += i + len(highlight.Quote)
+	}
+	if best < 0 {
+		return false
+	}
+	highlight.Start, highlight.End = best, best+len(quote)
+	return true
+}
+
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func commonSuffix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[len(a)-1-n] == b[len(b)-1-n] {
+		n++
+	}
+	return n
+}
+
+// reanchorHighlights anchors the highlights again in the current content of the item,
+// the ones whose quote disappeared are marked orphaned. Changes are saved.
+func (svc *Service) reanchorHighlights(ctx context.Context, item *Item, highlights []*Highlight) error {
+	text := itemText(item)
+	for _, highlight := range highlights {
+		start, end, orphaned := highlight.Start, highlight.End, highlight.Orphaned
+		highlight.Orphaned = !anchorHighlight(text, highlight)
+		if highlight.Start == start && highlight.End == end && highlight.Orphaned == orphaned {
+			continue
+		}
+		if err := svc.db.SaveHighlight(ctx, highlight); err != nil {
+			return errors.Wrapf(err, "save highlight %s error", highlight.ID)
+		}
+	}
+	return nil
+}
+
+// ListItemHighlights 列出文章的所有高亮，按当前内容重新定位
+func (svc *Service) ListItemHighlights(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	item, err := svc.db.GetItem(ctx, c.Param("item_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "item not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	highlights, err := svc.db.FilterHighlights(ctx, &HighlightFilter{ItemIDs: []string{item.ID}})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := svc.reanchorHighlights(ctx, item, highlights); err != nil {
+		logrus.WithError(err).Error("reanchor highlights error")
+	}
+	c.JSON(200, gin.H{"highlights": highlights})
+}
+
+// AddHighlight 高亮文章中的一段文字，quote 为空时按 start/end 截取
+func (svc *Service) AddHighlight(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	req := new(struct {
+		Quote   string `json:"quote"`
+		Prefix  string `json:"prefix"`
+		Suffix  string `json:"suffix"`
+		Start   int    `json:"start"`
+		End     int    `json:"end"`
+		Comment string `json:"comment"`
+	})
+	if err := c.BindJSON(req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	item, err := svc.db.GetItem(ctx, c.Param("item_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "item not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	text := itemText(item)
+	if req.Quote == "" && req.Start >= 0 && req.Start < req.End && req.End <= len(text) {
+		req.Quote = string(text[req.Start:req.End])
+	}
+	highlight := &Highlight{
+		ID:      Hash(fmt.Sprintf("highlight:%s@%d", item.ID, time.Now().UnixNano())),
+		ItemID:  item.ID,
+		Quote:   req.Quote,
+		Prefix:  req.Prefix,
+		Suffix:  req.Suffix,
+		Start:   req.Start,
+		End:     req.End,
+		Comment: req.Comment,
+	}
+	if !anchorHighlight(text, highlight) {
+		c.JSON(400, gin.H{"error": "quote not found in item"})
+		return
+	}
+	if highlight.Prefix == "" && highlight.Suffix == "" {
+		highlight.Prefix = string(text[max(highlight.Start-highlightContext, 0):highlight.Start])
+		highlight.Suffix = string(text[highlight.End:min(highlight.End+highlightContext, len(text))])
+	}
+
+	if err := svc.db.SaveHighlight(ctx, highlight); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"highlight": highlight})
+}
+
+// UpdateHighlight 修改高亮的批注
+func (svc *Service) UpdateHighlight(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	req := new(struct {
+		Comment *string `json:"comment"`
+	})
+	if err := c.BindJSON(req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	highlight, err := svc.db.GetHighlight(ctx, c.Param("highlight_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "highlight not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Comment != nil {
+		highlight.Comment = *req.Comment
+	}
+	if err := svc.db.SaveHighlight(ctx, highlight); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"highlight": highlight})
+}
+
+// DeleteHighlight 删除高亮
+func (svc *Service) DeleteHighlight(c *gin.Context) {
+	err := svc.db.DeleteHighlight(c.Request.Context(), c.Param("highlight_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "highlight not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
+
+type ListHighlightResult struct {
+	*Highlight
+	ItemTitle string `json:"item_title"`
+	ItemLink  string `json:"item_link"`
+	FeedID    string `json:"feed_id"`
+}
+
+// ListHighlights 分页列出所有文章的高亮，最新的在前
+func (svc *Service) ListHighlights(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	size, err := strconv.Atoi(c.Query("size"))
+	if err != nil || size < 1 {
+		size = 20
+	}
+	page, err := strconv.Atoi(c.Query("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	offset := (page - 1) * size
+	filter := &HighlightFilter{Limit: &size, Offset: &offset}
+	if itemID := c.Query("item_id"); itemID != "" {
+		filter.ItemIDs = []string{itemID}
+	}
+
+	total, err := svc.db.CountHighlights(ctx, filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	highlights, err := svc.db.FilterHighlights(ctx, filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	items := make(map[string]*Item)
+	for itemID, group := range lo.GroupBy(highlights, func(highlight *Highlight) string { return highlight.ItemID }) {
+		item, err := svc.db.GetItem(ctx, itemID)
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		if err := svc.reanchorHighlights(ctx, item, group); err != nil {
+			logrus.WithError(err).Error("reanchor highlights error")
+		}
+		items[itemID] = item
+	}
+	results := lo.Map(highlights, func(highlight *Highlight, _ int) *ListHighlightResult {
+		item := items[highlight.ItemID]
+		return &ListHighlightResult{Highlight: highlight, ItemTitle: item.Title, ItemLink: item.Link, FeedID: item.FeedID}
+	})
+
+	c.JSON(200, gin.H{"highlights": results, "pagination": gin.H{"size": size, "page": page, "total": total}})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var iconConfig struct {
+	Dir     string        // cached favicons, one file per feed
+	MaxAge  time.Duration // favicons are fetched again after this long
+	MaxSize int64         // bytes, larger icons are ignored
+}
+
+func init() {
+	iconConfig.Dir = os.Getenv("NEXA_ICON_DIR")
+	if iconConfig.Dir == "" {
+		iconConfig.Dir = "data/icons"
+	}
+	days, _ := strconv.Atoi(os.Getenv("NEXA_ICON_MAX_AGE_DAYS"))
+	if days <= 0 {
+		days = 7
+	}
+	iconConfig.MaxAge = time.Duration(days) * 24 * time.Hour
+	iconConfig.MaxSize = 512 * 1024
+}
+
+var (
+	iconTagRegexp = regexp.MustCompile(`(?is)<link\s[^>]*\brel\s*=\s*["']?[^"'>]*\bicon\b[^>]*>`)
+	relRegexp     = regexp.MustCompile(`(?is)\brel\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+// iconExpired reports whether the favicon of the feed should be fetched again.
+func iconExpired(feed *Feed) bool {
+	return feed.IconCheckedAt == nil || time.Since(*feed.IconCheckedAt) > iconConfig.MaxAge
+}
+
+// iconPath returns where the favicon of the feed is cached.
+func iconPath(feedID string) string {
+	return filepath.Join(iconConfig.Dir, feedID)
+}
+
+// findIcons returns the icons declared by the HTML page, resolved against base,
+// rel=icon and rel="shortcut icon" before the others like apple-touch-icon.
+func findIcons(page string, base *url.URL) []string {
+	var preferred, others []string
+	for _, tag := range iconTagRegexp.FindAllString(page, -1) {
+		rel := ""
+		if m := relRegexp.FindStringSubmatch(tag); m != nil {
+			rel = strings.ToLower(strings.Join(strings.Fields(lo.CoalesceOrEmpty(m[1], m[2], m[3])), " "))
+		}
+		if strings.Contains(rel, "mask-icon") {
+			continue // monochrome svg masks
+		}
+		m := canonicalHrefRegexp.FindStringSubmatch(tag)
+		if m == nil {
+			continue
+		}
+		href, err := base.Parse(strings.TrimSpace(lo.CoalesceOrEmpty(m[1], m[2], m[3])))
+		if err != nil || (href.Scheme != "http" && href.Scheme != "https") {
+			continue
+		}
+		if rel == "icon" || rel == "shortcut icon" {
+			preferred = append(preferred, href.String())
+		} else {
+			others = append(others, href.String())
+		}
+	}
+	return append(preferred, others...)
+}
+
+// iconCandidates returns the urls the favicon of the site is looked for at, in order:
+// the icons of the homepage, /favicon.ico and the image of the feed.
+func iconCandidates(ctx context.Context, feed *Feed) []string {
+	site, err := url.Parse(lo.CoalesceOrEmpty(feed.SiteURL, feed.Link))
+	if err != nil || site.Host == "" {
+		return lo.Compact([]string{feed.Image})
+	}
+	var candidates []string
+	if page, base, err := fetchPage(ctx, site.String()); err != nil {
+		logrus.WithError(err).WithField("feed_id", feed.ID).Debug("fetch homepage error")
+	} else {
+		candidates = findIcons(page, base)
+	}
+	candidates = append(candidates, (&url.URL{Scheme: site.Scheme, Host: site.Host, Path: "/favicon.ico"}).String(), feed.Image)
+	return lo.Uniq(lo.Compact(candidates))
+}
+
+// fetchPage returns the beginning of the HTML page and the url it was served from after redirects.
+func fetchPage(ctx context.Context, link string) (string, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("User-Agent", "nexa/1.0")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, canonicalMaxPage))
+	if err != nil {
+		return "", nil, err
+	}
+	return string(page), resp.Request.URL, nil
+}
+
+// fetchIcon downloads the image at link, it returns its content and type.
+func fetchIcon(ctx context.Context, link string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", "nexa/1.0")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, iconConfig.MaxSize+1))
+	if err != nil {
+		return nil, "", err
+	} else if len(data) == 0 || int64(len(data)) > iconConfig.MaxSize {
+		return nil, "", fmt.Errorf("icon of %d bytes", len(data))
+	}
+
+	// servers often send icons as text/plain or application/octet-stream
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil, "", fmt.Errorf("not an image: %s", mimeType)
+	} else if mimeType == "image/svg+xml" {
+		return nil, "", errors.New("svg icons may run scripts")
+	}
+	return data, mimeType, nil
+}
+
+// refreshIcon fetches the favicon of the site of the feed and caches it. The previous
+// icon is kept when none is found, it is retried after NEXA_ICON_MAX_AGE_DAYS either way.
+func (svc *Service) refreshIcon(ctx context.Context, feed *Feed) error {
+	now := time.Now()
+	update := &FeedUpdate{IconCheckedAt: &now}
+	defer func() {
+		if err := svc.db.UpdateFeed(ctx, feed.ID, update); err != nil {
+			logrus.WithError(err).WithField("feed_id", feed.ID).Error("update feed icon error")
+		}
+	}()
+
+	var lastErr error
+	for _, candidate := range iconCandidates(ctx, feed) {
+		data, mimeType, err := fetchIcon(ctx, candidate)
+		if err != nil {
+			lastErr = errors.Wrapf(err, "fetch icon %s error", candidate)
+			continue
+		}
+		if err := os.MkdirAll(iconConfig.Dir, 0o755); err != nil {
+			return err
+		}
+		tmp := iconPath(feed.ID) + ".tmp"
+		if err := os.WriteFile(tmp, data, 0o644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, iconPath(feed.ID)); err != nil {
+			return err
+		}
+		update.IconPath, update.IconType, update.IconUpdatedAt = lo.ToPtr(iconPath(feed.ID)), &mimeType, &now
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no icon candidate")
+	}
+	return lastErr
+}
+
+// removeIcon deletes the cached favicon of the feed.
+func removeIcon(feedID string) error {
+	if err := os.Remove(iconPath(feedID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// sandboxHeaders keeps browsers from sniffing or running content fetched from feeds,
+// should it be html or svg served under our origin.
+func sandboxHeaders(c *gin.Context) {
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Content-Security-Policy", "default-src 'none'; sandbox")
+}
+
+// GetFeedIcon 返回订阅站点的 favicon 缓存
+func (svc *Service) GetFeedIcon(c *gin.Context) {
+	feed, err := svc.db.GetFeed(c.Request.Context(), c.Param("feed_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "feed not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if feed.IconPath == "" {
+		c.JSON(404, gin.H{"error": "feed has no icon"})
+		return
+	}
+	f, err := os.Open(feed.IconPath)
+	if os.IsNotExist(err) {
+		c.JSON(404, gin.H{"error": "feed has no icon"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	c.Header("Content-Type", feed.IconType)
+	c.Header("Cache-Control", "private, max-age=86400")
+	sandboxHeaders(c)
+	http.ServeContent(c.Writer, c.Request, "", lo.FromPtr(feed.IconUpdatedAt), f)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// importedEntry is an article exported by another reader, with its origin feed.
+type importedEntry struct {
+	FeedURL   string
+	FeedTitle string
+	Category  string
+
+	Title     string
+	Link      string
+	GUID      string
+	Content   string
+	Published *time.Time
+	Crawled   *time.Time
+	Read      bool
+	Starred   bool
+}
+
+// parseReaderExport decodes the starred/saved items exported by another reader.
+// Supported formats are "greader" (Google Reader JSON as written by FreshRSS, Inoreader
+// and Feedly, e.g. starred.json) and "miniflux" (the entries API response), "" detects it.
+func parseReaderExport(data []byte, format string) ([]*importedEntry, error) {
+	if format == "" {
+		format = detectReaderExport(data)
+	}
+	switch format {
+	case "greader", "freshrss", "inoreader", "feedly":
+		return parseGReaderExport(data)
+	case "miniflux":
+		return parseMinifluxExport(data)
+	default:
+		return nil, fmt.Errorf("unsupported export format: %q", format)
+	}
+}
+
+func detectReaderExport(data []byte) string {
+	var probe struct {
+		Items   json.RawMessage `json:"items"`
+		Entries json.RawMessage `json:"entries"`
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		// a bare array is either feedly entries or miniflux entries
+		if bytes.Contains(trimmed, []byte(`"feed_url"`)) {
+			return "miniflux"
+		}
+		return "greader"
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return ""
+	}
+	if probe.Entries != nil {
+		return "miniflux"
+	}
+	if probe.Items != nil {
+		return "greader"
+	}
+	return ""
+}
+
+type greaderItem struct {
+	ID            string `json:"id"`
+	OriginID      string `json:"originId"` // feedly: guid of the original entry
+	Title         string `json:"title"`
+	Published     int64  `json:"published"`
+	CrawlTimeMsec string `json:"crawlTimeMsec"`
+	Crawled       int64  `json:"crawled"` // feedly
+	Unread        *bool  `json:"unread"`  // feedly
+	Canonical     []struct {
+		Href string `json:"href"`
+	} `json:"canonical"`
+	Alternate []struct {
+		Href string `json:"href"`
+	} `json:"alternate"`
+	Content struct {
+		Content string `json:"content"`
+	} `json:"content"`
+	Summary struct {
+		Content string `json:"content"`
+	} `json:"summary"`
+	Categories []string `json:"categories"`
+	Origin     struct {
+		StreamID string `json:"streamId"`
+		Title    string `json:"title"`
+		HtmlURL  string `json:"htmlUrl"`
+	} `json:"origin"`
+}
+
+func parseGReaderExport(data []byte) ([]*importedEntry, error) {
+	var items []*greaderItem
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, err
+		}
+	} else {
+		var stream struct {
+			ID    string         `json:"id"`
+			Items []*greaderItem `json:"items"`
+		}
+		if err := json.Unmarshal(data, &stream); err != nil {
+			return nil, err
+		}
+		items = stream.Items
+	}
+
+	entries := make([]*importedEntry, 0, len(items))
+	for _, item := range items {
+		entry := &importedEntry{
+			FeedURL:   strings.TrimPrefix(item.Origin.StreamID, "feed/"),
+			FeedTitle: item.Origin.Title,
+			Title:     item.Title,
+			GUID:      item.OriginID,
+			Content:   lo.CoalesceOrEmpty(item.Content.Content, item.Summary.Content),
+			Starred:   true, // the export is a list of starred/saved items
+		}
+		if entry.FeedURL == "" {
+			entry.FeedURL = item.Origin.HtmlURL
+		}
+		if len(item.Canonical) > 0 {
+			entry.Link = item.Canonical[0].Href
+		} else if len(item.Alternate) > 0 {
+			entry.Link = item.Alternate[0].Href
+		}
+		for _, category := range item.Categories {
+			switch {
+			case strings.HasSuffix(category, "/state/com.google/read"):
+				entry.Read = true
+			case strings.Contains(category, "/label/") && entry.Category == "":
+				entry.Category = category[strings.LastIndex(category, "/label/")+len("/label/"):]
+			}
+		}
+		if item.Unread != nil {
+			entry.Read = !*item.Unread
+		}
+		if item.Published > 0 {
+			entry.Published = lo.ToPtr(unixAuto(item.Published))
+		}
+		if msec, err := strconv.ParseInt(item.CrawlTimeMsec, 10, 64); err == nil && msec > 0 {
+			entry.Crawled = lo.ToPtr(time.UnixMilli(msec).UTC())
+		} else if item.Crawled > 0 {
+			entry.Crawled = lo.ToPtr(unixAuto(item.Crawled))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+type minifluxEntry struct {
+	Title       string     `json:"title"`
+	URL         string     `json:"url"`
+	Hash        string     `json:"hash"`
+	Status      string     `json:"status"`
+	Starred     bool       `json:"starred"`
+	Content     string     `json:"content"`
+	PublishedAt *time.Time `json:"published_at"`
+	CreatedAt   *time.Time `json:"created_at"`
+	Feed        struct {
+		Title    string `json:"title"`
+		FeedURL  string `json:"feed_url"`
+		SiteURL  string `json:"site_url"`
+		Category struct {
+			Title string `json:"title"`
+		} `json:"category"`
+	} `json:"feed"`
+}
+
+func parseMinifluxExport(data []byte) ([]*importedEntry, error) {
+	var raw []*minifluxEntry
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+	} else {
+		var resp struct {
+			Entries []*minifluxEntry `json:"entries"`
+		}
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return nil, err
+		}
+		raw = resp.Entries
+	}
+
+	entries := make([]*importedEntry, 0, len(raw))
+	for _, e := range raw {
+		entries = append(entries, &importedEntry{
+			FeedURL:   lo.CoalesceOrEmpty(e.Feed.FeedURL, e.Feed.SiteURL),
+			FeedTitle: e.Feed.Title,
+			Category:  e.Feed.Category.Title,
+			Title:     e.Title,
+			Link:      e.URL,
+			Content:   e.Content,
+			Published: e.PublishedAt,
+			Crawled:   e.CreatedAt,
+			Read:      e.Status == "read",
+			Starred:   e.Starred,
+		})
+	}
+	return entries, nil
+}
+
+// unixAuto converts a timestamp in seconds or milliseconds, readers disagree on the unit.
+func unixAuto(ts int64) time.Time {
+	if ts > 1e12 {
+		return time.UnixMilli(ts).UTC()
+	}
+	return time.Unix(ts, 0).UTC()
+}
+
+// importEntries creates the feeds and items of entries exported by another reader.
+// Feeds unknown to nexa are created suspended, so importing history does not start fetching them,
+// in the root folder named after their category.
+func (svc *Service) importEntries(ctx context.Context, entries []*importedEntry) (*ImportResult, error) {
+	existing, err := svc.db.FilterFeeds(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "list feeds error")
+	}
+	feedsByLink := lo.SliceToMap(existing, func(feed *ListFeedResult) (string, *Feed) { return feed.Link, feed.Feed })
+	index, err := newFolderIndex(ctx, svc.db)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(ImportResult)
+	for _, entry := range entries {
+		if entry.FeedURL == "" || (entry.Link == "" && entry.GUID == "") {
+			continue
+		}
+
+		feed := feedsByLink[entry.FeedURL]
+		if feed == nil {
+			feed = &Feed{
+				ID:        Hash(entry.FeedURL),
+				Title:     entry.FeedTitle,
+				Link:      entry.FeedURL,
+				Cron:      defaultFeedCron,
+				Suspended: true,
+			}
+			if entry.Category != "" {
+				folder, err := index.ensure(ctx, "", entry.Category)
+				if err != nil {
+					return nil, errors.Wrap(err, "create folder error")
+				}
+				feed.FolderID = folder.ID
+			}
+			if err := svc.db.SaveFeed(ctx, feed); err != nil {
+				return nil, errors.Wrap(err, "save feed error")
+			}
+			feedsByLink[feed.Link] = feed
+			result.FeedsCreated++
+		}
+
+		item := &Item{
+			ID:      importedItemID(entry.GUID, entry.Link),
+			FeedID:  feed.ID,
+			Title:   entry.Title,
+			Content: entry.Content,
+			Link:    entry.Link,
+			GUID:    entry.GUID,
+			PubDate: entry.Published,
+			Read:    entry.Read,
+			Starred: entry.Starred,
+		}
+		if entry.Crawled != nil {
+			item.CreatedAt = *entry.Crawled
+		} else if entry.Published != nil {
+			item.CreatedAt = *entry.Published
+		}
+
+		// the same article may already be stored under its native id, look it up by guid/link in any feed
+		if found, err := svc.db.FindItem(ctx, "", item.GUID, item.Link); err == nil {
+			item.ID, item.FeedID = found.ID, found.FeedID
+		}
+		created, err := svc.mergeItem(ctx, item)
+		if err != nil {
+			return nil, errors.Wrap(err, "save item error")
+		}
+		if created {
+			result.ItemsCreated++
+		} else {
+			result.ItemsMerged++
+		}
+	}
+	result.FoldersCreated = index.created
+	return result, nil
+}
+
+// ImportReaderExport 导入其他阅读器导出的收藏文章，format 可选 greader/miniflux，默认自动识别
+func (svc *Service) ImportReaderExport(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(400, gin.H{"error": "export file required"})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	entries, err := parseReaderExport(data, c.Query("format"))
+	if err != nil {
+		logrus.WithError(err).Warn("parse reader export error")
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := svc.importEntries(c.Request.Context(), entries)
+	if err != nil {
+		logrus.WithError(err).Error("import reader export error")
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"result": result})
+}
+
+// importedItemID returns the id of an item imported from another reader. It can not be the id
+// given by fetch, which hashes the raw published date the export does not carry.
+func importedItemID(guid, link string) string {
+	return Hash("import:" + lo.CoalesceOrEmpty(guid, link))
+}
+
+// adoptImportedItems gives the fetched items that were imported before the id of the imported item,
+// found by guid or link, so that they are not stored a second time.
+func (svc *Service) adoptImportedItems(ctx context.Context, items []*Item) error {
+	var ids []string
+	for _, item := range items {
+		ids = append(ids, item.ID)
+		ids = append(ids, importCandidates(item)...)
+	}
+	existing, err := svc.db.ExistingItemIDs(ctx, lo.Uniq(ids))
+	if err != nil {
+		return err
+	}
+	stored := lo.SliceToMap(existing, func(id string) (string, bool) { return id, true })
+	for _, item := range items {
+		if stored[item.ID] {
+			continue
+		}
+		if id, found := lo.Find(importCandidates(item), func(id string) bool { return stored[id] }); found {
+			item.ID = id
+			for _, enclosure := range item.Enclosures {
+				enclosure.ID, enclosure.ItemID = enclosureID(id, enclosure.URL), id
+			}
+			delete(stored, id) // items sharing a link adopt it once
+		}
+	}
+	return nil
+}
+
+// importCandidates returns the ids the item may have been imported with.
+func importCandidates(item *Item) []string {
+	var ids []string
+	if item.GUID != "" {
+		ids = append(ids, importedItemID(item.GUID, ""))
+	}
+	if item.Link != "" {
+		ids = append(ids, importedItemID("", item.Link))
+	}
+	return ids
+}
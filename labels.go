@@ -0,0 +1,13 @@
+package main
+
+import "github.com/gin-gonic/gin"
+
+// ListLabels 列出文章标签及其文章数量，用于构建待读、待分享等队列
+func (svc *Service) ListLabels(c *gin.Context) {
+	labels, err := svc.db.ListLabels(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"labels": labels})
+}
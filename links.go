@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+var linkConfig struct {
+	TrackingParams []string // query parameters removed from links, a trailing * matches a prefix
+	Wrappers       []string // hosts of redirect wrappers resolved to the link they wrap
+	MaxRedirects   int      // most redirects followed to unwrap a link
+	FetchPages     bool     // fetch item pages to follow <link rel=canonical>
+}
+
+func init() {
+	linkConfig.TrackingParams = splitList(os.Getenv("NEXA_TRACKING_PARAMS"), []string{
+		"utm_*", "fbclid", "gclid", "dclid", "msclkid", "yclid", "igshid", "mc_cid", "mc_eid",
+		"_hsenc", "_hsmi", "mkt_tok", "ref", "ref_src", "ref_url", "__twitter_impression",
+	})
+	linkConfig.Wrappers = splitList(os.Getenv("NEXA_LINK_WRAPPERS"), []string{
+		"feedproxy.google.com", "feeds.feedburner.com", "feedburner.google.com",
+		"t.co", "bit.ly", "ow.ly", "buff.ly", "dlvr.it", "ift.tt", "lnkd.in", "trib.al",
+	})
+	linkConfig.MaxRedirects = 5
+	if n, err := strconv.Atoi(os.Getenv("NEXA_LINK_MAX_REDIRECTS")); err == nil && n >= 0 {
+		linkConfig.MaxRedirects = n
+	}
+	linkConfig.FetchPages, _ = strconv.ParseBool(os.Getenv("NEXA_DEDUP_FETCH_PAGES"))
+}
+
+// splitList splits a comma separated setting, the default applies when it is empty.
+func splitList(s string, defaults []string) []string {
+	values := lo.Compact(lo.Map(strings.Split(s, ","), func(v string, _ int) string {
+		return strings.ToLower(strings.TrimSpace(v))
+	}))
+	if len(values) == 0 {
+		return defaults
+	}
+	return values
+}
+
+var (
+	canonicalTagRegexp  = regexp.MustCompile(`(?is)<link\s[^>]*\brel\s*=\s*["']?canonical\b[^>]*>`)
+	canonicalHrefRegexp = regexp.MustCompile(`(?is)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+func isTrackingParam(key string) bool {
+	key = strings.ToLower(key)
+	return lo.SomeBy(linkConfig.TrackingParams, func(param string) bool {
+		if prefix, ok := strings.CutSuffix(param, "*"); ok {
+			return strings.HasPrefix(key, prefix)
+		}
+		return key == param
+	})
+}
+
+func isWrapper(host string) bool {
+	host = strings.ToLower(host)
+	return lo.SomeBy(linkConfig.Wrappers, func(wrapper string) bool {
+		return host == wrapper || strings.HasSuffix(host, "."+wrapper)
+	})
+}
+
+// canonicalLink normalizes link so that the same story linked from different feeds compares equal:
+// scheme and host are lowercased, the fragment and tracking parameters are removed.
+func canonicalLink(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Host == "" {
+		return link
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment, u.RawFragment = "", ""
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			if isTrackingParam(key) {
+				query.Del(key)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return u.String()
+}
+
+// unwrapLink follows the redirects of known redirect wrappers like FeedBurner, at most
+// MaxRedirects of them, and returns the link they lead to. HEAD is tried before GET.
+func unwrapLink(ctx context.Context, link string) (string, error) {
+	client := &http.Client{
+		Transport: httpClient.Transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	for range linkConfig.MaxRedirects {
+		u, err := url.Parse(link)
+		if err != nil || !isWrapper(u.Hostname()) {
+			return link, nil
+		}
+		location, err := redirectLocation(ctx, client, http.MethodHead, u)
+		if errors.Is(err, errNoRedirect) {
+			// some servers do not answer HEAD
+			location, err = redirectLocation(ctx, client, http.MethodGet, u)
+		}
+		if errors.Is(err, errNoRedirect) {
+			return link, nil
+		} else if err != nil {
+			return link, err
+		}
+		link = location
+	}
+	return link, nil
+}
+
+// errNoRedirect is returned when the response is not a redirect.
+var errNoRedirect = errors.New("no redirect")
+
+func redirectLocation(ctx context.Context, client *http.Client, method string, u *url.URL) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "nexa/1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 || err != nil {
+		return "", errNoRedirect
+	}
+	return location.String(), nil
+}
+
+// findCanonical returns the <link rel=canonical> of the HTML page, resolved against base.
+func findCanonical(page string, base *url.URL) string {
+	tag := canonicalTagRegexp.FindString(page)
+	if tag == "" {
+		return ""
+	}
+	m := canonicalHrefRegexp.FindStringSubmatch(tag)
+	if m == nil {
+		return ""
+	}
+	href, err := url.Parse(html.UnescapeString(lo.CoalesceOrEmpty(m[1], m[2], m[3])))
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		href = base.ResolveReference(href)
+	}
+	if href.Scheme != "http" && href.Scheme != "https" {
+		return ""
+	}
+	return href.String()
+}
+
+// canonicalMaxPage is the number of bytes of an item page searched for its canonical link.
+const canonicalMaxPage = 512 * 1024
+
+// fetchCanonical fetches the page of the link and returns its canonical link,
+// the url redirects ended on when the page has none.
+func fetchCanonical(ctx context.Context, link string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "nexa/1.0")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return resp.Request.URL.String(), nil
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, canonicalMaxPage))
+	if err != nil {
+		return "", err
+	}
+	return lo.CoalesceOrEmpty(findCanonical(string(page), resp.Request.URL), resp.Request.URL.String()), nil
+}
+
+// normalizeLinks sets the canonical link of new items: redirect wrappers are resolved,
+// the <link rel=canonical> of the content or of the page is followed, and tracking
+// parameters are stripped. The original link is kept in Link.
+func (svc *Service) normalizeLinks(ctx context.Context, feed *Feed, items []*Item) {
+	log := logrus.WithField("feed_id", feed.ID)
+	for _, item := range items {
+		if item.Link == "" {
+			continue
+		}
+		link, err := unwrapLink(ctx, item.Link)
+		if err != nil {
+			log.WithError(err).Debugf("unwrap link %s error", item.Link)
+		}
+		base, _ := url.Parse(link)
+		if canonical := findCanonical(item.Content, base); canonical != "" {
+			link = canonical
+		} else if linkConfig.FetchPages {
+			if canonical, err := fetchCanonical(ctx, link); err != nil {
+				log.WithError(err).Debugf("fetch canonical link of %s error", link)
+			} else {
+				link = canonical
+			}
+		}
+		item.CanonicalLink = canonicalLink(link)
+	}
+}
@@ -1,5 +1,31 @@
 package main
 
+import (
+	"flag"
+
+	"github.com/sirupsen/logrus"
+)
+
 func main() {
-	Start(":7766")
+	ephemeral := flag.Bool("ephemeral", false, "keep all data in memory, nothing is written to disk")
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			logrus.WithError(err).Fatal("command failed")
+		}
+		return
+	}
+
+	var db DB
+	if *ephemeral {
+		logrus.Warn("running in ephemeral mode, data will be lost on exit")
+		db = NewMemoryDB()
+	} else {
+		var err error
+		if db, err = openDB(); err != nil {
+			logrus.WithError(err).Fatal("failed to open db")
+		}
+	}
+	Start(":7766", db)
 }
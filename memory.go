@@ -0,0 +1,1219 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"gorm.io/gorm"
+)
+
+// MemoryDB is a DB kept entirely in memory, used by the ephemeral mode.
+// It follows the semantics of the gorm implementation, e.g. AddItem ignores items already stored.
+type MemoryDB struct {
+	mu    sync.RWMutex
+	feeds map[string]*Feed
+	items map[string]*Item
+	tags  map[string][]string // feed id -> tag names
+	users map[string]*User
+
+	tagSettings map[string]*TagSetting
+	folders     map[string]*Folder
+	highlights  map[string]*Highlight
+	rules       map[string]*Rule
+	smartFeeds  map[string]*SmartFeed
+	outputFeeds map[string]*OutputFeed
+	enclosures  map[string]*Enclosure
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		feeds: make(map[string]*Feed),
+		items: make(map[string]*Item),
+		tags:  make(map[string][]string),
+		users: make(map[string]*User),
+
+		tagSettings: make(map[string]*TagSetting),
+		folders:     make(map[string]*Folder),
+		highlights:  make(map[string]*Highlight),
+		rules:       make(map[string]*Rule),
+		smartFeeds:  make(map[string]*SmartFeed),
+		outputFeeds: make(map[string]*OutputFeed),
+		enclosures:  make(map[string]*Enclosure),
+	}
+}
+
+func (m *MemoryDB) GetFeed(ctx context.Context, feedID string) (*Feed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	feed, ok := m.feeds[feedID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return m.copyFeed(feed), nil
+}
+
+func (m *MemoryDB) FilterFeeds(ctx context.Context, tags []string) ([]*ListFeedResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	feeds := []*ListFeedResult{}
+	for _, feed := range m.feeds {
+		if len(tags) > 0 && !lo.Some(m.tags[feed.ID], tags) {
+			continue
+		}
+		result := &ListFeedResult{Feed: m.copyFeed(feed)}
+		for _, item := range m.items {
+			if item.FeedID == feed.ID {
+				result.TotalCount++
+				result.UnreadCount += lo.Ternary(item.Read, 0, 1)
+				result.StarredCount += lo.Ternary(item.Starred, 1, 0)
+			}
+		}
+		feeds = append(feeds, result)
+	}
+	sort.Slice(feeds, func(i, j int) bool { return feeds[i].ID < feeds[j].ID })
+	return feeds, nil
+}
+
+func (m *MemoryDB) SaveFeed(ctx context.Context, feed *Feed) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := *feed
+	stored.Tags = nil
+	m.feeds[feed.ID] = &stored
+
+	var tags []string
+	for _, tagName := range feed.Tags {
+		if tagName != "" && !slices.Contains(tags, tagName) {
+			tags = append(tags, tagName)
+		}
+	}
+	m.tags[feed.ID] = tags
+	return nil
+}
+
+func (m *MemoryDB) UpdateFeed(ctx context.Context, feedID string, update *FeedUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	feed, ok := m.feeds[feedID]
+	if !ok {
+		return nil // like an UPDATE matching no row
+	}
+	if update.UpstreamTitle != nil {
+		feed.UpstreamTitle = *update.UpstreamTitle
+		if feed.CustomTitle == "" {
+			feed.Title = *update.UpstreamTitle
+		}
+	}
+	for field, value := range map[*string]*string{
+		&feed.SiteURL:     update.SiteURL,
+		&feed.Description: update.Description,
+		&feed.Image:       update.Image,
+		&feed.Language:    update.Language,
+		&feed.Generator:   update.Generator,
+		&feed.Copyright:   update.Copyright,
+		&feed.IconPath:    update.IconPath,
+		&feed.IconType:    update.IconType,
+	} {
+		if value != nil {
+			*field = *value
+		}
+	}
+	for field, value := range map[**time.Time]*time.Time{
+		&feed.LastBuildDate: update.LastBuildDate,
+		&feed.IconUpdatedAt: update.IconUpdatedAt,
+		&feed.IconCheckedAt: update.IconCheckedAt,
+	} {
+		if value != nil {
+			*field = lo.ToPtr(*value)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) DeleteFeed(ctx context.Context, feedID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, item := range m.items {
+		if item.FeedID == feedID {
+			m.deleteHighlights(id)
+			m.deleteEnclosures(id)
+			delete(m.items, id)
+		}
+	}
+	delete(m.feeds, feedID)
+	delete(m.tags, feedID)
+	return nil
+}
+
+func (m *MemoryDB) ListTags(ctx context.Context) ([]*ListTagResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	tags := make(map[string]*ListTagResult)
+	for feedID, names := range m.tags {
+		for _, name := range names {
+			result, ok := tags[name]
+			if !ok {
+				result = &ListTagResult{Name: name}
+				if setting := m.tagSettings[name]; setting != nil {
+					result.Position, result.Color = setting.Position, setting.Color
+				}
+				tags[name] = result
+			}
+			for _, item := range m.items {
+				if item.FeedID == feedID {
+					result.TotalCount++
+					result.UnreadCount += lo.Ternary[int64](item.Read, 0, 1)
+					result.StarredCount += lo.Ternary[int64](item.Starred, 1, 0)
+				}
+			}
+		}
+	}
+
+	results := lo.Values(tags)
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Position != results[j].Position {
+			return results[i].Position < results[j].Position
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results, nil
+}
+
+// hasTag reports whether any feed has the tag, the caller must hold the lock.
+func (m *MemoryDB) hasTag(name string) bool {
+	return lo.SomeBy(lo.Values(m.tags), func(names []string) bool { return slices.Contains(names, name) })
+}
+
+func (m *MemoryDB) RenameTag(ctx context.Context, from, to string, merge bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hasTag(from) {
+		return gorm.ErrRecordNotFound
+	}
+	exists := m.hasTag(to)
+	if exists && !merge {
+		return ErrTagExists
+	}
+	for feedID, names := range m.tags {
+		if !slices.Contains(names, from) {
+			continue
+		}
+		names = lo.Without(names, from)
+		if !slices.Contains(names, to) {
+			names = append(names, to)
+		}
+		m.tags[feedID] = names
+	}
+
+	if !exists {
+		delete(m.tagSettings, to)
+		if setting := m.tagSettings[from]; setting != nil {
+			setting.Name = to
+			m.tagSettings[to] = setting
+		}
+	}
+	delete(m.tagSettings, from)
+	return nil
+}
+
+func (m *MemoryDB) DeleteTag(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hasTag(name) {
+		return gorm.ErrRecordNotFound
+	}
+	for feedID, names := range m.tags {
+		m.tags[feedID] = lo.Without(names, name)
+	}
+	delete(m.tagSettings, name)
+	return nil
+}
+
+func (m *MemoryDB) SetTagColor(ctx context.Context, name, color string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hasTag(name) {
+		return gorm.ErrRecordNotFound
+	}
+	m.tagSetting(name).Color = color
+	return nil
+}
+
+func (m *MemoryDB) SetTagOrder(ctx context.Context, names []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, name := range names {
+		m.tagSetting(name).Position = i + 1
+	}
+	return nil
+}
+
+// tagSetting returns the settings of the tag, creating them if needed, the caller must hold the lock.
+func (m *MemoryDB) tagSetting(name string) *TagSetting {
+	setting, ok := m.tagSettings[name]
+	if !ok {
+		setting = &TagSetting{Name: name}
+		m.tagSettings[name] = setting
+	}
+	return setting
+}
+
+func (m *MemoryDB) AddItem(ctx context.Context, items ...*Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, item := range items {
+		item.CreatedAt = now
+		item.ClusterID = lo.CoalesceOrEmpty(item.ClusterID, item.ID)
+		m.addEnclosures(item.Enclosures)
+		if existing, ok := m.items[item.ID]; ok {
+			// on conflict do nothing, but details the item lacks are added
+			existing.Authors = append(existing.Authors, copyAuthors(item.Authors[min(len(existing.Authors), len(item.Authors)):])...)
+			existing.Categories = sortedLabels(append(existing.Categories, item.Categories...))
+			continue
+		}
+		stored := *item
+		stored.Enclosures = nil
+		stored.Authors = copyAuthors(item.Authors)
+		stored.Categories = sortedLabels(item.Categories)
+		m.items[item.ID] = &stored
+	}
+	return nil
+}
+
+func (m *MemoryDB) FilterItems(ctx context.Context, filter *ItemFilter) ([]*Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	items := m.filterItems(filter)
+	less := m.itemLess(filter)
+	sort.Slice(items, func(i, j int) bool { return less(items[i], items[j]) })
+	if c := filter.Cursor; c != nil {
+		after := &Item{ID: c.ID, PubDate: &c.Time, CreatedAt: c.Time}
+		items = lo.Filter(items, func(item *Item, _ int) bool { return less(after, item) })
+	}
+
+	offset := 0
+	if filter.Offset != nil {
+		offset = min(max(*filter.Offset, 0), len(items))
+	}
+	items = items[offset:]
+	if filter.Limit != nil && *filter.Limit >= 0 && *filter.Limit < len(items) {
+		items = items[:*filter.Limit]
+	}
+
+	results := make([]*Item, len(items))
+	for i, item := range items {
+		results[i] = m.copyItemDetails(item)
+	}
+	return results, nil
+}
+
+// itemLess returns the ordering of filter.Sort, the same as the SQL backends.
+func (m *MemoryDB) itemLess(filter *ItemFilter) func(x, y *Item) bool {
+	newest := func(x, y *Item) bool {
+		a, b := itemSortTime(x), itemSortTime(y)
+		if a.Equal(b) {
+			return x.ID > y.ID
+		}
+		return a.After(b)
+	}
+	// then orders by key first, items with equal keys by newest
+	then := func(key func(item *Item) string) func(x, y *Item) bool {
+		return func(x, y *Item) bool {
+			if a, b := key(x), key(y); a != b {
+				return a < b
+			}
+			return newest(x, y)
+		}
+	}
+
+	switch filter.Sort {
+	case SortOldest:
+		return func(x, y *Item) bool { return newest(y, x) }
+	case SortCreatedAt:
+		return func(x, y *Item) bool {
+			if x.CreatedAt.Equal(y.CreatedAt) {
+				return x.ID > y.ID
+			}
+			return x.CreatedAt.After(y.CreatedAt)
+		}
+	case SortFeed:
+		return then(func(item *Item) string {
+			if feed, ok := m.feeds[item.FeedID]; ok {
+				return feed.Title
+			}
+			return ""
+		})
+	case SortUnread:
+		return then(func(item *Item) string { return strconv.FormatBool(item.Read) })
+	case SortRelevance:
+		q := strings.ToLower(filter.rankText())
+		return then(func(item *Item) string {
+			return strconv.FormatBool(q == "" || !strings.Contains(strings.ToLower(item.Title), q))
+		})
+	default:
+		return newest
+	}
+}
+
+// itemSortTime is the time items are ordered by, the fetch time when there is no pub_date.
+func itemSortTime(item *Item) time.Time {
+	if item.PubDate != nil {
+		return *item.PubDate
+	}
+	return item.CreatedAt
+}
+
+func (m *MemoryDB) CountItems(ctx context.Context, filter *ItemFilter) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return int64(len(m.filterItems(filter))), nil
+}
+
+func (m *MemoryDB) filterItems(filter *ItemFilter) []*Item {
+	var items []*Item
+	for _, item := range m.items {
+		if m.matchItem(item, filter) {
+			items = append(items, item)
+		}
+	}
+	if filter.Collapse {
+		// the matching item with the smallest id stands for its cluster
+		representatives := make(map[string]*Item)
+		for _, item := range items {
+			if r, ok := representatives[item.ClusterID]; !ok || item.ID < r.ID {
+				representatives[item.ClusterID] = item
+			}
+		}
+		items = lo.Filter(items, func(item *Item, _ int) bool { return representatives[item.ClusterID] == item })
+	}
+	// map iteration is random, keep results deterministic for equal sort keys
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items
+}
+
+func (m *MemoryDB) matchItem(item *Item, filter *ItemFilter) bool {
+	if len(filter.FeedIDs) > 0 && !slices.Contains(filter.FeedIDs, item.FeedID) {
+		return false
+	}
+	if len(filter.Tags) > 0 && !lo.Some(m.tags[item.FeedID], filter.Tags) {
+		return false
+	}
+	if len(filter.Labels) > 0 && !lo.Some(item.Labels, filter.Labels) {
+		return false
+	}
+	if len(filter.Authors) > 0 && !lo.SomeBy(item.Authors, func(author *ItemAuthor) bool {
+		return lo.SomeBy(filter.Authors, func(name string) bool {
+			return strings.EqualFold(author.Name, name) || (author.Email != "" && strings.EqualFold(author.Email, name))
+		})
+	}) {
+		return false
+	}
+	if len(filter.Categories) > 0 && !lo.SomeBy(item.Categories, func(category string) bool {
+		return lo.SomeBy(filter.Categories, func(name string) bool { return strings.EqualFold(category, name) })
+	}) {
+		return false
+	}
+	if len(filter.ClusterIDs) > 0 && !slices.Contains(filter.ClusterIDs, item.ClusterID) {
+		return false
+	}
+	if len(filter.FolderIDs) > 0 {
+		feed, ok := m.feeds[item.FeedID]
+		if !ok || !slices.Contains(filter.FolderIDs, feed.FolderID) {
+			return false
+		}
+	}
+	if filter.Unread != nil && item.Read == *filter.Unread {
+		return false
+	}
+	if len(filter.FeedTitles) > 0 {
+		feed, ok := m.feeds[item.FeedID]
+		if !ok || !lo.SomeBy(filter.FeedTitles, func(title string) bool {
+			return strings.EqualFold(feed.Title, title) || feed.ID == title
+		}) {
+			return false
+		}
+	}
+	if filter.PubDate != nil && (item.PubDate == nil || item.PubDate.Before(*filter.PubDate)) {
+		return false
+	}
+	if filter.PubBefore != nil && (item.PubDate == nil || !item.PubDate.Before(*filter.PubBefore)) {
+		return false
+	}
+	if filter.Starred != nil && item.Starred != *filter.Starred {
+		return false
+	}
+	if filter.Liked != nil && item.Liked != *filter.Liked {
+		return false
+	}
+	if filter.SearchQuery != nil && *filter.SearchQuery != "" {
+		q := strings.ToLower(*filter.SearchQuery)
+		if !strings.Contains(strings.ToLower(item.Title), q) &&
+			!strings.Contains(strings.ToLower(item.Content), q) &&
+			!strings.Contains(strings.ToLower(item.Description), q) {
+			return false
+		}
+	}
+	for _, term := range filter.Terms {
+		if matchTerm(item, term) == term.Exclude {
+			return false
+		}
+	}
+	return true
+}
+
+func matchTerm(item *Item, term SearchTerm) bool {
+	var texts []string
+	switch term.Field {
+	case TermTitle:
+		texts = []string{item.Title}
+	case TermContent:
+		texts = []string{item.Content, item.Description}
+	case TermAuthor:
+		texts = lo.Map(item.Authors, func(author *ItemAuthor, _ int) string { return author.Name })
+	case TermLink:
+		texts = []string{item.Link}
+	default:
+		texts = []string{item.Title, item.Content, item.Description}
+	}
+	q := strings.ToLower(term.Text)
+	return lo.SomeBy(texts, func(text string) bool { return strings.Contains(strings.ToLower(text), q) })
+}
+
+func (m *MemoryDB) DuplicateCandidates(ctx context.Context, since time.Time, links []string) ([]*Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	candidates := []*Item{}
+	for _, item := range m.items {
+		if !item.CreatedAt.Before(since) || (item.CanonicalLink != "" && slices.Contains(links, item.CanonicalLink)) {
+			candidates = append(candidates, &Item{
+				ID:            item.ID,
+				FeedID:        item.FeedID,
+				CreatedAt:     item.CreatedAt,
+				CanonicalLink: item.CanonicalLink,
+				SimHash:       item.SimHash,
+				ClusterID:     item.ClusterID,
+			})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if !candidates[i].CreatedAt.Equal(candidates[j].CreatedAt) {
+			return candidates[i].CreatedAt.Before(candidates[j].CreatedAt)
+		}
+		return candidates[i].ID < candidates[j].ID
+	})
+	return candidates, nil
+}
+
+func (m *MemoryDB) ExistingItemIDs(ctx context.Context, itemIDs []string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return lo.Filter(itemIDs, func(id string, _ int) bool {
+		_, ok := m.items[id]
+		return ok
+	}), nil
+}
+
+func (m *MemoryDB) GetItem(ctx context.Context, itemID string) (*Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	item, ok := m.items[itemID]
+	if !ok {
+		return new(Item), gorm.ErrRecordNotFound
+	}
+	return m.copyItemDetails(item), nil
+}
+
+func (m *MemoryDB) FindItem(ctx context.Context, feedID, guid, link string) (*Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, item := range m.filterItems(&ItemFilter{}) {
+		if feedID != "" && item.FeedID != feedID {
+			continue
+		}
+		if (guid != "" && item.GUID == guid) || (link != "" && item.Link == link) {
+			return m.copyItemDetails(item), nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (m *MemoryDB) UpdateItem(ctx context.Context, itemID string, update *ItemUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item, ok := m.items[itemID]
+	if !ok {
+		return nil // like an UPDATE matching no rows
+	}
+	if update.Read != nil {
+		item.Read = *update.Read
+	}
+	if update.Starred != nil {
+		item.Starred = *update.Starred
+	}
+	if update.Liked != nil {
+		item.Liked = *update.Liked
+	}
+	if update.Note != nil {
+		item.Note = *update.Note
+	}
+	if update.Labels != nil {
+		item.Labels = sortedLabels(*update.Labels)
+	}
+	if update.Position != nil {
+		item.Position = *update.Position
+	}
+	return nil
+}
+
+func (m *MemoryDB) SaveItem(ctx context.Context, item *Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	item.ClusterID = lo.CoalesceOrEmpty(item.ClusterID, item.ID)
+	m.addEnclosures(item.Enclosures)
+	stored := *item
+	stored.Labels = sortedLabels(item.Labels)
+	stored.Enclosures = nil
+	stored.Authors = copyAuthors(item.Authors)
+	stored.Categories = sortedLabels(item.Categories)
+	m.items[item.ID] = &stored
+	return nil
+}
+
+// sortedLabels returns the distinct non empty labels in the order the SQL backends return them.
+func sortedLabels(labels []string) []string {
+	labels = lo.Uniq(lo.Compact(labels))
+	slices.Sort(labels)
+	return labels
+}
+
+// copyItemDetails copies the item with its enclosures, the caller must hold the lock.
+func (m *MemoryDB) copyItemDetails(item *Item) *Item {
+	copied := copyItem(item)
+	copied.Enclosures = []*Enclosure{}
+	for _, enclosure := range m.enclosures {
+		if enclosure.ItemID == item.ID {
+			e := *enclosure
+			copied.Enclosures = append(copied.Enclosures, &e)
+		}
+	}
+	sort.Slice(copied.Enclosures, func(i, j int) bool { return copied.Enclosures[i].Position < copied.Enclosures[j].Position })
+	return copied
+}
+
+// addEnclosures stores the enclosures not stored yet, the caller must hold the lock.
+func (m *MemoryDB) addEnclosures(enclosures []*Enclosure) {
+	now := time.Now()
+	for _, enclosure := range enclosures {
+		if _, ok := m.enclosures[enclosure.ID]; ok {
+			continue
+		}
+		stored := *enclosure
+		if stored.CreatedAt.IsZero() {
+			stored.CreatedAt = now
+		}
+		m.enclosures[enclosure.ID] = &stored
+	}
+}
+
+// deleteEnclosures deletes the enclosures of the item, the caller must hold the lock.
+func (m *MemoryDB) deleteEnclosures(itemID string) {
+	for id, enclosure := range m.enclosures {
+		if enclosure.ItemID == itemID {
+			delete(m.enclosures, id)
+		}
+	}
+}
+
+func (m *MemoryDB) FilterEnclosures(ctx context.Context, filter *EnclosureFilter) ([]*Enclosure, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	enclosures := []*Enclosure{}
+	for _, enclosure := range m.enclosures {
+		if _, ok := m.items[enclosure.ItemID]; !ok ||
+			(len(filter.FeedIDs) > 0 && !slices.Contains(filter.FeedIDs, enclosure.FeedID)) ||
+			(len(filter.ItemIDs) > 0 && !slices.Contains(filter.ItemIDs, enclosure.ItemID)) ||
+			(filter.Downloaded != nil && (enclosure.DownloadedAt != nil) != *filter.Downloaded) {
+			continue
+		}
+		copied := *enclosure
+		enclosures = append(enclosures, &copied)
+	}
+	sort.Slice(enclosures, func(i, j int) bool {
+		x, y := m.items[enclosures[i].ItemID], m.items[enclosures[j].ItemID]
+		if a, b := itemSortTime(x), itemSortTime(y); !a.Equal(b) {
+			return a.Before(b)
+		}
+		if x.ID != y.ID {
+			return x.ID < y.ID
+		}
+		return enclosures[i].Position < enclosures[j].Position
+	})
+	return enclosures, nil
+}
+
+func (m *MemoryDB) GetEnclosure(ctx context.Context, enclosureID string) (*Enclosure, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	enclosure, ok := m.enclosures[enclosureID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *enclosure
+	return &copied, nil
+}
+
+func (m *MemoryDB) SaveEnclosure(ctx context.Context, enclosure *Enclosure) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := *enclosure
+	m.enclosures[enclosure.ID] = &stored
+	return nil
+}
+
+func copyItem(item *Item) *Item {
+	copied := *item
+	copied.Labels = slices.Clone(item.Labels)
+	if copied.Labels == nil {
+		copied.Labels = []string{}
+	}
+	copied.Authors = copyAuthors(item.Authors)
+	copied.Categories = lo.CoalesceSliceOrEmpty(slices.Clone(item.Categories))
+	return &copied
+}
+
+func copyAuthors(authors []*ItemAuthor) []*ItemAuthor {
+	copied := make([]*ItemAuthor, len(authors))
+	for i, author := range authors {
+		a := *author
+		a.Position = i
+		copied[i] = &a
+	}
+	return copied
+}
+
+func (m *MemoryDB) MarkInFeed(ctx context.Context, feedID string, itemIDs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, item := range m.items {
+		if item.FeedID == feedID {
+			item.InFeed = slices.Contains(itemIDs, item.ID)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryDB) PurgeableItems(ctx context.Context, feedID string, keepLast int, before *time.Time) ([]*Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var items []*Item
+	for _, item := range m.items {
+		if item.FeedID == feedID {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return itemSortTime(items[i]).After(itemSortTime(items[j])) })
+
+	var results []*Item
+	for i, item := range items {
+		if item.Starred || item.Liked || item.InFeed || len(item.Labels) > 0 || item.Note != "" || m.highlighted(item.ID) || i < keepLast {
+			continue
+		}
+		if before != nil && !itemSortTime(item).Before(*before) {
+			continue
+		}
+		results = append(results, copyItem(item))
+	}
+	slices.Reverse(results)
+	return results, nil
+}
+
+func (m *MemoryDB) DeleteItems(ctx context.Context, itemIDs ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, id := range itemIDs {
+		m.deleteHighlights(id)
+		m.deleteEnclosures(id)
+		delete(m.items, id)
+	}
+	return nil
+}
+
+func (m *MemoryDB) Optimize(ctx context.Context) error { return nil }
+
+func (m *MemoryDB) Backup(ctx context.Context, path string) error {
+	return errors.New("nothing to back up in ephemeral mode")
+}
+
+func (m *MemoryDB) ListLabels(ctx context.Context) ([]*ListLabelResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	labels := make(map[string]*ListLabelResult)
+	for _, item := range m.items {
+		for _, name := range item.Labels {
+			result, ok := labels[name]
+			if !ok {
+				result = &ListLabelResult{Name: name}
+				labels[name] = result
+			}
+			result.TotalCount++
+			result.UnreadCount += lo.Ternary[int64](item.Read, 0, 1)
+			result.StarredCount += lo.Ternary[int64](item.Starred, 1, 0)
+		}
+	}
+
+	results := lo.Values(labels)
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results, nil
+}
+
+func (m *MemoryDB) TopCategories(ctx context.Context, feedID string, limit int) ([]*ListCategoryResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	categories := make(map[string]*ListCategoryResult)
+	for _, item := range m.items {
+		if item.FeedID != feedID {
+			continue
+		}
+		for _, name := range item.Categories {
+			result, ok := categories[strings.ToLower(name)]
+			if !ok {
+				result = &ListCategoryResult{Name: name}
+				categories[strings.ToLower(name)] = result
+			}
+			result.Name = min(result.Name, name)
+			result.TotalCount++
+			result.UnreadCount += lo.Ternary[int64](item.Read, 0, 1)
+			result.StarredCount += lo.Ternary[int64](item.Starred, 1, 0)
+		}
+	}
+
+	results := lo.Values(categories)
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].TotalCount != results[j].TotalCount {
+			return results[i].TotalCount > results[j].TotalCount
+		}
+		return results[i].Name < results[j].Name
+	})
+	return results[:min(limit, len(results))], nil
+}
+
+func (m *MemoryDB) FilterHighlights(ctx context.Context, filter *HighlightFilter) ([]*Highlight, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	highlights := m.filterHighlights(filter)
+	offset := 0
+	if filter.Offset != nil {
+		offset = min(max(*filter.Offset, 0), len(highlights))
+	}
+	highlights = highlights[offset:]
+	if filter.Limit != nil && *filter.Limit >= 0 && *filter.Limit < len(highlights) {
+		highlights = highlights[:*filter.Limit]
+	}
+
+	results := make([]*Highlight, len(highlights))
+	for i, highlight := range highlights {
+		copied := *highlight
+		results[i] = &copied
+	}
+	return results, nil
+}
+
+func (m *MemoryDB) CountHighlights(ctx context.Context, filter *HighlightFilter) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return int64(len(m.filterHighlights(filter))), nil
+}
+
+func (m *MemoryDB) filterHighlights(filter *HighlightFilter) []*Highlight {
+	highlights := []*Highlight{}
+	for _, highlight := range m.highlights {
+		if len(filter.ItemIDs) == 0 || slices.Contains(filter.ItemIDs, highlight.ItemID) {
+			highlights = append(highlights, highlight)
+		}
+	}
+	sort.Slice(highlights, func(i, j int) bool {
+		if !highlights[i].CreatedAt.Equal(highlights[j].CreatedAt) {
+			return highlights[i].CreatedAt.After(highlights[j].CreatedAt)
+		}
+		return highlights[i].ID < highlights[j].ID
+	})
+	return highlights
+}
+
+func (m *MemoryDB) GetHighlight(ctx context.Context, highlightID string) (*Highlight, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	highlight, ok := m.highlights[highlightID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *highlight
+	return &copied, nil
+}
+
+func (m *MemoryDB) SaveHighlight(ctx context.Context, highlight *Highlight) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if highlight.CreatedAt.IsZero() {
+		highlight.CreatedAt = now
+	}
+	highlight.UpdatedAt = now
+	stored := *highlight
+	m.highlights[highlight.ID] = &stored
+	return nil
+}
+
+func (m *MemoryDB) DeleteHighlight(ctx context.Context, highlightID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.highlights[highlightID]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	delete(m.highlights, highlightID)
+	return nil
+}
+
+// highlighted reports whether the item has highlights, the caller must hold the lock.
+func (m *MemoryDB) highlighted(itemID string) bool {
+	return lo.SomeBy(lo.Values(m.highlights), func(highlight *Highlight) bool { return highlight.ItemID == itemID })
+}
+
+// deleteHighlights deletes the highlights of the item, the caller must hold the lock.
+func (m *MemoryDB) deleteHighlights(itemID string) {
+	for id, highlight := range m.highlights {
+		if highlight.ItemID == itemID {
+			delete(m.highlights, id)
+		}
+	}
+}
+
+func (m *MemoryDB) ListRules(ctx context.Context) ([]*Rule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rules := make([]*Rule, 0, len(m.rules))
+	for _, rule := range m.rules {
+		rules = append(rules, copyRule(rule))
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].Position != rules[j].Position {
+			return rules[i].Position < rules[j].Position
+		}
+		if !rules[i].CreatedAt.Equal(rules[j].CreatedAt) {
+			return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+		}
+		return rules[i].ID < rules[j].ID
+	})
+	return rules, nil
+}
+
+func (m *MemoryDB) GetRule(ctx context.Context, ruleID string) (*Rule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rule, ok := m.rules[ruleID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return copyRule(rule), nil
+}
+
+func (m *MemoryDB) SaveRule(ctx context.Context, rule *Rule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if rule.CreatedAt.IsZero() {
+		rule.CreatedAt = now
+	}
+	rule.UpdatedAt = now
+	m.rules[rule.ID] = copyRule(rule)
+	return nil
+}
+
+func (m *MemoryDB) DeleteRule(ctx context.Context, ruleID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.rules[ruleID]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	delete(m.rules, ruleID)
+	return nil
+}
+
+func copyRule(rule *Rule) *Rule {
+	copied := *rule
+	copied.FeedIDs = slices.Clone(rule.FeedIDs)
+	copied.Tags = slices.Clone(rule.Tags)
+	copied.Conditions = slices.Clone(rule.Conditions)
+	copied.Actions = slices.Clone(rule.Actions)
+	return &copied
+}
+
+func (m *MemoryDB) ListSmartFeeds(ctx context.Context) ([]*SmartFeed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	smartFeeds := make([]*SmartFeed, 0, len(m.smartFeeds))
+	for _, smartFeed := range m.smartFeeds {
+		smartFeeds = append(smartFeeds, copySmartFeed(smartFeed))
+	}
+	sort.Slice(smartFeeds, func(i, j int) bool {
+		if smartFeeds[i].Position != smartFeeds[j].Position {
+			return smartFeeds[i].Position < smartFeeds[j].Position
+		}
+		return smartFeeds[i].Name < smartFeeds[j].Name
+	})
+	return smartFeeds, nil
+}
+
+func (m *MemoryDB) GetSmartFeed(ctx context.Context, smartFeedID string) (*SmartFeed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	smartFeed, ok := m.smartFeeds[smartFeedID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return copySmartFeed(smartFeed), nil
+}
+
+func (m *MemoryDB) SaveSmartFeed(ctx context.Context, smartFeed *SmartFeed) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if smartFeed.CreatedAt.IsZero() {
+		smartFeed.CreatedAt = now
+	}
+	smartFeed.UpdatedAt = now
+	m.smartFeeds[smartFeed.ID] = copySmartFeed(smartFeed)
+	return nil
+}
+
+func (m *MemoryDB) DeleteSmartFeed(ctx context.Context, smartFeedID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.smartFeeds[smartFeedID]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	delete(m.smartFeeds, smartFeedID)
+	return nil
+}
+
+func copySmartFeed(smartFeed *SmartFeed) *SmartFeed {
+	copied := *smartFeed
+	copied.FeedIDs = slices.Clone(smartFeed.FeedIDs)
+	copied.Tags = slices.Clone(smartFeed.Tags)
+	copied.Labels = slices.Clone(smartFeed.Labels)
+	return &copied
+}
+
+func (m *MemoryDB) ListOutputFeeds(ctx context.Context) ([]*OutputFeed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	outputFeeds := make([]*OutputFeed, 0, len(m.outputFeeds))
+	for _, outputFeed := range m.outputFeeds {
+		outputFeeds = append(outputFeeds, copyOutputFeed(outputFeed))
+	}
+	sort.Slice(outputFeeds, func(i, j int) bool { return outputFeeds[i].Name < outputFeeds[j].Name })
+	return outputFeeds, nil
+}
+
+func (m *MemoryDB) GetOutputFeed(ctx context.Context, outputFeedID string) (*OutputFeed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	outputFeed, ok := m.outputFeeds[outputFeedID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return copyOutputFeed(outputFeed), nil
+}
+
+func (m *MemoryDB) FindOutputFeed(ctx context.Context, token string) (*OutputFeed, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, outputFeed := range m.outputFeeds {
+		if outputFeed.Token == token {
+			return copyOutputFeed(outputFeed), nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (m *MemoryDB) SaveOutputFeed(ctx context.Context, outputFeed *OutputFeed) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if outputFeed.CreatedAt.IsZero() {
+		outputFeed.CreatedAt = now
+	}
+	outputFeed.UpdatedAt = now
+	m.outputFeeds[outputFeed.ID] = copyOutputFeed(outputFeed)
+	return nil
+}
+
+func (m *MemoryDB) DeleteOutputFeed(ctx context.Context, outputFeedID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.outputFeeds[outputFeedID]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	delete(m.outputFeeds, outputFeedID)
+	return nil
+}
+
+func copyOutputFeed(outputFeed *OutputFeed) *OutputFeed {
+	copied := *outputFeed
+	copied.FeedIDs = slices.Clone(outputFeed.FeedIDs)
+	copied.Tags = slices.Clone(outputFeed.Tags)
+	copied.Labels = slices.Clone(outputFeed.Labels)
+	return &copied
+}
+
+func (m *MemoryDB) ListFolders(ctx context.Context) ([]*Folder, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	folders := make([]*Folder, 0, len(m.folders))
+	for _, folder := range m.folders {
+		copied := *folder
+		folders = append(folders, &copied)
+	}
+	sort.Slice(folders, func(i, j int) bool {
+		if folders[i].Position != folders[j].Position {
+			return folders[i].Position < folders[j].Position
+		}
+		return folders[i].Name < folders[j].Name
+	})
+	return folders, nil
+}
+
+func (m *MemoryDB) GetFolder(ctx context.Context, folderID string) (*Folder, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	folder, ok := m.folders[folderID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *folder
+	return &copied, nil
+}
+
+func (m *MemoryDB) SaveFolder(ctx context.Context, folder *Folder) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if folder.CreatedAt.IsZero() {
+		folder.CreatedAt = time.Now()
+	}
+	stored := *folder
+	m.folders[folder.ID] = &stored
+	return nil
+}
+
+func (m *MemoryDB) DeleteFolder(ctx context.Context, folderID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	folder, ok := m.folders[folderID]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+	for _, child := range m.folders {
+		if child.ParentID == folderID {
+			child.ParentID = folder.ParentID
+		}
+	}
+	for _, feed := range m.feeds {
+		if feed.FolderID == folderID {
+			feed.FolderID = folder.ParentID
+		}
+	}
+	delete(m.folders, folderID)
+	return nil
+}
+
+func (m *MemoryDB) GetUser(ctx context.Context, name string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.users[name]
+	if !ok {
+		return new(User), gorm.ErrRecordNotFound
+	}
+	copied := *user
+	copied.RecoveryCodes = slices.Clone(user.RecoveryCodes)
+	return &copied, nil
+}
+
+func (m *MemoryDB) SaveUser(ctx context.Context, user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored := *user
+	stored.RecoveryCodes = slices.Clone(user.RecoveryCodes)
+	if stored.CreatedAt.IsZero() {
+		stored.CreatedAt = time.Now()
+	}
+	m.users[user.Name] = &stored
+	return nil
+}
+
+func (m *MemoryDB) copyFeed(feed *Feed) *Feed {
+	copied := *feed
+	copied.Tags = slices.Clone(m.tags[feed.ID])
+	if copied.Tags == nil {
+		copied.Tags = []string{}
+	}
+	return &copied
+}
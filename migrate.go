@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// migration is a numbered schema change, each one runs in its own transaction.
+// Migrations must never be edited once released, add a new one instead.
+// They describe the tables with local structs so that later changes of the
+// models in types.go do not change what an old migration does.
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+var migrations = []migration{
+	{1, "initial schema", func(tx *gorm.DB) error {
+		type feed struct {
+			ID            string `gorm:"primaryKey"`
+			Title         string
+			Desc          string
+			Link          string
+			LastBuildDate *time.Time
+			Cron          string
+			Suspended     bool
+		}
+		type item struct {
+			ID          string `gorm:"primaryKey"`
+			FeedID      string
+			CreatedAt   time.Time
+			Title       string
+			Content     string
+			Description string
+			Image       string
+			Link        string
+			GUID        string
+			PubDate     *time.Time
+			Read        bool
+			Starred     bool
+			Liked       bool
+			Tags        string
+		}
+		type tag struct {
+			FeedID string `gorm:"primaryKey"`
+			Name   string `gorm:"primaryKey"`
+		}
+		type user struct {
+			Name          string `gorm:"primaryKey"`
+			CreatedAt     time.Time
+			TOTPSecret    string
+			TOTPEnabled   bool
+			RecoveryCodes string
+		}
+		if err := tx.Table("feeds").AutoMigrate(&feed{}); err != nil {
+			return err
+		}
+		if err := tx.Table("items").AutoMigrate(&item{}); err != nil {
+			return err
+		}
+		if err := tx.Table("tags").AutoMigrate(&tag{}); err != nil {
+			return err
+		}
+		if err := tx.Table("users").AutoMigrate(&user{}); err != nil {
+			return err
+		}
+		if tx.Dialector.Name() == "postgres" {
+			return tx.Exec("CREATE INDEX IF NOT EXISTS idx_items_search ON items USING GIN (" + postgresSearchVector + ")").Error
+		}
+		return nil
+	}},
+	{2, "retention policies", func(tx *gorm.DB) error {
+		type feed struct {
+			RetentionMaxItems int `gorm:"not null;default:0"`
+			RetentionMaxDays  int `gorm:"not null;default:0"`
+		}
+		type item struct {
+			InFeed bool `gorm:"not null;default:false"`
+		}
+		if err := tx.Table("feeds").AutoMigrate(&feed{}); err != nil {
+			return err
+		}
+		return tx.Table("items").AutoMigrate(&item{})
+	}},
+	{3, "qualified search index", func(tx *gorm.DB) error {
+		if tx.Dialector.Name() != "postgres" {
+			return nil
+		}
+		// item queries join feeds, which also have title and description columns
+		if err := tx.Exec("DROP INDEX IF EXISTS idx_items_search").Error; err != nil {
+			return err
+		}
+		return tx.Exec("CREATE INDEX idx_items_search ON items USING GIN (" + postgresItemSearchVector + ")").Error
+	}},
+	{4, "indexes for feed and tag counts", func(tx *gorm.DB) error {
+		for _, stmt := range []string{
+			"CREATE INDEX IF NOT EXISTS idx_items_feed_read ON items (feed_id, read)",
+			"CREATE INDEX IF NOT EXISTS idx_items_pub_date ON items (pub_date)",
+			"CREATE INDEX IF NOT EXISTS idx_tags_name ON tags (name)",
+		} {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{5, "tag settings", func(tx *gorm.DB) error {
+		type tagSetting struct {
+			Name     string `gorm:"primaryKey"`
+			Position int    `gorm:"not null;default:0"`
+			Color    string `gorm:"not null;default:''"`
+		}
+		return tx.Table("tag_settings").AutoMigrate(&tagSetting{})
+	}},
+	{6, "folders", func(tx *gorm.DB) error {
+		type folder struct {
+			ID        string `gorm:"primaryKey"`
+			Name      string `gorm:"not null"`
+			ParentID  string `gorm:"not null;default:'';index"`
+			Position  int    `gorm:"not null;default:0"`
+			CreatedAt time.Time
+		}
+		type feed struct {
+			FolderID string `gorm:"not null;default:'';index"`
+		}
+		if err := tx.Table("folders").AutoMigrate(&folder{}); err != nil {
+			return err
+		}
+		return tx.Table("feeds").AutoMigrate(&feed{})
+	}},
+	{7, "item labels and notes", func(tx *gorm.DB) error {
+		type itemLabel struct {
+			ItemID string `gorm:"primaryKey"`
+			Name   string `gorm:"primaryKey;index"`
+		}
+		type item struct {
+			Note string `gorm:"not null;default:''"`
+		}
+		if err := tx.Table("item_labels").AutoMigrate(&itemLabel{}); err != nil {
+			return err
+		}
+		if err := tx.Table("items").AutoMigrate(&item{}); err != nil {
+			return err
+		}
+
+		// the unused items.tags column becomes labels, comma separated values if any
+		var rows []struct {
+			ID   string
+			Tags string
+		}
+		if err := tx.Table("items").Select("id, tags").Where("tags <> ''").Scan(&rows).Error; err != nil {
+			return err
+		}
+		var labels []itemLabel
+		for _, row := range rows {
+			for _, name := range strings.Split(row.Tags, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					labels = append(labels, itemLabel{ItemID: row.ID, Name: name})
+				}
+			}
+		}
+		if len(labels) > 0 {
+			err := tx.Table("item_labels").Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(labels, 500).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Exec("ALTER TABLE items DROP COLUMN tags").Error
+	}},
+	{8, "highlights", func(tx *gorm.DB) error {
+		type highlight struct {
+			ID        string `gorm:"primaryKey"`
+			ItemID    string `gorm:"not null;index"`
+			Quote     string `gorm:"not null"`
+			Prefix    string `gorm:"not null;default:''"`
+			Suffix    string `gorm:"not null;default:''"`
+			Start     int    `gorm:"not null;default:0"`
+			End       int    `gorm:"not null;default:0"`
+			Comment   string `gorm:"not null;default:''"`
+			Orphaned  bool   `gorm:"not null;default:false"`
+			CreatedAt time.Time
+			UpdatedAt time.Time
+		}
+		return tx.Table("highlights").AutoMigrate(&highlight{})
+	}},
+	{9, "rules and item authors", func(tx *gorm.DB) error {
+		type rule struct {
+			ID         string `gorm:"primaryKey"`
+			Name       string `gorm:"not null;default:''"`
+			Enabled    bool   `gorm:"not null;default:true"`
+			Position   int    `gorm:"not null;default:0"`
+			FeedIDs    string
+			Tags       string
+			Match      string `gorm:"not null;default:''"`
+			Conditions string
+			Actions    string
+			CreatedAt  time.Time
+			UpdatedAt  time.Time
+		}
+		type item struct {
+			Author string `gorm:"not null;default:''"`
+		}
+		if err := tx.Table("rules").AutoMigrate(&rule{}); err != nil {
+			return err
+		}
+		return tx.Table("items").AutoMigrate(&item{})
+	}},
+	{10, "smart feeds", func(tx *gorm.DB) error {
+		type smartFeed struct {
+			ID        string `gorm:"primaryKey"`
+			Name      string `gorm:"not null"`
+			Position  int    `gorm:"not null;default:0"`
+			FeedIDs   string
+			Tags      string
+			Labels    string
+			Query     string `gorm:"not null;default:''"`
+			Unread    bool   `gorm:"not null;default:false"`
+			Starred   bool   `gorm:"not null;default:false"`
+			Liked     bool   `gorm:"not null;default:false"`
+			Days      int    `gorm:"not null;default:0"`
+			Sort      string `gorm:"not null;default:''"`
+			CreatedAt time.Time
+			UpdatedAt time.Time
+		}
+		return tx.Table("smart_feeds").AutoMigrate(&smartFeed{})
+	}},
+	{11, "output feeds", func(tx *gorm.DB) error {
+		type outputFeed struct {
+			ID          string `gorm:"primaryKey"`
+			Name        string `gorm:"not null"`
+			Token       string `gorm:"not null;uniqueIndex:idx_output_feeds_token"`
+			SmartFeedID string `gorm:"not null;default:''"`
+			FeedIDs     string
+			Tags        string
+			Labels      string
+			Query       string `gorm:"not null;default:''"`
+			Starred     bool   `gorm:"not null;default:false"`
+			Liked       bool   `gorm:"not null;default:false"`
+			Days        int    `gorm:"not null;default:0"`
+			Limit       int    `gorm:"not null;default:0"`
+			CreatedAt   time.Time
+			UpdatedAt   time.Time
+		}
+		return tx.Table("output_feeds").AutoMigrate(&outputFeed{})
+	}},
+	{12, "item clusters", func(tx *gorm.DB) error {
+		type item struct {
+			CanonicalLink string `gorm:"not null;default:'';index:idx_items_canonical_link"`
+			SimHash       int64  `gorm:"not null;default:0"`
+			ClusterID     string `gorm:"not null;default:'';index:idx_items_cluster_id"`
+		}
+		if err := tx.Table("items").AutoMigrate(&item{}); err != nil {
+			return err
+		}
+		// existing items are clusters of their own, only new items are compared
+		return tx.Exec("UPDATE items SET cluster_id = id WHERE cluster_id = ''").Error
+	}},
+	{13, "enclosures and podcasts", func(tx *gorm.DB) error {
+		type enclosure struct {
+			ID           string `gorm:"primaryKey"`
+			ItemID       string `gorm:"not null;index:idx_enclosures_item_id"`
+			FeedID       string `gorm:"not null;index:idx_enclosures_feed_id"`
+			Position     int    `gorm:"not null;default:0"`
+			URL          string `gorm:"not null"`
+			Type         string `gorm:"not null;default:''"`
+			Length       int64  `gorm:"not null;default:0"`
+			Duration     int    `gorm:"not null;default:0"`
+			Path         string `gorm:"not null;default:''"`
+			Size         int64  `gorm:"not null;default:0"`
+			DownloadedAt *time.Time
+			CreatedAt    time.Time
+		}
+		type item struct {
+			Duration    int    `gorm:"not null;default:0"`
+			Episode     int    `gorm:"not null;default:0"`
+			Season      int    `gorm:"not null;default:0"`
+			EpisodeType string `gorm:"not null;default:''"`
+			Position    int    `gorm:"not null;default:0"`
+		}
+		type feed struct {
+			DownloadEnclosures bool `gorm:"not null;default:false"`
+			DownloadQuotaMB    int  `gorm:"column:download_quota_mb;not null;default:0"`
+		}
+		if err := tx.Table("enclosures").AutoMigrate(&enclosure{}); err != nil {
+			return err
+		}
+		if err := tx.Table("items").AutoMigrate(&item{}); err != nil {
+			return err
+		}
+		return tx.Table("feeds").AutoMigrate(&feed{})
+	}},
+	{14, "item authors and categories", func(tx *gorm.DB) error {
+		type itemAuthor struct {
+			ItemID   string `gorm:"primaryKey"`
+			Position int    `gorm:"primaryKey;autoIncrement:false"`
+			Name     string `gorm:"not null;index:idx_item_authors_name"`
+			Email    string `gorm:"not null;default:''"`
+		}
+		type itemCategory struct {
+			ItemID string `gorm:"primaryKey"`
+			Name   string `gorm:"primaryKey;index:idx_item_categories_name"`
+		}
+		type item struct {
+			UpdatedDate *time.Time
+		}
+		if err := tx.Table("item_authors").AutoMigrate(&itemAuthor{}); err != nil {
+			return err
+		}
+		if err := tx.Table("item_categories").AutoMigrate(&itemCategory{}); err != nil {
+			return err
+		}
+		if err := tx.Table("items").AutoMigrate(&item{}); err != nil {
+			return err
+		}
+		// the single author stored so far becomes the first one
+		return tx.Exec("INSERT INTO item_authors (item_id, position, name, email) " +
+			"SELECT id, 0, author, '' FROM items WHERE author <> ''").Error
+	}},
+	{15, "feed metadata", func(tx *gorm.DB) error {
+		type feed struct {
+			CustomTitle   string `gorm:"not null;default:''"`
+			UpstreamTitle string `gorm:"not null;default:''"`
+			SiteURL       string `gorm:"column:site_url;not null;default:''"`
+			Description   string `gorm:"not null;default:''"`
+			Image         string `gorm:"not null;default:''"`
+			Language      string `gorm:"not null;default:''"`
+			Generator     string `gorm:"not null;default:''"`
+			Copyright     string `gorm:"not null;default:''"`
+			IconPath      string `gorm:"not null;default:''"`
+			IconType      string `gorm:"not null;default:''"`
+			IconUpdatedAt *time.Time
+			IconCheckedAt *time.Time
+		}
+		if err := tx.Table("feeds").AutoMigrate(&feed{}); err != nil {
+			return err
+		}
+		// titles so far all came from upstream
+		return tx.Exec("UPDATE feeds SET upstream_title = title").Error
+	}},
+	{16, "item times in utc", func(tx *gorm.DB) error {
+		if tx.Dialector.Name() != "sqlite" {
+			return nil // postgres compares timestamps, not their text
+		}
+		type item struct {
+			ID          string
+			CreatedAt   time.Time
+			PubDate     *time.Time
+			UpdatedDate *time.Time
+		}
+		utc := func(t *time.Time) *time.Time {
+			if t == nil {
+				return nil
+			}
+			return lo.ToPtr(t.UTC())
+		}
+		var items []item
+		return tx.Table("items").Select("id", "created_at", "pub_date", "updated_date").
+			Where("created_at NOT LIKE '%+00:00' OR pub_date NOT LIKE '%+00:00' OR updated_date NOT LIKE '%+00:00'").
+			FindInBatches(&items, 500, func(tx *gorm.DB, _ int) error {
+				for _, it := range items {
+					err := tx.Table("items").Where("id = ?", it.ID).UpdateColumns(map[string]any{
+						"created_at":   it.CreatedAt.UTC(),
+						"pub_date":     utc(it.PubDate),
+						"updated_date": utc(it.UpdatedDate),
+					}).Error
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}).Error
+	}},
+}
+
+type SchemaVersion struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (v *SchemaVersion) TableName() string { return "schema_version" }
+
+// latestSchemaVersion is the schema version this build of nexa expects.
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 for a fresh database.
+func (s *gormDB) SchemaVersion(ctx context.Context) (int, error) {
+	db := s.db.WithContext(ctx)
+	if !db.Migrator().HasTable(&SchemaVersion{}) {
+		return 0, nil
+	}
+	var version int
+	err := db.Model(&SchemaVersion{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// PendingMigrations returns the migrations not applied yet.
+func (s *gormDB) PendingMigrations(ctx context.Context) ([]migration, error) {
+	version, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version > latestSchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than supported version %d", version, latestSchemaVersion())
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// migrate applies the pending migrations in order, backup is called first
+// when there is something to migrate in a database that already holds data.
+func (s *gormDB) migrate(ctx context.Context, backup func(ctx context.Context, version int) error) error {
+	version, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get schema version error")
+	}
+	pending, err := s.PendingMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if backup != nil && s.db.Migrator().HasTable("feeds") {
+		if err := backup(ctx, version); err != nil {
+			return errors.Wrap(err, "backup before migration error")
+		}
+	}
+
+	db := s.db.WithContext(ctx)
+	if err := db.AutoMigrate(&SchemaVersion{}); err != nil {
+		return errors.Wrap(err, "create schema_version error")
+	}
+	for _, m := range pending {
+		logrus.Infof("migrate schema to version %d: %s", m.Version, m.Name)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaVersion{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return errors.Wrapf(err, "migration %d (%s) error", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+// migrateCommand implements `nexa migrate status|up`.
+func migrateCommand(action string) error {
+	ctx := context.Background()
+	db, err := dialDB()
+	if err != nil {
+		return errors.Wrap(err, "open db error")
+	}
+
+	switch action {
+	case "status":
+		version, err := db.SchemaVersion(ctx)
+		if err != nil {
+			return err
+		}
+		pending, err := db.PendingMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("schema version: %d (latest %d)\n", version, latestSchemaVersion())
+		for _, m := range pending {
+			fmt.Printf("pending: %d %s\n", m.Version, m.Name)
+		}
+		return nil
+	case "up":
+		if err := db.Migrate(ctx); err != nil {
+			return err
+		}
+		fmt.Printf("schema is up to date (version %d)\n", latestSchemaVersion())
+		return nil
+	default:
+		return errors.New(usage)
+	}
+}
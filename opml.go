@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+)
+
+// OPML outlines with an xmlUrl are feeds, the others are folders nesting their children.
+type opmlDocument struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    struct {
+		Title       string `xml:"title,omitempty"`
+		DateCreated string `xml:"dateCreated,omitempty"`
+	} `xml:"head"`
+	Body struct {
+		Outlines []*opmlOutline `xml:"outline"`
+	} `xml:"body"`
+}
+
+type opmlOutline struct {
+	Text     string         `xml:"text,attr"`
+	Title    string         `xml:"title,attr,omitempty"`
+	Type     string         `xml:"type,attr,omitempty"`
+	XMLURL   string         `xml:"xmlUrl,attr,omitempty"`
+	HTMLURL  string         `xml:"htmlUrl,attr,omitempty"`
+	Category string         `xml:"category,attr,omitempty"` // comma separated tags
+	Outlines []*opmlOutline `xml:"outline"`
+}
+
+// exportOPML writes the folders as nested outlines containing their feeds.
+func (svc *Service) exportOPML(ctx context.Context, w io.Writer) error {
+	folders, err := svc.db.ListFolders(ctx)
+	if err != nil {
+		return errors.Wrap(err, "list folders error")
+	}
+	feeds, err := svc.db.FilterFeeds(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "list feeds error")
+	}
+
+	known := lo.SliceToMap(folders, func(folder *Folder) (string, bool) { return folder.ID, true })
+	feedsByFolder := lo.GroupBy(feeds, func(feed *ListFeedResult) string {
+		return lo.Ternary(known[feed.FolderID], feed.FolderID, "")
+	})
+	var outlines func(folders []*ListFolderResult, folderID string) []*opmlOutline
+	outlines = func(folders []*ListFolderResult, folderID string) []*opmlOutline {
+		result := []*opmlOutline{}
+		for _, folder := range folders {
+			result = append(result, &opmlOutline{Text: folder.Name, Title: folder.Name, Outlines: outlines(folder.Children, folder.ID)})
+		}
+		for _, feed := range feedsByFolder[folderID] {
+			title := lo.CoalesceOrEmpty(feed.Title, feed.Link)
+			result = append(result, &opmlOutline{
+				Text:     title,
+				Title:    title,
+				Type:     "rss",
+				XMLURL:   feed.Link,
+				HTMLURL:  feed.SiteURL,
+				Category: strings.Join(feed.Tags, ","),
+			})
+		}
+		return result
+	}
+
+	doc := &opmlDocument{Version: "2.0"}
+	doc.Head.Title = "nexa subscriptions"
+	doc.Head.DateCreated = time.Now().UTC().Format(time.RFC1123Z)
+	doc.Body.Outlines = outlines(folderTree(folders, feeds), "")
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(doc)
+}
+
+// checkOutlines rejects feeds which are not served over http or https, like file: urls.
+func checkOutlines(outlines []*opmlOutline) error {
+	for _, outline := range outlines {
+		if outline.XMLURL == "" {
+			if err := checkOutlines(outline.Outlines); err != nil {
+				return err
+			}
+		} else if u, err := url.Parse(outline.XMLURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid feed url schema: %s", outline.XMLURL)
+		}
+	}
+	return nil
+}
+
+// importOPML subscribes to the feeds of the document, outlines without xmlUrl become folders.
+// Feeds already subscribed are matched by link, get the tags of the outline and,
+// when they are not in a folder yet, are moved to the folder of the outline.
+func (svc *Service) importOPML(ctx context.Context, r io.Reader) (*ImportResult, error) {
+	doc := new(opmlDocument)
+	if err := xml.NewDecoder(r).Decode(doc); err != nil {
+		return nil, errors.Wrap(err, "invalid opml")
+	}
+	// checked up front, so that nothing is imported from a rejected document
+	if err := checkOutlines(doc.Body.Outlines); err != nil {
+		return nil, err
+	}
+
+	index, err := newFolderIndex(ctx, svc.db)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := svc.db.FilterFeeds(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "list feeds error")
+	}
+	feedsByLink := lo.SliceToMap(existing, func(feed *ListFeedResult) (string, *Feed) { return feed.Link, feed.Feed })
+
+	result := new(ImportResult)
+	var walk func(outlines []*opmlOutline, folderID string) error
+	walk = func(outlines []*opmlOutline, folderID string) error {
+		for _, outline := range outlines {
+			if outline.XMLURL == "" {
+				name := strings.TrimSpace(lo.CoalesceOrEmpty(outline.Text, outline.Title))
+				if name == "" {
+					// an unnamed group, keep its feeds in the current folder
+					if err := walk(outline.Outlines, folderID); err != nil {
+						return err
+					}
+					continue
+				}
+				folder, err := index.ensure(ctx, folderID, name)
+				if err != nil {
+					return errors.Wrapf(err, "create folder %s error", name)
+				}
+				if err := walk(outline.Outlines, folder.ID); err != nil {
+					return err
+				}
+				continue
+			}
+
+			feed := &Feed{
+				Title:    lo.CoalesceOrEmpty(outline.Title, outline.Text),
+				Link:     outline.XMLURL,
+				SiteURL:  outline.HTMLURL,
+				FolderID: folderID,
+				Tags: lo.Compact(lo.Map(strings.Split(outline.Category, ","), func(tag string, _ int) string {
+					return strings.Trim(strings.TrimSpace(tag), "/")
+				})),
+			}
+			found := feedsByLink[feed.Link]
+			local, err := svc.importFeed(ctx, feed, found)
+			if err != nil {
+				return errors.Wrapf(err, "import feed %s error", feed.Link)
+			}
+			if found != nil {
+				result.FeedsMerged++
+			} else {
+				result.FeedsCreated++
+			}
+			feedsByLink[local.Link] = local
+		}
+		return nil
+	}
+	if err := walk(doc.Body.Outlines, ""); err != nil {
+		return nil, err
+	}
+	result.FoldersCreated = index.created
+	return result, nil
+}
+
+// ExportOPML 导出 OPML 订阅列表，文件夹导出为嵌套的 outline
+func (svc *Service) ExportOPML(c *gin.Context) {
+	filename := fmt.Sprintf("nexa-%s.opml", time.Now().Format("20060102"))
+	c.Header("Content-Type", "text/x-opml; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if err := svc.exportOPML(c.Request.Context(), c.Writer); err != nil {
+		logrus.WithError(err).Error("export opml error")
+	}
+}
+
+// ImportOPML 导入 OPML 订阅列表，嵌套的 outline 导入为文件夹
+func (svc *Service) ImportOPML(c *gin.Context) {
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(400, gin.H{"error": "opml file required"})
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	result, err := svc.importOPML(c.Request.Context(), f)
+	if err != nil {
+		logrus.WithError(err).Warn("import opml error")
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"result": result})
+}
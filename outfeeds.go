@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	outputFeedLimit    = 50  // items published when the output feed sets no limit
+	outputFeedMaxLimit = 500 // most items an output feed can publish
+	outputFeedMaxAge   = 5 * time.Minute
+)
+
+var outputContentTypes = map[string]string{
+	".rss":  "application/rss+xml; charset=utf-8",
+	".atom": "application/atom+xml; charset=utf-8",
+	".json": "application/feed+json; charset=utf-8",
+}
+
+// newOutputToken returns a random token, output feeds are readable by anyone knowing it.
+func newOutputToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// outputFilter resolves the output feed to the filter of its items.
+func (svc *Service) outputFilter(ctx context.Context, out *OutputFeed, now time.Time) (*ItemFilter, error) {
+	filter := new(ItemFilter)
+	if out.SmartFeedID != "" {
+		smartFeed, err := svc.db.GetSmartFeed(ctx, out.SmartFeedID)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get smart feed %s error", out.SmartFeedID)
+		}
+		if filter, err = smartFeed.Filter(now); err != nil {
+			return nil, err
+		}
+	}
+	filter.FeedIDs = append(filter.FeedIDs, out.FeedIDs...)
+	filter.Tags = append(filter.Tags, out.Tags...)
+	filter.Labels = append(filter.Labels, out.Labels...)
+	if out.Starred {
+		filter.Starred = lo.ToPtr(true)
+	}
+	if out.Liked {
+		filter.Liked = lo.ToPtr(true)
+	}
+	if out.Days > 0 {
+		since := now.AddDate(0, 0, -out.Days).UTC()
+		if filter.PubDate == nil || since.After(*filter.PubDate) {
+			filter.PubDate = &since
+		}
+	}
+	if err := ParseQuery(out.Query, filter, now); err != nil {
+		return nil, err
+	}
+	filter.Limit = lo.ToPtr(lo.Ternary(out.Limit > 0, min(out.Limit, outputFeedMaxLimit), outputFeedLimit))
+	filter.Offset = nil
+	filter.Cursor = nil
+	return filter, nil
+}
+
+type rssDocument struct {
+	XMLName xml.Name `xml:"rss"`
+	Version string   `xml:"version,attr"`
+	Atom    string   `xml:"xmlns:atom,attr"`
+	DC      string   `xml:"xmlns:dc,attr"`
+	Channel struct {
+		Title         string `xml:"title"`
+		Link          string `xml:"link"`
+		Description   string `xml:"description"`
+		LastBuildDate string `xml:"lastBuildDate,omitempty"`
+		Self          struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"atom:link"`
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link,omitempty"`
+	Description string   `xml:"description"`
+	Author      string   `xml:"dc:creator,omitempty"`
+	Categories  []string `xml:"category"`
+	Enclosure   *struct {
+		URL    string `xml:"url,attr"`
+		Length int64  `xml:"length,attr"`
+		Type   string `xml:"type,attr"`
+	} `xml:"enclosure"`
+	GUID struct {
+		Value       string `xml:",chardata"`
+		IsPermaLink bool   `xml:"isPermaLink,attr"`
+	} `xml:"guid"`
+	PubDate string `xml:"pubDate,omitempty"`
+}
+
+type atomDocument struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href   string `xml:"href,attr"`
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published,omitempty"`
+	Links     []atomLink `xml:"link"`
+	Author    *struct {
+		Name string `xml:"name"`
+	} `xml:"author,omitempty"`
+	Categories []struct {
+		Term string `xml:"term,attr"`
+	} `xml:"category"`
+	Content struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"content"`
+}
+
+// https://www.jsonfeed.org/version/1.1/
+type jsonFeedDocument struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	FeedURL     string         `json:"feed_url"`
+	Description string         `json:"description,omitempty"`
+	Items       []jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string `json:"id"`
+	URL           string `json:"url,omitempty"`
+	Title         string `json:"title"`
+	ContentHTML   string `json:"content_html"`
+	DatePublished string `json:"date_published,omitempty"`
+	Authors       []struct {
+		Name string `json:"name"`
+	} `json:"authors,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Attachments []struct {
+		URL               string `json:"url"`
+		MimeType          string `json:"mime_type"`
+		SizeInBytes       int64  `json:"size_in_bytes,omitempty"`
+		DurationInSeconds int    `json:"duration_in_seconds,omitempty"`
+	} `json:"attachments,omitempty"`
+}
+
+// renderOutputFeed writes the items in the format of ext, selfURL is where the feed is served.
+func renderOutputFeed(out *OutputFeed, items []*Item, ext, selfURL string, updated time.Time) ([]byte, error) {
+	title := lo.CoalesceOrEmpty(out.Name, "nexa")
+	description := "Items republished by nexa"
+	content := func(item *Item) string { return lo.CoalesceOrEmpty(item.Content, item.Description) }
+
+	buf := new(bytes.Buffer)
+	switch ext {
+	case ".rss":
+		doc := &rssDocument{Version: "2.0", Atom: "http://www.w3.org/2005/Atom", DC: "http://purl.org/dc/elements/1.1/"}
+		doc.Channel.Title = title
+		doc.Channel.Link = selfURL
+		doc.Channel.Description = description
+		doc.Channel.LastBuildDate = updated.Format(time.RFC1123Z)
+		doc.Channel.Self.Href, doc.Channel.Self.Rel, doc.Channel.Self.Type = selfURL, "self", "application/rss+xml"
+		for _, item := range items {
+			entry := rssItem{
+				Title:       item.Title,
+				Link:        shareLink(item),
+				Description: content(item),
+				Author:      item.Author,
+				Categories:  item.Labels,
+			}
+			// RSS allows a single enclosure per item, upstream urls are used as stream urls expire
+			if len(item.Enclosures) > 0 {
+				enclosure := item.Enclosures[0]
+				entry.Enclosure = &struct {
+					URL    string `xml:"url,attr"`
+					Length int64  `xml:"length,attr"`
+					Type   string `xml:"type,attr"`
+				}{URL: enclosure.URL, Length: enclosure.Length, Type: lo.CoalesceOrEmpty(enclosure.Type, "application/octet-stream")}
+			}
+			entry.GUID.Value = "urn:nexa:item:" + item.ID
+			entry.PubDate = itemSortTime(item).Format(time.RFC1123Z)
+			doc.Channel.Items = append(doc.Channel.Items, entry)
+		}
+		buf.WriteString(xml.Header)
+		if err := xml.NewEncoder(buf).Encode(doc); err != nil {
+			return nil, err
+		}
+	case ".atom":
+		doc := &atomDocument{
+			ID:      "urn:nexa:output:" + out.ID,
+			Title:   title,
+			Updated: updated.Format(time.RFC3339),
+			Links:   []atomLink{{Href: selfURL, Rel: "self", Type: "application/atom+xml"}},
+		}
+		for _, item := range items {
+			entry := atomEntry{
+				ID:        "urn:nexa:item:" + item.ID,
+				Title:     item.Title,
+				Updated:   itemSortTime(item).Format(time.RFC3339),
+				Published: itemSortTime(item).Format(time.RFC3339),
+			}
+			if link := shareLink(item); link != "" {
+				entry.Links = []atomLink{{Href: link, Rel: "alternate"}}
+			}
+			for _, enclosure := range item.Enclosures {
+				entry.Links = append(entry.Links, atomLink{Href: enclosure.URL, Rel: "enclosure", Type: enclosure.Type, Length: enclosure.Length})
+			}
+			if item.Author != "" {
+				entry.Author = &struct {
+					Name string `xml:"name"`
+				}{Name: item.Author}
+			}
+			for _, label := range item.Labels {
+				entry.Categories = append(entry.Categories, struct {
+					Term string `xml:"term,attr"`
+				}{Term: label})
+			}
+			entry.Content.Type, entry.Content.Value = "html", content(item)
+			doc.Entries = append(doc.Entries, entry)
+		}
+		buf.WriteString(xml.Header)
+		if err := xml.NewEncoder(buf).Encode(doc); err != nil {
+			return nil, err
+		}
+	case ".json":
+		doc := &jsonFeedDocument{
+			Version:     "https://jsonfeed.org/version/1.1",
+			Title:       title,
+			FeedURL:     selfURL,
+			Description: description,
+			Items:       []jsonFeedItem{},
+		}
+		for _, item := range items {
+			entry := jsonFeedItem{
+				ID:            "urn:nexa:item:" + item.ID,
+				URL:           shareLink(item),
+				Title:         item.Title,
+				ContentHTML:   content(item),
+				DatePublished: itemSortTime(item).Format(time.RFC3339),
+				Tags:          item.Labels,
+			}
+			if item.Author != "" {
+				entry.Authors = append(entry.Authors, struct {
+					Name string `json:"name"`
+				}{Name: item.Author})
+			}
+			for _, enclosure := range item.Enclosures {
+				entry.Attachments = append(entry.Attachments, struct {
+					URL               string `json:"url"`
+					MimeType          string `json:"mime_type"`
+					SizeInBytes       int64  `json:"size_in_bytes,omitempty"`
+					DurationInSeconds int    `json:"duration_in_seconds,omitempty"`
+				}{enclosure.URL, lo.CoalesceOrEmpty(enclosure.Type, "application/octet-stream"), enclosure.Length, lo.CoalesceOrEmpty(enclosure.Duration, item.Duration)})
+			}
+			doc.Items = append(doc.Items, entry)
+		}
+		if err := json.NewEncoder(buf).Encode(doc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", ext)
+	}
+	return buf.Bytes(), nil
+}
+
+// shareLink is the link of the item given to others, without tracking parameters when known.
+func shareLink(item *Item) string {
+	return lo.CoalesceOrEmpty(item.CanonicalLink, item.Link)
+}
+
+// requestURL is the absolute url of the request, behind a trusted proxy as seen by the client.
+// Forwarded headers of other clients are ignored, they would end up in cached feeds.
+func requestURL(c *gin.Context) string {
+	scheme := lo.Ternary(c.Request.TLS != nil, "https", "http")
+	host := c.Request.Host
+	if isTrustedProxy(c.Request) {
+		if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+			scheme = proto
+		}
+		host = lo.CoalesceOrEmpty(c.GetHeader("X-Forwarded-Host"), host)
+	}
+	return scheme + "://" + host + c.Request.URL.Path
+}
+
+// notModified reports whether the client copy is fresh, If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		return lo.SomeBy(strings.Split(match, ","), func(tag string) bool {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			return tag == etag || tag == "*"
+		})
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !lastModified.Truncate(time.Second).After(since)
+}
+
+// ServeOutputFeed 以 RSS/Atom/JSON Feed 发布输出订阅，使用 token 而不是 JWT 鉴权
+func (svc *Service) ServeOutputFeed(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	file := c.Param("file")
+	ext := path.Ext(file)
+	contentType, ok := outputContentTypes[ext]
+	if !ok {
+		c.JSON(404, gin.H{"error": "output feed not found"})
+		return
+	}
+	out, err := svc.db.FindOutputFeed(ctx, strings.TrimSuffix(file, ext))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "output feed not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	filter, err := svc.outputFilter(ctx, out, now)
+	if err != nil {
+		logrus.WithError(err).WithField("output_feed_id", out.ID).Error("resolve output feed error")
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	items, err := svc.db.FilterItems(ctx, filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	lastModified := out.UpdatedAt
+	for _, item := range items {
+		if t := itemSortTime(item); t.After(lastModified) {
+			lastModified = t
+		}
+	}
+	lastModified = lastModified.UTC()
+	body, err := renderOutputFeed(out, items, ext, requestURL(c), lastModified)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	// the etag follows the content, it also changes when an older item enters or leaves the filter
+	etag := `"` + Hash(string(body))[:32] + `"`
+
+	c.Header("ETag", etag)
+	c.Header("Last-Modified", lastModified.Format(http.TimeFormat))
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(outputFeedMaxAge.Seconds())))
+	if notModified(c.Request, etag, lastModified) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(200, contentType, body)
+}
+
+type outputFeedRequest struct {
+	Name        string   `json:"name"`
+	SmartFeedID string   `json:"smart_feed_id"`
+	FeedIDs     []string `json:"feed_ids"`
+	Tags        []string `json:"tags"`
+	Labels      []string `json:"labels"`
+	Query       string   `json:"query"`
+	Starred     bool     `json:"starred"`
+	Liked       bool     `json:"liked"`
+	Days        int      `json:"days"`
+	Limit       int      `json:"limit"`
+}
+
+// bindOutputFeed reads the output feed of the request into out, it responds 400 when invalid.
+func (svc *Service) bindOutputFeed(c *gin.Context, out *OutputFeed) bool {
+	req := new(outputFeedRequest)
+	if err := c.BindJSON(req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return false
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		c.JSON(400, gin.H{"error": "name required"})
+		return false
+	}
+	if req.Days < 0 || req.Limit < 0 || req.Limit > outputFeedMaxLimit {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("days must not be negative and limit must be between 0 and %d", outputFeedMaxLimit)})
+		return false
+	}
+	if err := ParseQuery(req.Query, new(ItemFilter), time.Now()); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return false
+	}
+	if req.SmartFeedID != "" {
+		if _, err := svc.db.GetSmartFeed(c.Request.Context(), req.SmartFeedID); errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(400, gin.H{"error": "smart feed not found"})
+			return false
+		} else if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return false
+		}
+	}
+
+	out.Name = strings.TrimSpace(req.Name)
+	out.SmartFeedID = req.SmartFeedID
+	out.FeedIDs = req.FeedIDs
+	out.Tags = req.Tags
+	out.Labels = req.Labels
+	out.Query = req.Query
+	out.Starred = req.Starred
+	out.Liked = req.Liked
+	out.Days = req.Days
+	out.Limit = req.Limit
+	return true
+}
+
+// ListOutputFeeds 列出输出订阅及其 token
+func (svc *Service) ListOutputFeeds(c *gin.Context) {
+	outputFeeds, err := svc.db.ListOutputFeeds(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"output_feeds": outputFeeds})
+}
+
+// AddOutputFeed 创建输出订阅，生成随机 token
+func (svc *Service) AddOutputFeed(c *gin.Context) {
+	token, err := newOutputToken()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	out := &OutputFeed{ID: Hash(fmt.Sprintf("output@%d", time.Now().UnixNano()))[:16], Token: token}
+	if !svc.bindOutputFeed(c, out) {
+		return
+	}
+	if err := svc.db.SaveOutputFeed(c.Request.Context(), out); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"output_feed": out})
+}
+
+// UpdateOutputFeed 修改输出订阅，token 不变
+func (svc *Service) UpdateOutputFeed(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	out, err := svc.db.GetOutputFeed(ctx, c.Param("output_feed_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "output feed not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !svc.bindOutputFeed(c, out) {
+		return
+	}
+	if err := svc.db.SaveOutputFeed(ctx, out); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"output_feed": out})
+}
+
+// RotateOutputFeedToken 重新生成输出订阅的 token，旧地址失效
+func (svc *Service) RotateOutputFeedToken(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	out, err := svc.db.GetOutputFeed(ctx, c.Param("output_feed_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "output feed not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if out.Token, err = newOutputToken(); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if err := svc.db.SaveOutputFeed(ctx, out); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"output_feed": out})
+}
+
+// DeleteOutputFeed 删除输出订阅
+func (svc *Service) DeleteOutputFeed(c *gin.Context) {
+	err := svc.db.DeleteOutputFeed(c.Request.Context(), c.Param("output_feed_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "output feed not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mmcdole/gofeed"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var downloadConfig struct {
+	Dir     string // local copies of enclosures, one directory per feed
+	QuotaMB int    // default quota of each feed
+}
+
+func init() {
+	downloadConfig.Dir = os.Getenv("NEXA_DOWNLOAD_DIR")
+	if downloadConfig.Dir == "" {
+		downloadConfig.Dir = "data/enclosures"
+	}
+	downloadConfig.QuotaMB, _ = strconv.Atoi(os.Getenv("NEXA_DOWNLOAD_QUOTA_MB"))
+	if downloadConfig.QuotaMB <= 0 {
+		downloadConfig.QuotaMB = 1024
+	}
+}
+
+const (
+	streamURLLifetime = 24 * time.Hour
+	downloadTimeout   = 30 * time.Minute
+)
+
+// downloadMu serializes the bookkeeping of downloads, so that quotas are enforced on a consistent state.
+// Transfers run outside of it.
+var downloadMu sync.Mutex
+
+// downloading holds the ids of the enclosures being downloaded on request.
+var downloading sync.Map
+
+// parseEnclosures returns the RSS enclosures and media RSS contents of the item, without duplicates.
+func parseEnclosures(item *Item, raw *gofeed.Item) []*Enclosure {
+	var enclosures []*Enclosure
+	add := func(link, mimeType, length, duration string) {
+		if link == "" || lo.ContainsBy(enclosures, func(e *Enclosure) bool { return e.URL == link }) {
+			return
+		}
+		size, _ := strconv.ParseInt(length, 10, 64)
+		seconds, _ := strconv.ParseFloat(duration, 64)
+		enclosures = append(enclosures, &Enclosure{
+			ID:       enclosureID(item.ID, link),
+			ItemID:   item.ID,
+			FeedID:   item.FeedID,
+			Position: len(enclosures),
+			URL:      link,
+			Type:     mimeType,
+			Length:   max(size, 0),
+			Duration: int(seconds),
+		})
+	}
+
+	for _, enclosure := range raw.Enclosures {
+		add(enclosure.URL, enclosure.Type, enclosure.Length, "")
+	}
+	media := raw.Extensions["media"]
+	contents := media["content"]
+	for _, group := range media["group"] {
+		contents = append(contents, group.Children["content"]...)
+	}
+	for _, content := range contents {
+		add(content.Attrs["url"], content.Attrs["type"], content.Attrs["fileSize"], content.Attrs["duration"])
+	}
+	if item.Image == "" {
+		if thumbnails := media["thumbnail"]; len(thumbnails) > 0 {
+			item.Image = thumbnails[0].Attrs["url"]
+		}
+	}
+	return enclosures
+}
+
+// enclosureID returns the id of the enclosure of the item at link.
+func enclosureID(itemID, link string) string {
+	return Hash(itemID + ":" + link)
+}
+
+// parsePodcast sets the podcast metadata of the iTunes extension on the item.
+func parsePodcast(item *Item, raw *gofeed.Item) {
+	itunes := raw.ITunesExt
+	if itunes == nil {
+		return
+	}
+	item.Duration = parseDuration(itunes.Duration)
+	item.Episode, _ = strconv.Atoi(strings.TrimSpace(itunes.Episode))
+	item.Season, _ = strconv.Atoi(strings.TrimSpace(itunes.Season))
+	item.EpisodeType = strings.ToLower(strings.TrimSpace(itunes.EpisodeType))
+	if item.Image == "" {
+		item.Image = itunes.Image
+	}
+}
+
+// parseDuration parses an iTunes duration, seconds or [HH:]MM:SS, 0 when invalid.
+func parseDuration(s string) int {
+	seconds := 0
+	for _, part := range strings.Split(strings.TrimSpace(s), ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0
+		}
+		seconds = seconds*60 + int(n)
+	}
+	return seconds
+}
+
+// streamSignature signs the stream url of the enclosure until expires.
+func streamSignature(enclosureID string, expires int64) string {
+	mac := hmac.New(sha256.New, authConfig.JwtSecret)
+	fmt.Fprintf(mac, "stream:%s:%d", enclosureID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signEnclosures sets the stream urls of the enclosures of the items, players can not send
+// the authorization header so the urls are signed. They are valid for a day or more.
+func signEnclosures(items ...*Item) {
+	expires := time.Now().Add(streamURLLifetime).Truncate(time.Hour).Add(time.Hour).Unix()
+	for _, item := range items {
+		for _, enclosure := range item.Enclosures {
+			enclosure.StreamURL = fmt.Sprintf("/media/%s?expires=%d&signature=%s",
+				enclosure.ID, expires, streamSignature(enclosure.ID, expires))
+		}
+	}
+}
+
+// downloadQuota returns the quota of the feed in bytes.
+func downloadQuota(feed *Feed) int64 {
+	return int64(lo.Ternary(feed.DownloadQuotaMB > 0, feed.DownloadQuotaMB, downloadConfig.QuotaMB)) << 20
+}
+
+// downloadPath returns where the enclosure is stored, the extension comes from the url or the type.
+func downloadPath(enclosure *Enclosure) string {
+	ext := ""
+	if u, err := url.Parse(enclosure.URL); err == nil {
+		ext = path.Ext(u.Path)
+	}
+	if len(ext) < 2 || len(ext) > 6 {
+		ext = ""
+		if exts, _ := mime.ExtensionsByType(enclosure.Type); len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return filepath.Join(downloadConfig.Dir, enclosure.FeedID, enclosure.ID+ext)
+}
+
+// streamClient has no overall timeout, episodes take longer to stream than to fetch feeds.
+var streamClient = &http.Client{}
+
+// downloadEnclosure stores a local copy of the enclosure, at most quota bytes.
+func (svc *Service) downloadEnclosure(ctx context.Context, enclosure *Enclosure, quota int64) error {
+	if enclosure.Length > quota {
+		return fmt.Errorf("enclosure of %d bytes exceeds the quota of %d bytes", enclosure.Length, quota)
+	}
+	ctx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, enclosure.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "nexa/1.0")
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+
+	dst := downloadPath(enclosure)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, io.LimitReader(resp.Body, quota+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size > quota {
+		return fmt.Errorf("enclosure exceeds the quota of %d bytes", quota)
+	}
+
+	downloadMu.Lock()
+	defer downloadMu.Unlock()
+	// the item may have been deleted during the transfer
+	if _, err := svc.db.GetEnclosure(ctx, enclosure.ID); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+
+	enclosure.Path, enclosure.Size, enclosure.DownloadedAt = dst, size, lo.ToPtr(time.Now())
+	if enclosure.Type == "" {
+		enclosure.Type = resp.Header.Get("Content-Type")
+	}
+	return svc.db.SaveEnclosure(ctx, enclosure)
+}
+
+// removeDownload deletes the local copy of the enclosure.
+func (svc *Service) removeDownload(ctx context.Context, enclosure *Enclosure) error {
+	if err := os.Remove(enclosure.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	enclosure.Path, enclosure.Size, enclosure.DownloadedAt = "", 0, nil
+	return svc.db.SaveEnclosure(ctx, enclosure)
+}
+
+// enforceQuota removes the downloads of the oldest items of the feed until the feed fits its quota.
+func (svc *Service) enforceQuota(ctx context.Context, feed *Feed) error {
+	downloadMu.Lock()
+	defer downloadMu.Unlock()
+
+	downloads, err := svc.db.FilterEnclosures(ctx, &EnclosureFilter{FeedIDs: []string{feed.ID}, Downloaded: lo.ToPtr(true)})
+	if err != nil {
+		return err
+	}
+	used := lo.SumBy(downloads, func(enclosure *Enclosure) int64 { return enclosure.Size })
+	for _, enclosure := range downloads {
+		if used <= downloadQuota(feed) {
+			break
+		}
+		used -= enclosure.Size
+		if err := svc.removeDownload(ctx, enclosure); err != nil {
+			return errors.Wrapf(err, "remove download %s error", enclosure.ID)
+		}
+	}
+	return nil
+}
+
+// downloadNewEnclosures downloads the enclosures of new items of the feed, newest first,
+// as long as they fit in the quota, then removes the older downloads beyond the quota.
+func (svc *Service) downloadNewEnclosures(ctx context.Context, feed *Feed, items []*Item) {
+	log := logrus.WithField("feed_id", feed.ID)
+	items = slices.Clone(items)
+	slices.SortFunc(items, func(x, y *Item) int { return itemSortTime(y).Compare(itemSortTime(x)) })
+	quota, used := downloadQuota(feed), int64(0)
+	for _, item := range items {
+		for _, enclosure := range item.Enclosures {
+			if used+enclosure.Length > quota {
+				log.Infof("download quota of %d MB reached", quota>>20)
+				goto enforce
+			}
+			if err := svc.downloadEnclosure(ctx, enclosure, quota-used); err != nil {
+				log.WithError(err).Warnf("download enclosure %s error", enclosure.URL)
+				continue
+			}
+			used += enclosure.Size
+		}
+	}
+enforce:
+	if err := svc.enforceQuota(ctx, feed); err != nil {
+		log.WithError(err).Error("enforce download quota error")
+	}
+}
+
+// queueDownload downloads the enclosure in the background, then removes the oldest downloads
+// of the feed beyond its quota. Enclosures already being downloaded are left alone.
+func (svc *Service) queueDownload(enclosure *Enclosure, feed *Feed) {
+	if _, busy := downloading.LoadOrStore(enclosure.ID, true); busy {
+		return
+	}
+	go func() {
+		defer downloading.Delete(enclosure.ID)
+		ctx := context.Background()
+		log := logrus.WithField("enclosure_id", enclosure.ID)
+		if err := svc.downloadEnclosure(ctx, enclosure, downloadQuota(feed)); err != nil {
+			log.WithError(err).Warnf("download enclosure %s error", enclosure.URL)
+			return
+		}
+		if err := svc.enforceQuota(ctx, feed); err != nil {
+			log.WithError(err).Error("enforce download quota error")
+		}
+	}()
+}
+
+// pruneDownloads deletes the local files of enclosures which are no longer stored,
+// after their items or feeds were deleted.
+func (svc *Service) pruneDownloads(ctx context.Context) error {
+	downloadMu.Lock()
+	defer downloadMu.Unlock()
+
+	downloads, err := svc.db.FilterEnclosures(ctx, &EnclosureFilter{Downloaded: lo.ToPtr(true)})
+	if err != nil {
+		return err
+	}
+	kept := lo.SliceToMap(downloads, func(enclosure *Enclosure) (string, bool) { return filepath.Clean(enclosure.Path), true })
+	dirs, err := os.ReadDir(downloadConfig.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		dirPath := filepath.Join(downloadConfig.Dir, dir.Name())
+		files, err := os.ReadDir(dirPath)
+		if err != nil {
+			return err
+		}
+		removed := 0
+		for _, file := range files {
+			if info, err := file.Info(); err == nil && strings.HasPrefix(file.Name(), ".download-") &&
+				time.Since(info.ModTime()) < downloadTimeout {
+				continue // removed by its download, which may still be running
+			}
+			if p := filepath.Join(dirPath, file.Name()); !kept[p] {
+				if err := os.Remove(p); err != nil {
+					return err
+				}
+				removed++
+			}
+		}
+		if removed == len(files) {
+			os.Remove(dirPath)
+		}
+	}
+	return nil
+}
+
+// streamHeaders sets the Content-Type of a streamed enclosure. Only audio, video and raster images
+// are served as themselves, anything else could be html or svg running under our origin and is
+// served as a download.
+func streamHeaders(c *gin.Context, contentType string) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	playable := strings.HasPrefix(mediaType, "audio/") || strings.HasPrefix(mediaType, "video/") ||
+		(strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml")
+	if playable {
+		c.Header("Content-Type", contentType)
+	} else {
+		c.Header("Content-Type", "application/octet-stream")
+		c.Header("Content-Disposition", "attachment")
+	}
+	sandboxHeaders(c)
+}
+
+// StreamEnclosure 播放附件，优先使用本地副本，否则代理上游并转发 Range 请求
+func (svc *Service) StreamEnclosure(c *gin.Context) {
+	enclosureID := c.Param("enclosure_id")
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires ||
+		!hmac.Equal([]byte(c.Query("signature")), []byte(streamSignature(enclosureID, expires))) {
+		c.JSON(403, gin.H{"error": "invalid or expired signature"})
+		return
+	}
+	enclosure, err := svc.db.GetEnclosure(c.Request.Context(), enclosureID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "enclosure not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if enclosure.DownloadedAt != nil {
+		if f, err := os.Open(enclosure.Path); err == nil {
+			defer f.Close()
+			streamHeaders(c, enclosure.Type)
+			// ServeContent answers range and conditional requests
+			http.ServeContent(c.Writer, c.Request, filepath.Base(enclosure.Path), *enclosure.DownloadedAt, f)
+			return
+		}
+		logrus.WithField("enclosure_id", enclosure.ID).Warn("local copy of enclosure is missing, streaming it")
+	}
+
+	req, err := http.NewRequestWithContext(c.Request.Context(), c.Request.Method, enclosure.URL, nil)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	req.Header.Set("User-Agent", "nexa/1.0")
+	for _, header := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		if value := c.GetHeader(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		c.JSON(502, gin.H{"error": err.Error()})
+		return
+	}
+	defer resp.Body.Close()
+	for _, header := range []string{"Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Last-Modified", "Cache-Control"} {
+		if value := resp.Header.Get(header); value != "" {
+			c.Header(header, value)
+		}
+	}
+	streamHeaders(c, lo.CoalesceOrEmpty(resp.Header.Get("Content-Type"), enclosure.Type))
+	c.Status(resp.StatusCode)
+	if _, err := io.Copy(c.Writer, resp.Body); err != nil {
+		logrus.WithError(err).WithField("enclosure_id", enclosure.ID).Debug("stream enclosure interrupted")
+	}
+}
+
+// DownloadEnclosure 在后台下载附件到本地，超出订阅配额时删除最旧的下载
+func (svc *Service) DownloadEnclosure(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	enclosure, err := svc.db.GetEnclosure(ctx, c.Param("enclosure_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "enclosure not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	feed, err := svc.db.GetFeed(ctx, enclosure.FeedID)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	if enclosure.DownloadedAt != nil {
+		c.JSON(200, gin.H{"enclosure": enclosure})
+		return
+	}
+	// downloads may take minutes, they outlive the request
+	svc.queueDownload(enclosure, feed)
+	c.JSON(202, gin.H{"enclosure": enclosure})
+}
+
+// DeleteEnclosureDownload 删除附件的本地副本
+func (svc *Service) DeleteEnclosureDownload(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	enclosure, err := svc.db.GetEnclosure(ctx, c.Param("enclosure_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "enclosure not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	downloadMu.Lock()
+	defer downloadMu.Unlock()
+	if enclosure.DownloadedAt != nil {
+		if err := svc.removeDownload(ctx, enclosure); err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	c.JSON(200, gin.H{"enclosure": enclosure})
+}
+
+// ListDownloads 列出已下载的附件及每个订阅的用量
+func (svc *Service) ListDownloads(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	filter := new(EnclosureFilter)
+	if feedID := c.Query("feed_id"); feedID != "" {
+		filter.FeedIDs = []string{feedID}
+	}
+	filter.Downloaded = lo.ToPtr(true)
+	downloads, err := svc.db.FilterEnclosures(ctx, filter)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	usage := make(map[string]int64)
+	for _, enclosure := range downloads {
+		usage[enclosure.FeedID] += enclosure.Size
+	}
+	c.JSON(200, gin.H{"downloads": downloads, "usage": usage})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// postgresSearchVector is the document the idx_items_search index was first built on by migration 1,
+// it must not change.
+const postgresSearchVector = "to_tsvector('simple', coalesce(title, '') || ' ' || coalesce(description, '') || ' ' || coalesce(content, ''))"
+
+// postgresItemSearchVector is the document searched by SearchQuery, postgresSearchVector with qualified
+// columns for queries joining feeds. It must match the idx_items_search index built by migration 3.
+const postgresItemSearchVector = "to_tsvector('simple', coalesce(items.title, '') || ' ' || coalesce(items.description, '') || ' ' || coalesce(items.content, ''))"
+
+type PostgresDB struct {
+	gormDB
+}
+
+func NewPostgresDB(dsn string) (*PostgresDB, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresDB{gormDB{db: db.Debug()}}, nil
+}
+
+// Migrate applies pending migrations, backups of PostgreSQL are left to pg_dump.
+func (s *PostgresDB) Migrate(ctx context.Context) error {
+	return s.migrate(ctx, func(ctx context.Context, version int) error {
+		logrus.Warnf("migrating postgres schema from version %d, make sure a pg_dump backup exists", version)
+		return nil
+	})
+}
+
+func (s *PostgresDB) Optimize(ctx context.Context) error {
+	return s.db.WithContext(ctx).Exec("VACUUM ANALYZE items").Error
+}
+
+func (s *PostgresDB) Backup(ctx context.Context, path string) error {
+	return errors.New("online backup is not supported for PostgreSQL, use pg_dump")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SearchTerm is a word or phrase of a search query, matched case insensitively.
+// Field scopes it to one part of the item, empty for title, content and description.
+type SearchTerm struct {
+	Field   string
+	Text    string
+	Exclude bool
+}
+
+// Fields a search term can be scoped to.
+const (
+	TermTitle   = "title"
+	TermContent = "content" // content and description
+	TermAuthor  = "author"
+	TermLink    = "link"
+)
+
+// QueryError is a syntax error in a search query, Pos is the offset in characters of the faulty token.
+type QueryError struct {
+	Pos int
+	Msg string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// queryDateLayouts are the absolute dates accepted by after: and before:,
+// relative ones are ages like 7d or 12h.
+var queryDateLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// ParseQuery parses a search query into filter, for example
+//
+//	title:golang feed:"Hacker News" tag:tech is:unread after:2025-01-01 -crypto "exact phrase"
+//
+// Bare words and quoted phrases are searched in title, content and description,
+// title:, content:, author: and link: scope them, a leading - excludes them.
+// feed:, tag: and label: given several times match any of their values.
+// Unknown prefixes are searched as plain words, so urls need no quoting.
+func ParseQuery(q string, filter *ItemFilter, now time.Time) error {
+	p := &queryParser{src: []rune(q)}
+	for {
+		p.skipSpaces()
+		if p.pos >= len(p.src) {
+			return nil
+		}
+		if err := p.parseTerm(filter, now); err != nil {
+			return err
+		}
+	}
+}
+
+type queryParser struct {
+	src []rune
+	pos int
+}
+
+func (p *queryParser) skipSpaces() {
+	for p.pos < len(p.src) && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+// value reads a word up to the next space, or a quoted phrase.
+func (p *queryParser) value() (string, error) {
+	if p.pos < len(p.src) && p.src[p.pos] == '"' {
+		start := p.pos
+		end := start + 1
+		for end < len(p.src) && p.src[end] != '"' {
+			end++
+		}
+		if end >= len(p.src) {
+			return "", &QueryError{Pos: start, Msg: "unterminated quote"}
+		}
+		p.pos = end + 1
+		return string(p.src[start+1 : end]), nil
+	}
+	start := p.pos
+	for p.pos < len(p.src) && !unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+	return string(p.src[start:p.pos]), nil
+}
+
+func (p *queryParser) parseTerm(filter *ItemFilter, now time.Time) error {
+	start := p.pos
+	exclude := false
+	if p.src[p.pos] == '-' && p.pos+1 < len(p.src) && !unicode.IsSpace(p.src[p.pos+1]) {
+		exclude = true
+		p.pos++
+	}
+
+	field := ""
+	if p.src[p.pos] != '"' {
+		for end := p.pos; end < len(p.src) && !unicode.IsSpace(p.src[end]) && p.src[end] != '"'; end++ {
+			if p.src[end] == ':' {
+				if name := strings.ToLower(string(p.src[p.pos:end])); isQueryField(name) {
+					field = name
+					p.pos = end + 1
+				}
+				break
+			}
+		}
+	}
+
+	valuePos := p.pos
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	if field != "" && strings.TrimSpace(value) == "" {
+		return &QueryError{Pos: start, Msg: fmt.Sprintf("missing value for %s:", field)}
+	}
+	if field == "" && value == "" {
+		// a lone "" or -""
+		return nil
+	}
+
+	switch field {
+	case "", TermTitle, TermContent, TermAuthor, TermLink:
+		filter.Terms = append(filter.Terms, SearchTerm{Field: field, Text: value, Exclude: exclude})
+		return nil
+	}
+	if exclude {
+		return &QueryError{Pos: start, Msg: fmt.Sprintf("%s: can not be excluded", field)}
+	}
+	switch field {
+	case "feed":
+		filter.FeedTitles = append(filter.FeedTitles, value)
+	case "tag":
+		filter.Tags = append(filter.Tags, value)
+	case "label":
+		filter.Labels = append(filter.Labels, value)
+	case "category":
+		filter.Categories = append(filter.Categories, value)
+	case "is":
+		yes, no := true, false
+		switch strings.ToLower(value) {
+		case "unread":
+			filter.Unread = &yes
+		case "read":
+			filter.Unread = &no
+		case "starred":
+			filter.Starred = &yes
+		case "unstarred":
+			filter.Starred = &no
+		case "liked":
+			filter.Liked = &yes
+		case "unliked":
+			filter.Liked = &no
+		default:
+			return &QueryError{Pos: valuePos, Msg: fmt.Sprintf("unknown state %q, expected unread, read, starred, unstarred, liked or unliked", value)}
+		}
+	case "after", "before":
+		t, ok := parseQueryDate(value, now)
+		if !ok {
+			return &QueryError{Pos: valuePos, Msg: fmt.Sprintf("invalid date %q, expected YYYY-MM-DD or an age like 7d", value)}
+		}
+		if field == "after" {
+			if filter.PubDate == nil || t.After(*filter.PubDate) {
+				filter.PubDate = &t
+			}
+		} else if filter.PubBefore == nil || t.Before(*filter.PubBefore) {
+			filter.PubBefore = &t
+		}
+	}
+	return nil
+}
+
+func isQueryField(name string) bool {
+	switch name {
+	case TermTitle, TermContent, TermAuthor, TermLink, "feed", "tag", "label", "category", "is", "after", "before":
+		return true
+	}
+	return false
+}
+
+func parseQueryDate(s string, now time.Time) (time.Time, bool) {
+	for _, layout := range queryDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t.UTC(), true
+		}
+	}
+	if age, err := parseAge(s); err == nil && age > 0 {
+		return now.Add(-age).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+// rankText is the text search results are ranked by, the free text of the query.
+// Scoped terms are left out, items matching title: all rank the same.
+func (filter *ItemFilter) rankText() string {
+	if filter.SearchQuery != nil && *filter.SearchQuery != "" {
+		return *filter.SearchQuery
+	}
+	var words []string
+	for _, term := range filter.Terms {
+		if !term.Exclude && term.Field == "" {
+			words = append(words, term.Text)
+		}
+	}
+	return strings.Join(words, " ")
+}
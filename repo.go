@@ -2,34 +2,185 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 )
 
+// ErrTagExists is returned when renaming a tag to the name of another existing tag.
+var ErrTagExists = errors.New("tag already exists")
+
 type ItemFilter struct {
 	FeedIDs     []string
+	FolderIDs   []string // items of the feeds directly in these folders
+	Labels      []string // items with any of these labels
+	Authors     []string // items by any of these authors, names or emails ignoring case
+	Categories  []string // items in any of these upstream categories, ignoring case
+	ClusterIDs  []string
 	Tags        []string
+	FeedTitles  []string // items of the feeds with any of these titles, or ids
 	PubDate     *time.Time
+	PubBefore   *time.Time
 	Unread      *bool
 	Starred     *bool
 	Liked       *bool
-	SortBy      *string
+	Sort        ItemSort
 	Limit       *int
 	Offset      *int
+	Cursor      *ItemCursor // keyset pagination, see ItemSort.Keyset
 	SearchQuery *string
+	Terms       []SearchTerm // parsed from a search query, see ParseQuery
+	Collapse    bool         // one item per cluster among the matching ones
+}
+
+// ItemSort is one of the supported orderings of item lists,
+// items without pub_date are ordered by the time they were fetched.
+type ItemSort string
+
+const (
+	SortNewest    ItemSort = "newest"
+	SortOldest    ItemSort = "oldest"
+	SortCreatedAt ItemSort = "created_at" // fetch time, newest first
+	SortFeed      ItemSort = "feed"       // feed title, then newest
+	SortUnread    ItemSort = "unread"     // unread first, then newest
+	SortRelevance ItemSort = "relevance"  // best search matches first, then newest
+)
+
+func ParseItemSort(s string) (ItemSort, error) {
+	switch sort := ItemSort(s); sort {
+	case "":
+		return SortNewest, nil
+	case SortNewest, SortOldest, SortCreatedAt, SortFeed, SortUnread, SortRelevance:
+		return sort, nil
+	default:
+		return "", fmt.Errorf("invalid sort: %q", s)
+	}
+}
+
+// Keyset reports whether the ordering supports cursor pagination.
+func (sort ItemSort) Keyset() bool {
+	return sort == "" || sort == SortNewest || sort == SortOldest || sort == SortCreatedAt
+}
+
+// ItemCursor is the position of the last item of a page, the next page starts right after it,
+// no matter how many items were added meanwhile. Time is the sort key of the item.
+type ItemCursor struct {
+	Sort ItemSort  `json:"s,omitempty"`
+	Time time.Time `json:"t"`
+	ID   string    `json:"i"`
+}
+
+// ItemUpdate holds the changes of an item, nil fields are left unchanged.
+type ItemUpdate struct {
+	Read     *bool
+	Starred  *bool
+	Liked    *bool
+	Note     *string
+	Labels   *[]string // replaces all the labels of the item
+	Position *int
+}
+
+// FeedUpdate sets the non nil fields of the feed, the other fields and the tags are left untouched.
+type FeedUpdate struct {
+	UpstreamTitle *string // also the title, unless the feed has a custom title
+	SiteURL       *string
+	Description   *string
+	Image         *string
+	Language      *string
+	Generator     *string
+	Copyright     *string
+	LastBuildDate *time.Time
+	IconPath      *string
+	IconType      *string
+	IconUpdatedAt *time.Time
+	IconCheckedAt *time.Time
+}
+
+type EnclosureFilter struct {
+	FeedIDs    []string
+	ItemIDs    []string
+	Downloaded *bool
+}
+
+type HighlightFilter struct {
+	ItemIDs []string
+	Limit   *int
+	Offset  *int
 }
 
 type DB interface {
 	GetFeed(ctx context.Context, feedID string) (*Feed, error)
 	FilterFeeds(ctx context.Context, tags []string) ([]*ListFeedResult, error)
 	SaveFeed(ctx context.Context, feed *Feed) error
+	UpdateFeed(ctx context.Context, feedID string, update *FeedUpdate) error
 	DeleteFeed(ctx context.Context, feedID string) error
 
 	ListTags(ctx context.Context) ([]*ListTagResult, error)
+	// RenameTag renames a tag on all feeds, when merge is set an existing tag named to absorbs it.
+	RenameTag(ctx context.Context, from, to string, merge bool) error
+	DeleteTag(ctx context.Context, name string) error
+	SetTagColor(ctx context.Context, name, color string) error
+	// SetTagOrder sets the display position of the tags to their index in names.
+	SetTagOrder(ctx context.Context, names []string) error
+
+	ListLabels(ctx context.Context) ([]*ListLabelResult, error)
+	// TopCategories returns the limit upstream categories of the feed with the most items.
+	TopCategories(ctx context.Context, feedID string, limit int) ([]*ListCategoryResult, error)
 
 	AddItem(ctx context.Context, items ...*Item) error
 	FilterItems(ctx context.Context, filter *ItemFilter) ([]*Item, error)
 	CountItems(ctx context.Context, filter *ItemFilter) (int64, error)
 	GetItem(ctx context.Context, itemID string) (*Item, error)
-	UpdateItem(ctx context.Context, itemID string, read, star, like *bool) error
+	// ExistingItemIDs returns the ids among itemIDs of the items already stored.
+	ExistingItemIDs(ctx context.Context, itemIDs []string) ([]string, error)
+	// DuplicateCandidates returns the items new items may duplicate, the ones fetched since
+	// the given time or with one of the canonical links. Only id, feed_id, canonical_link,
+	// sim_hash and cluster_id are set.
+	DuplicateCandidates(ctx context.Context, since time.Time, links []string) ([]*Item, error)
+	FindItem(ctx context.Context, feedID, guid, link string) (*Item, error)
+	UpdateItem(ctx context.Context, itemID string, update *ItemUpdate) error
 	SaveItem(ctx context.Context, item *Item) error
+	MarkInFeed(ctx context.Context, feedID string, itemIDs []string) error
+	PurgeableItems(ctx context.Context, feedID string, keepLast int, before *time.Time) ([]*Item, error)
+	DeleteItems(ctx context.Context, itemIDs ...string) error
+	Optimize(ctx context.Context) error
+	Backup(ctx context.Context, path string) error
+
+	// FilterHighlights returns the highlights newest first.
+	FilterHighlights(ctx context.Context, filter *HighlightFilter) ([]*Highlight, error)
+	CountHighlights(ctx context.Context, filter *HighlightFilter) (int64, error)
+	GetHighlight(ctx context.Context, highlightID string) (*Highlight, error)
+	SaveHighlight(ctx context.Context, highlight *Highlight) error
+	DeleteHighlight(ctx context.Context, highlightID string) error
+
+	// ListRules returns the rules in evaluation order.
+	ListRules(ctx context.Context) ([]*Rule, error)
+	GetRule(ctx context.Context, ruleID string) (*Rule, error)
+	SaveRule(ctx context.Context, rule *Rule) error
+	DeleteRule(ctx context.Context, ruleID string) error
+
+	ListSmartFeeds(ctx context.Context) ([]*SmartFeed, error)
+	GetSmartFeed(ctx context.Context, smartFeedID string) (*SmartFeed, error)
+	SaveSmartFeed(ctx context.Context, smartFeed *SmartFeed) error
+	DeleteSmartFeed(ctx context.Context, smartFeedID string) error
+
+	// FilterEnclosures returns the enclosures, the oldest items first.
+	FilterEnclosures(ctx context.Context, filter *EnclosureFilter) ([]*Enclosure, error)
+	GetEnclosure(ctx context.Context, enclosureID string) (*Enclosure, error)
+	SaveEnclosure(ctx context.Context, enclosure *Enclosure) error
+
+	ListOutputFeeds(ctx context.Context) ([]*OutputFeed, error)
+	GetOutputFeed(ctx context.Context, outputFeedID string) (*OutputFeed, error)
+	FindOutputFeed(ctx context.Context, token string) (*OutputFeed, error)
+	SaveOutputFeed(ctx context.Context, outputFeed *OutputFeed) error
+	DeleteOutputFeed(ctx context.Context, outputFeedID string) error
+
+	ListFolders(ctx context.Context) ([]*Folder, error)
+	GetFolder(ctx context.Context, folderID string) (*Folder, error)
+	SaveFolder(ctx context.Context, folder *Folder) error
+	// DeleteFolder moves the subfolders and feeds of the folder to its parent and deletes it.
+	DeleteFolder(ctx context.Context, folderID string) error
+
+	GetUser(ctx context.Context, name string) (*User, error)
+	SaveUser(ctx context.Context, user *User) error
 }
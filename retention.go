@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var retentionConfig struct {
+	MaxItems int    // keep the newest N items of each feed
+	MaxDays  int    // keep items younger than N days
+	Cron     string // schedule of the purge job
+}
+
+func init() {
+	retentionConfig.MaxItems, _ = strconv.Atoi(os.Getenv("NEXA_RETENTION_MAX_ITEMS"))
+	retentionConfig.MaxDays, _ = strconv.Atoi(os.Getenv("NEXA_RETENTION_MAX_DAYS"))
+	retentionConfig.Cron = os.Getenv("NEXA_RETENTION_CRON")
+	if retentionConfig.Cron == "" {
+		retentionConfig.Cron = "0 30 3 * * *"
+	}
+}
+
+// retentionPolicy returns the policy of the feed, feed settings take precedence over the global ones.
+func retentionPolicy(feed *Feed) (maxItems, maxDays int) {
+	maxItems, maxDays = retentionConfig.MaxItems, retentionConfig.MaxDays
+	if feed.RetentionMaxItems > 0 {
+		maxItems = feed.RetentionMaxItems
+	}
+	if feed.RetentionMaxDays > 0 {
+		maxDays = feed.RetentionMaxDays
+	}
+	return maxItems, maxDays
+}
+
+type PurgeResult struct {
+	FeedID string  `json:"feed_id"`
+	Title  string  `json:"title"`
+	Count  int     `json:"count"`
+	Items  []*Item `json:"items"`
+}
+
+// purge deletes the items out of the retention policy of each feed.
+// An item is kept when it is one of the newest MaxItems items or younger than MaxDays,
+// starred, liked, labeled or annotated items and items still listed by the upstream feed are always kept.
+func (svc *Service) purge(ctx context.Context, dryRun bool) ([]*PurgeResult, error) {
+	feeds, err := svc.db.FilterFeeds(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "list feeds error")
+	}
+
+	results := []*PurgeResult{}
+	deleted := 0
+	for _, feed := range feeds {
+		maxItems, maxDays := retentionPolicy(feed.Feed)
+		if maxItems <= 0 && maxDays <= 0 {
+			continue
+		}
+		var before *time.Time
+		if maxDays > 0 {
+			t := time.Now().AddDate(0, 0, -maxDays)
+			before = &t
+		}
+
+		items, err := svc.db.PurgeableItems(ctx, feed.ID, maxItems, before)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list purgeable items of feed %s error", feed.ID)
+		}
+		if len(items) == 0 {
+			continue
+		}
+		results = append(results, &PurgeResult{FeedID: feed.ID, Title: feed.Title, Count: len(items), Items: items})
+		if dryRun {
+			continue
+		}
+
+		ids := make([]string, len(items))
+		for i, item := range items {
+			ids[i] = item.ID
+		}
+		if err := svc.db.DeleteItems(ctx, ids...); err != nil {
+			return nil, errors.Wrapf(err, "delete items of feed %s error", feed.ID)
+		}
+		deleted += len(ids)
+	}
+
+	if deleted > 0 {
+		logrus.Infof("purged %d items", deleted)
+		if err := svc.pruneDownloads(ctx); err != nil {
+			logrus.WithError(err).Error("prune downloads error")
+		}
+		if err := svc.db.Optimize(ctx); err != nil {
+			logrus.WithError(err).Error("optimize db error")
+		}
+	}
+	return results, nil
+}
+
+func (svc *Service) initRetention() {
+	_, err := svc.cron.AddFunc(retentionConfig.Cron, func() {
+		if _, err := svc.purge(context.Background(), false); err != nil {
+			logrus.WithError(err).Error("purge items error")
+		}
+	})
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid NEXA_RETENTION_CRON")
+	}
+}
+
+// PurgeItems 按保留策略清理文章，dry_run=true 时只返回将被删除的文章
+func (svc *Service) PurgeItems(c *gin.Context) {
+	dryRun := c.Query("dry_run") == "true"
+
+	results, err := svc.purge(c.Request.Context(), dryRun)
+	if err != nil {
+		logrus.WithError(err).Error("purge items error")
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	total := 0
+	for _, result := range results {
+		total += result.Count
+	}
+	c.JSON(200, gin.H{"dry_run": dryRun, "total": total, "feeds": results})
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// compiledRule is a validated rule with its conditions ready to be evaluated.
+type compiledRule struct {
+	*Rule
+	conditions []func(item *Item, now time.Time) bool
+}
+
+func compileRule(rule *Rule) (*compiledRule, error) {
+	if rule.Match != "" && rule.Match != "all" && rule.Match != "any" {
+		return nil, fmt.Errorf("invalid match %q", rule.Match)
+	}
+	if len(rule.Conditions) == 0 {
+		// it would match every item of its scope
+		return nil, errors.New("rule has no condition")
+	}
+	if len(rule.Actions) == 0 {
+		return nil, errors.New("rule has no action")
+	}
+	for _, action := range rule.Actions {
+		switch action.Type {
+		case "read", "star", "like", "skip", "delete":
+		case "label":
+			if strings.TrimSpace(action.Value) == "" {
+				return nil, errors.New("label action requires a label")
+			}
+		case "webhook":
+			if u, err := url.Parse(action.Value); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("invalid webhook url %q", action.Value)
+			}
+		default:
+			return nil, fmt.Errorf("invalid action %q", action.Type)
+		}
+	}
+
+	compiled := &compiledRule{Rule: rule}
+	for _, cond := range rule.Conditions {
+		match, err := compileCondition(cond)
+		if err != nil {
+			return nil, errors.Wrapf(err, "condition on %s", cond.Field)
+		}
+		compiled.conditions = append(compiled.conditions, match)
+	}
+	return compiled, nil
+}
+
+func compileCondition(cond RuleCondition) (func(item *Item, now time.Time) bool, error) {
+	if cond.Field == "age" {
+		age, err := parseAge(cond.Value)
+		if err != nil {
+			return nil, err
+		}
+		switch cond.Op {
+		case "older_than":
+			return func(item *Item, now time.Time) bool { return now.Sub(itemAgeTime(item, now)) > age }, nil
+		case "newer_than":
+			return func(item *Item, now time.Time) bool { return now.Sub(itemAgeTime(item, now)) <= age }, nil
+		default:
+			return nil, fmt.Errorf("invalid op %q", cond.Op)
+		}
+	}
+
+	var field func(item *Item) string
+	switch cond.Field {
+	case "title":
+		field = func(item *Item) string { return item.Title }
+	case "content":
+		field = func(item *Item) string { return item.Content + "\n" + item.Description }
+	case "author":
+		field = func(item *Item) string { return item.Author }
+	case "link":
+		field = func(item *Item) string { return item.Link }
+	default:
+		return nil, fmt.Errorf("invalid field %q", cond.Field)
+	}
+
+	switch cond.Op {
+	case "contains", "not_contains":
+		keyword := strings.ToLower(cond.Value)
+		negate := cond.Op == "not_contains"
+		return func(item *Item, _ time.Time) bool {
+			return strings.Contains(strings.ToLower(field(item)), keyword) != negate
+		}, nil
+	case "matches", "not_matches":
+		re, err := regexp.Compile(cond.Value)
+		if err != nil {
+			return nil, err
+		}
+		negate := cond.Op == "not_matches"
+		return func(item *Item, _ time.Time) bool { return re.MatchString(field(item)) != negate }, nil
+	default:
+		return nil, fmt.Errorf("invalid op %q", cond.Op)
+	}
+}
+
+// parseAge parses a Go duration, or a number of days like 7d.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// itemAgeTime is the publication time of the item, new items without one are just fetched.
+func itemAgeTime(item *Item, now time.Time) time.Time {
+	if item.PubDate != nil {
+		return *item.PubDate
+	}
+	if !item.CreatedAt.IsZero() {
+		return item.CreatedAt
+	}
+	return now
+}
+
+// inScope reports whether the rule applies to the items of the feed.
+func (rule *compiledRule) inScope(feed *Feed) bool {
+	if len(rule.FeedIDs) > 0 && !slices.Contains(rule.FeedIDs, feed.ID) {
+		return false
+	}
+	return len(rule.Tags) == 0 || lo.Some(feed.Tags, rule.Tags)
+}
+
+func (rule *compiledRule) match(item *Item, now time.Time) bool {
+	if rule.Match == "any" {
+		return lo.SomeBy(rule.conditions, func(cond func(*Item, time.Time) bool) bool { return cond(item, now) })
+	}
+	return lo.EveryBy(rule.conditions, func(cond func(*Item, time.Time) bool) bool { return cond(item, now) })
+}
+
+// ruleEffects accumulates the actions of the rules matching an item.
+type ruleEffects struct {
+	Read, Starred, Liked, Skip bool
+	Labels                     []string
+	Webhooks                   []ruleWebhook
+}
+
+type ruleWebhook struct {
+	URL  string
+	Rule string
+}
+
+func (e *ruleEffects) add(rule *compiledRule) {
+	for _, action := range rule.Actions {
+		switch action.Type {
+		case "read":
+			e.Read = true
+		case "star":
+			e.Starred = true
+		case "like":
+			e.Liked = true
+		case "label":
+			if label := strings.TrimSpace(action.Value); !slices.Contains(e.Labels, label) {
+				e.Labels = append(e.Labels, label)
+			}
+		case "skip", "delete":
+			e.Skip = true
+		case "webhook":
+			e.Webhooks = append(e.Webhooks, ruleWebhook{URL: action.Value, Rule: rule.Name})
+		}
+	}
+}
+
+// evaluateRules returns the effects of the rules matching the item of the feed, nil when none matches.
+func evaluateRules(rules []*compiledRule, feed *Feed, item *Item, now time.Time) *ruleEffects {
+	var effects *ruleEffects
+	for _, rule := range rules {
+		if rule.inScope(feed) && rule.match(item, now) {
+			if effects == nil {
+				effects = new(ruleEffects)
+			}
+			effects.add(rule)
+		}
+	}
+	return effects
+}
+
+// enabledRules returns the compiled enabled rules, invalid ones are logged and ignored.
+func (svc *Service) enabledRules(ctx context.Context) ([]*compiledRule, error) {
+	rules, err := svc.db.ListRules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var compiled []*compiledRule
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
+		}
+		c, err := compileRule(rule)
+		if err != nil {
+			logrus.WithField("rule_id", rule.ID).WithError(err).Warn("invalid rule")
+			continue
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// applyRules evaluates the rules on the items of the feed which are not stored yet,
+// flags are set on the items and the skipped ones are removed. The remaining effects,
+// labels and webhooks, must be applied by applyRuleEffects once the items are stored.
+func (svc *Service) applyRules(ctx context.Context, feed *Feed, items []*Item) ([]*Item, map[string]*ruleEffects, error) {
+	rules, err := svc.enabledRules(ctx)
+	if err != nil || len(rules) == 0 {
+		return items, nil, err
+	}
+	existing, err := svc.db.ExistingItemIDs(ctx, lo.Map(items, func(item *Item, _ int) string { return item.ID }))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	effects := make(map[string]*ruleEffects)
+	kept := make([]*Item, 0, len(items))
+	for _, item := range items {
+		if slices.Contains(existing, item.ID) {
+			kept = append(kept, item)
+			continue
+		}
+		e := evaluateRules(rules, feed, item, now)
+		if e == nil {
+			kept = append(kept, item)
+			continue
+		}
+		if e.Skip {
+			logrus.WithField("feed_id", feed.ID).Debugf("rule skipped item %s", item.Title)
+			continue
+		}
+		item.Read = item.Read || e.Read
+		item.Starred = item.Starred || e.Starred
+		item.Liked = item.Liked || e.Liked
+		effects[item.ID] = e
+		kept = append(kept, item)
+	}
+	return kept, effects, nil
+}
+
+func (svc *Service) applyRuleEffects(ctx context.Context, feed *Feed, items []*Item, effects map[string]*ruleEffects) {
+	for _, item := range items {
+		e := effects[item.ID]
+		if e == nil {
+			continue
+		}
+		if len(e.Labels) > 0 {
+			if err := svc.db.UpdateItem(ctx, item.ID, &ItemUpdate{Labels: &e.Labels}); err != nil {
+				logrus.WithField("item_id", item.ID).WithError(err).Error("label item error")
+			}
+		}
+		for _, webhook := range e.Webhooks {
+			go fireWebhook(webhook, feed, item)
+		}
+	}
+}
+
+// fireWebhook posts the item matched by a rule to the webhook url.
+func fireWebhook(webhook ruleWebhook, feed *Feed, item *Item) {
+	log := logrus.WithField("webhook", webhook.URL).WithField("item_id", item.ID)
+	body, err := json.Marshal(gin.H{
+		"event": "rule.matched",
+		"rule":  webhook.Rule,
+		"feed":  gin.H{"id": feed.ID, "title": feed.Title, "link": feed.Link},
+		"item":  item,
+	})
+	if err != nil {
+		log.WithError(err).Error("encode webhook error")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		log.WithError(err).Error("webhook request error")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nexa/1.0")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		log.WithError(err).Warn("webhook error")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Warnf("webhook status code: %d", resp.StatusCode)
+	}
+}
+
+// scanRuleItems calls fn with the stored items in the scope of the rule.
+func (svc *Service) scanRuleItems(ctx context.Context, rule *compiledRule, fn func(feed *Feed, item *Item) error) error {
+	feeds, err := svc.db.FilterFeeds(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "list feeds error")
+	}
+	const pageSize = 200
+	for _, feed := range feeds {
+		if !rule.inScope(feed.Feed) {
+			continue
+		}
+		for offset := 0; ; offset += pageSize {
+			limit, offset := pageSize, offset
+			items, err := svc.db.FilterItems(ctx, &ItemFilter{FeedIDs: []string{feed.ID}, Sort: SortNewest, Limit: &limit, Offset: &offset})
+			if err != nil {
+				return errors.Wrapf(err, "list items of feed %s error", feed.ID)
+			}
+			for _, item := range items {
+				if err := fn(feed.Feed, item); err != nil {
+					return err
+				}
+			}
+			if len(items) < pageSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+type RuleApplyResult struct {
+	Matched   int `json:"matched"`
+	Updated   int `json:"updated"`
+	Deleted   int `json:"deleted"`
+	Protected int `json:"protected"` // matched but kept, see applyRule
+}
+
+// applyRule runs the actions of the rule on the stored items it matches,
+// skip and delete actions delete them. Webhooks are only fired for new items.
+// Like retention, deletions spare starred, liked, labeled, annotated and highlighted items.
+func (svc *Service) applyRule(ctx context.Context, rule *compiledRule) (*RuleApplyResult, error) {
+	result := new(RuleApplyResult)
+	var deleted []string
+	now := time.Now()
+	err := svc.scanRuleItems(ctx, rule, func(feed *Feed, item *Item) error {
+		if !rule.match(item, now) {
+			return nil
+		}
+		result.Matched++
+		e := new(ruleEffects)
+		e.add(rule)
+		if e.Skip {
+			if item.Starred || item.Liked || len(item.Labels) > 0 || item.Note != "" {
+				result.Protected++
+			} else {
+				deleted = append(deleted, item.ID)
+			}
+			return nil
+		}
+
+		update := &ItemUpdate{}
+		if e.Read && !item.Read {
+			update.Read = lo.ToPtr(true)
+		}
+		if e.Starred && !item.Starred {
+			update.Starred = lo.ToPtr(true)
+		}
+		if e.Liked && !item.Liked {
+			update.Liked = lo.ToPtr(true)
+		}
+		if missing := lo.Without(e.Labels, item.Labels...); len(missing) > 0 {
+			update.Labels = lo.ToPtr(append(slices.Clone(item.Labels), missing...))
+		}
+		if *update == (ItemUpdate{}) {
+			return nil
+		}
+		result.Updated++
+		return svc.db.UpdateItem(ctx, item.ID, update)
+	})
+	if err != nil {
+		return nil, err
+	}
+	highlighted, err := svc.highlightedItems(ctx, deleted)
+	if err != nil {
+		return nil, err
+	}
+	deleted = lo.Without(deleted, highlighted...)
+	result.Protected += len(highlighted)
+	if len(deleted) > 0 {
+		if err := svc.db.DeleteItems(ctx, deleted...); err != nil {
+			return nil, errors.Wrap(err, "delete items error")
+		}
+		result.Deleted = len(deleted)
+		if err := svc.pruneDownloads(ctx); err != nil {
+			logrus.WithError(err).Error("prune downloads error")
+		}
+	}
+	return result, nil
+}
+
+// highlightedItems returns the ids among itemIDs of the items having highlights.
+func (svc *Service) highlightedItems(ctx context.Context, itemIDs []string) ([]string, error) {
+	var highlighted []string
+	for _, chunk := range lo.Chunk(itemIDs, 500) {
+		highlights, err := svc.db.FilterHighlights(ctx, &HighlightFilter{ItemIDs: chunk})
+		if err != nil {
+			return nil, errors.Wrap(err, "list highlights error")
+		}
+		highlighted = append(highlighted, lo.Map(highlights, func(highlight *Highlight, _ int) string { return highlight.ItemID })...)
+	}
+	return lo.Uniq(highlighted), nil
+}
+
+type ruleRequest struct {
+	Name       string          `json:"name"`
+	Enabled    *bool           `json:"enabled"`
+	Position   int             `json:"position"`
+	FeedIDs    []string        `json:"feed_ids"`
+	Tags       []string        `json:"tags"`
+	Match      string          `json:"match"`
+	Conditions []RuleCondition `json:"conditions"`
+	Actions    []RuleAction    `json:"actions"`
+}
+
+// bindRule reads the rule of the request into rule and validates it, it responds 400 on error.
+func bindRule(c *gin.Context, rule *Rule) (*compiledRule, bool) {
+	req := new(ruleRequest)
+	if err := c.BindJSON(req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	rule.Name = req.Name
+	rule.Enabled = req.Enabled == nil || *req.Enabled
+	rule.Position = req.Position
+	rule.FeedIDs = req.FeedIDs
+	rule.Tags = req.Tags
+	rule.Match = req.Match
+	rule.Conditions = req.Conditions
+	rule.Actions = req.Actions
+
+	compiled, err := compileRule(rule)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return compiled, true
+}
+
+// ListRules 按执行顺序列出所有规则
+func (svc *Service) ListRules(c *gin.Context) {
+	rules, err := svc.db.ListRules(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"rules": rules})
+}
+
+// AddRule 创建规则，规则只作用于之后抓取到的新文章
+func (svc *Service) AddRule(c *gin.Context) {
+	rule := &Rule{ID: Hash(fmt.Sprintf("rule@%d", time.Now().UnixNano()))}
+	if _, ok := bindRule(c, rule); !ok {
+		return
+	}
+	if err := svc.db.SaveRule(c.Request.Context(), rule); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"rule": rule})
+}
+
+// UpdateRule 修改规则
+func (svc *Service) UpdateRule(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	rule, err := svc.db.GetRule(ctx, c.Param("rule_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "rule not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if _, ok := bindRule(c, rule); !ok {
+		return
+	}
+	if err := svc.db.SaveRule(ctx, rule); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"rule": rule})
+}
+
+// DeleteRule 删除规则
+func (svc *Service) DeleteRule(c *gin.Context) {
+	err := svc.db.DeleteRule(c.Request.Context(), c.Param("rule_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "rule not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
+
+// TestRule 用已有文章测试规则（无需保存），返回匹配数量和前 limit 篇文章，不执行任何动作
+func (svc *Service) TestRule(c *gin.Context) {
+	compiled, ok := bindRule(c, new(Rule))
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit < 1 {
+		limit = 50
+	}
+
+	matched := 0
+	items := []*Item{}
+	now := time.Now()
+	err = svc.scanRuleItems(c.Request.Context(), compiled, func(feed *Feed, item *Item) error {
+		if compiled.match(item, now) {
+			matched++
+			if len(items) < limit {
+				items = append(items, item)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("test rule error")
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"matched": matched, "items": items})
+}
+
+// ApplyRule 对已有文章执行规则，skip/delete 会删除匹配的文章，不触发 webhook
+func (svc *Service) ApplyRule(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	rule, err := svc.db.GetRule(ctx, c.Param("rule_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "rule not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	compiled, err := compileRule(rule)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := svc.applyRule(ctx, compiled)
+	if err != nil {
+		logrus.WithError(err).Error("apply rule error")
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"result": result})
+}
@@ -3,9 +3,15 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
 
+	"github.com/mmcdole/gofeed"
 	"github.com/pkg/errors"
 	"github.com/robfig/cron/v3"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 )
 
@@ -14,21 +20,58 @@ type Service struct {
 
 	cron  *cron.Cron
 	crons map[string]cron.EntryID
+
+	users sync.Map // names of users known to exist
+}
+
+func Start(addr string, db DB) {
+	svc := newService(db)
+	svc.initCron()
+	svc.initRetention()
+	svc.initBackup()
+	svc.listen(addr)
 }
 
-func Start(addr string) {
-	svc := new(Service)
-	svc.cron = cron.New(cron.WithSeconds())
-	svc.crons = make(map[string]cron.EntryID)
+func newService(db DB) *Service {
+	return &Service{
+		db:    db,
+		cron:  cron.New(cron.WithSeconds()),
+		crons: make(map[string]cron.EntryID),
+	}
+}
 
-	db, err := NewSQLiteDB("data/nexa.db")
+// SQLDB is a DB backed by a SQL database, which has a versioned schema.
+type SQLDB interface {
+	DB
+	SchemaVersion(ctx context.Context) (int, error)
+	PendingMigrations(ctx context.Context) ([]migration, error)
+	Migrate(ctx context.Context) error
+}
+
+// openDB opens the configured database and migrates its schema to the latest version.
+func openDB() (DB, error) {
+	db, err := dialDB()
 	if err != nil {
-		logrus.WithError(err).Fatal("failed to open sqlite db")
+		return nil, err
+	}
+	if err := db.Migrate(context.Background()); err != nil {
+		return nil, err
 	}
-	svc.db = db
+	return db, nil
+}
 
-	svc.initCron()
-	svc.listen(addr)
+// dialDB opens the database configured by NEXA_DSN,
+// a postgres:// url selects PostgreSQL, anything else is a SQLite file path.
+func dialDB() (SQLDB, error) {
+	dsn := os.Getenv("NEXA_DSN")
+	switch {
+	case dsn == "":
+		return NewSQLiteDB("data/nexa.db")
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return NewPostgresDB(dsn)
+	default:
+		return NewSQLiteDB(dsn)
+	}
 }
 
 func (svc *Service) initCron() {
@@ -74,7 +117,11 @@ func (svc *Service) fetch(ctx context.Context, feedID string) error {
 	if err != nil {
 		return errors.Wrap(err, "fetch feed error")
 	}
-	feed.Title = f.Title
+	update := feedUpdate(f)
+	feed.UpstreamTitle, feed.SiteURL, feed.Image = *update.UpstreamTitle, *update.SiteURL, *update.Image
+	if feed.CustomTitle == "" {
+		feed.Title = feed.UpstreamTitle
+	}
 
 	items := make([]*Item, 0, len(f.Items))
 	for _, raw := range f.Items {
@@ -89,20 +136,96 @@ func (svc *Service) fetch(ctx context.Context, feedID string) error {
 			GUID:        raw.GUID,
 			PubDate:     raw.PublishedParsed,
 		}
+		item.Authors = parseAuthors(raw)
+		if len(item.Authors) > 0 {
+			item.Author = item.Authors[0].Name
+		}
+		item.Categories = parseCategories(raw)
+		if item.PubDate != nil {
+			// stored in UTC so that dates compare correctly in SQL
+			item.PubDate = lo.ToPtr(item.PubDate.UTC())
+		}
+		if raw.UpdatedParsed != nil {
+			item.UpdatedDate = lo.ToPtr(raw.UpdatedParsed.UTC())
+		}
 		if raw.Image != nil {
 			item.Image = raw.Image.URL
 		}
+		item.Enclosures = parseEnclosures(item, raw)
+		parsePodcast(item, raw)
 		items = append(items, item)
 	}
+	if err := svc.adoptImportedItems(ctx, items); err != nil {
+		return errors.Wrap(err, "find imported items error")
+	}
+	// items still listed upstream are protected from retention, otherwise they would come back,
+	// skipped items included, rules only run on new items
+	itemIDs := lo.Map(items, func(item *Item, _ int) string { return item.ID })
+
+	items, effects, err := svc.applyRules(ctx, feed, items)
+	if err != nil {
+		return errors.Wrap(err, "apply rules error")
+	}
+	existing, err := svc.db.ExistingItemIDs(ctx, lo.Map(items, func(item *Item, _ int) string { return item.ID }))
+	if err != nil {
+		return errors.Wrap(err, "find existing items error")
+	}
+	newItems := lo.Filter(items, func(item *Item, _ int) bool { return !lo.Contains(existing, item.ID) })
+	svc.normalizeLinks(ctx, feed, newItems)
+	if err := svc.clusterItems(ctx, newItems); err != nil {
+		// items are still stored, each in a cluster of its own
+		logrus.WithError(err).WithField("feed_id", feed.ID).Error("cluster items error")
+	}
 	if err := svc.db.AddItem(ctx, items...); err != nil {
 		return errors.Wrap(err, "save items error")
 	}
+	svc.applyRuleEffects(ctx, feed, items, effects)
+	if feed.DownloadEnclosures && len(newItems) > 0 {
+		// downloads outlive the fetch, they may take minutes
+		go svc.downloadNewEnclosures(context.Background(), feed, newItems)
+	}
 
-	feed.LastBuildDate = f.UpdatedParsed
-	// FIXME: 更新部分字段就好，不然有可能发生 tags 被更新成老的的问题
-	if err := svc.db.SaveFeed(ctx, feed); err != nil {
+	if err := svc.db.MarkInFeed(ctx, feed.ID, itemIDs); err != nil {
+		return errors.Wrap(err, "mark listed items error")
+	}
+
+	// only the upstream metadata is updated, settings changed during the fetch are kept
+	if err := svc.db.UpdateFeed(ctx, feed.ID, update); err != nil {
 		return errors.Wrap(err, "update feed error")
 	}
+	if iconExpired(feed) {
+		if err := svc.refreshIcon(ctx, feed); err != nil {
+			logrus.WithError(err).WithField("feed_id", feed.ID).Warn("refresh feed icon error")
+		}
+	}
 
 	return nil
 }
+
+// feedUpdate returns the metadata of the fetched feed.
+func feedUpdate(f *gofeed.Feed) *FeedUpdate {
+	update := &FeedUpdate{
+		UpstreamTitle: lo.ToPtr(strings.TrimSpace(f.Title)),
+		SiteURL:       lo.ToPtr(siteURL(f)),
+		Description:   lo.ToPtr(strings.TrimSpace(f.Description)),
+		Image:         lo.ToPtr(""),
+		Language:      lo.ToPtr(strings.TrimSpace(f.Language)),
+		Generator:     lo.ToPtr(strings.TrimSpace(f.Generator)),
+		Copyright:     lo.ToPtr(strings.TrimSpace(f.Copyright)),
+		LastBuildDate: f.UpdatedParsed,
+	}
+	if f.Image != nil {
+		update.Image = lo.ToPtr(f.Image.URL)
+	}
+	return update
+}
+
+// siteURL returns the homepage of the feed, which is the link of RSS feeds and the alternate link of Atom feeds.
+func siteURL(f *gofeed.Feed) string {
+	for _, link := range append([]string{f.Link}, f.Links...) {
+		if u, err := url.Parse(link); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			return link
+		}
+	}
+	return ""
+}
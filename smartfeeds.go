@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"gorm.io/gorm"
+)
+
+// smartFeedPrefix tells smart feed ids apart from feed ids, which are hex hashes.
+const smartFeedPrefix = "smart-"
+
+// Filter resolves the smart feed to the filter of its items, the query is parsed with ParseQuery.
+func (feed *SmartFeed) Filter(now time.Time) (*ItemFilter, error) {
+	filter := &ItemFilter{
+		FeedIDs: feed.FeedIDs,
+		Tags:    feed.Tags,
+		Labels:  feed.Labels,
+		Sort:    feed.Sort,
+	}
+	if feed.Unread {
+		filter.Unread = lo.ToPtr(true)
+	}
+	if feed.Starred {
+		filter.Starred = lo.ToPtr(true)
+	}
+	if feed.Liked {
+		filter.Liked = lo.ToPtr(true)
+	}
+	if feed.Days > 0 {
+		filter.PubDate = lo.ToPtr(now.AddDate(0, 0, -feed.Days).UTC())
+	}
+	if err := ParseQuery(feed.Query, filter, now); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+type ListSmartFeedResult struct {
+	*SmartFeed
+	UnreadCount int64 `json:"unread_count"`
+}
+
+func (svc *Service) listSmartFeeds(ctx context.Context) ([]*ListSmartFeedResult, error) {
+	smartFeeds, err := svc.db.ListSmartFeeds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	results := make([]*ListSmartFeedResult, len(smartFeeds))
+	for i, smartFeed := range smartFeeds {
+		filter, err := smartFeed.Filter(now)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid query of smart feed %s", smartFeed.ID)
+		}
+		results[i] = &ListSmartFeedResult{SmartFeed: smartFeed}
+		if filter.Unread != nil && !*filter.Unread {
+			continue // is:read smart feeds have no unread items
+		}
+		filter.Unread = lo.ToPtr(true)
+		if results[i].UnreadCount, err = svc.db.CountItems(ctx, filter); err != nil {
+			return nil, errors.Wrapf(err, "count items of smart feed %s error", smartFeed.ID)
+		}
+	}
+	return results, nil
+}
+
+// listSmartFeedItems 列出智能订阅的文章，查询参数在保存的过滤条件上叠加
+func (svc *Service) listSmartFeedItems(c *gin.Context, smartFeedID string) {
+	smartFeed, err := svc.db.GetSmartFeed(c.Request.Context(), smartFeedID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "smart feed not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	filter, err := smartFeed.Filter(time.Now())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	svc.listItems(c, filter, nil)
+}
+
+type smartFeedRequest struct {
+	Name     string   `json:"name"`
+	Position int      `json:"position"`
+	FeedIDs  []string `json:"feed_ids"`
+	Tags     []string `json:"tags"`
+	Labels   []string `json:"labels"`
+	Query    string   `json:"query"`
+	Unread   bool     `json:"unread"`
+	Starred  bool     `json:"starred"`
+	Liked    bool     `json:"liked"`
+	Days     int      `json:"days"`
+	Sort     string   `json:"sort"`
+}
+
+// bindSmartFeed reads the smart feed of the request into smartFeed, it responds 400 when invalid.
+func bindSmartFeed(c *gin.Context, smartFeed *SmartFeed) bool {
+	req := new(smartFeedRequest)
+	if err := c.BindJSON(req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return false
+	}
+	sort, err := ParseItemSort(req.Sort)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return false
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		c.JSON(400, gin.H{"error": "name required"})
+		return false
+	}
+	if req.Days < 0 {
+		c.JSON(400, gin.H{"error": "days must not be negative"})
+		return false
+	}
+	if err := ParseQuery(req.Query, new(ItemFilter), time.Now()); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return false
+	}
+
+	smartFeed.Name = strings.TrimSpace(req.Name)
+	smartFeed.Position = req.Position
+	smartFeed.FeedIDs = req.FeedIDs
+	smartFeed.Tags = req.Tags
+	smartFeed.Labels = req.Labels
+	smartFeed.Query = req.Query
+	smartFeed.Unread = req.Unread
+	smartFeed.Starred = req.Starred
+	smartFeed.Liked = req.Liked
+	smartFeed.Days = req.Days
+	smartFeed.Sort = sort
+	return true
+}
+
+// AddSmartFeed 保存一组过滤条件为智能订阅
+func (svc *Service) AddSmartFeed(c *gin.Context) {
+	smartFeed := &SmartFeed{ID: smartFeedPrefix + Hash(fmt.Sprintf("smart@%d", time.Now().UnixNano()))[:16]}
+	if !bindSmartFeed(c, smartFeed) {
+		return
+	}
+	if err := svc.db.SaveSmartFeed(c.Request.Context(), smartFeed); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"smart_feed": smartFeed})
+}
+
+// UpdateSmartFeed 修改智能订阅
+func (svc *Service) UpdateSmartFeed(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	smartFeed, err := svc.db.GetSmartFeed(ctx, c.Param("smart_feed_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "smart feed not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	if !bindSmartFeed(c, smartFeed) {
+		return
+	}
+	if err := svc.db.SaveSmartFeed(ctx, smartFeed); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"smart_feed": smartFeed})
+}
+
+// DeleteSmartFeed 删除智能订阅
+func (svc *Service) DeleteSmartFeed(c *gin.Context) {
+	err := svc.db.DeleteSmartFeed(c.Request.Context(), c.Param("smart_feed_id"))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(404, gin.H{"error": "smart feed not found"})
+		return
+	} else if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
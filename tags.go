@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/samber/lo"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+var tagColorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// tagError writes the response of a failed tag operation.
+func tagError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		c.JSON(404, gin.H{"error": "tag not found"})
+	case errors.Is(err, ErrTagExists):
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		logrus.WithError(err).Error("tag operation error")
+		c.JSON(500, gin.H{"error": err.Error()})
+	}
+}
+
+// ListTags 列出所有标签及其文章数量，按显示顺序排列
+func (svc *Service) ListTags(c *gin.Context) {
+	tags, err := svc.db.ListTags(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"tags": tags})
+}
+
+// RenameTag 重命名所有订阅上的标签，目标标签已存在时返回 409
+func (svc *Service) RenameTag(c *gin.Context) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		c.JSON(400, gin.H{"error": "name required"})
+		return
+	}
+	if name == c.Param("tag") {
+		c.JSON(200, gin.H{"success": true})
+		return
+	}
+
+	if err := svc.db.RenameTag(c.Request.Context(), c.Param("tag"), name, false); err != nil {
+		tagError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
+
+// MergeTag 将标签合并到 into 标签中
+func (svc *Service) MergeTag(c *gin.Context) {
+	var req struct {
+		Into string `json:"into"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	into := strings.TrimSpace(req.Into)
+	if into == "" || into == c.Param("tag") {
+		c.JSON(400, gin.H{"error": "into must be another tag"})
+		return
+	}
+
+	if err := svc.db.RenameTag(c.Request.Context(), c.Param("tag"), into, true); err != nil {
+		tagError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
+
+// DeleteTag 从所有订阅上移除标签，订阅本身不受影响
+func (svc *Service) DeleteTag(c *gin.Context) {
+	if err := svc.db.DeleteTag(c.Request.Context(), c.Param("tag")); err != nil {
+		tagError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
+
+// UpdateTag 设置标签颜色，空字符串恢复默认颜色
+func (svc *Service) UpdateTag(c *gin.Context) {
+	var req struct {
+		Color string `json:"color"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Color != "" && !tagColorRegexp.MatchString(req.Color) {
+		c.JSON(400, gin.H{"error": "color must be #rrggbb"})
+		return
+	}
+
+	if err := svc.db.SetTagColor(c.Request.Context(), c.Param("tag"), strings.ToLower(req.Color)); err != nil {
+		tagError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
+
+// OrderTags 按给定的标签列表设置显示顺序
+func (svc *Service) OrderTags(c *gin.Context) {
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	tags, err := svc.db.ListTags(c.Request.Context())
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	known := lo.SliceToMap(tags, func(tag *ListTagResult) (string, bool) { return tag.Name, true })
+	if unknown, ok := lo.Find(req.Tags, func(name string) bool { return !known[name] }); ok {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("unknown tag %q", unknown)})
+		return
+	}
+
+	if err := svc.db.SetTagOrder(c.Request.Context(), req.Tags); err != nil {
+		tagError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"success": true})
+}
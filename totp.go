@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"image/png"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/pquerna/otp/totp"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	totpIssuer         = "nexa"
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+)
+
+// checkSecondFactor validates a TOTP code or consumes a recovery code of the user.
+func (svc *Service) checkSecondFactor(ctx context.Context, user *User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	if totp.Validate(code, user.TOTPSecret) {
+		return true, nil
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			// recovery codes can only be used once
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			if err := svc.db.SaveUser(ctx, user); err != nil {
+				return false, err
+			}
+			logrus.WithField("user", user.Name).Warn("recovery code used")
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func generateRecoveryCodes() (codes, hashes []string, err error) {
+	for range recoveryCodeCount {
+		buf := make([]byte, recoveryCodeLength)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf))[:recoveryCodeLength]
+		code := raw[:recoveryCodeLength/2] + "-" + raw[recoveryCodeLength/2:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// twoFactorUser 返回需要管理 2FA 的用户，仅密码登录模式支持 2FA
+func (svc *Service) twoFactorUser(c *gin.Context) (*User, bool) {
+	if !authConfig.Enabled || authConfig.ProxyHeader != "" {
+		c.JSON(400, gin.H{"error": "two-factor authentication requires password login"})
+		return nil, false
+	}
+
+	ctx := c.Request.Context()
+	name := c.GetString("user")
+	user, err := svc.db.GetUser(ctx, name)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		user = &User{Name: name}
+	} else if err != nil {
+		logrus.WithField("user", name).WithError(err).Error("get user error")
+		c.JSON(500, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return user, true
+}
+
+func (svc *Service) TwoFactorStatus(c *gin.Context) {
+	user, ok := svc.twoFactorUser(c)
+	if !ok {
+		return
+	}
+	c.JSON(200, gin.H{"enabled": user.TOTPEnabled, "recovery_codes_left": len(user.RecoveryCodes)})
+}
+
+// SetupTwoFactor 生成新的 TOTP 密钥，需要调用 VerifyTwoFactor 确认后才会生效
+func (svc *Service) SetupTwoFactor(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, ok := svc.twoFactorUser(c)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		c.JSON(409, gin.H{"error": "two-factor authentication already enabled"})
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: user.Name})
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	img, err := key.Image(256, 256)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	user.TOTPSecret = key.Secret()
+	if err := svc.db.SaveUser(ctx, user); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"secret":      key.Secret(),
+		"otpauth_url": key.URL(),
+		"qr":          "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr.Bytes()),
+	})
+}
+
+// VerifyTwoFactor 校验验证码并启用 2FA，返回一次性的恢复码
+func (svc *Service) VerifyTwoFactor(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, ok := svc.twoFactorUser(c)
+	if !ok {
+		return
+	}
+
+	req := new(struct {
+		Code string `json:"code"`
+	})
+	if err := c.BindJSON(req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		c.JSON(409, gin.H{"error": "two-factor setup not started"})
+		return
+	}
+	if !totp.Validate(strings.TrimSpace(req.Code), user.TOTPSecret) {
+		c.JSON(401, gin.H{"error": "invalid code"})
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	user.TOTPEnabled = true
+	user.RecoveryCodes = hashes
+	if err := svc.db.SaveUser(ctx, user); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	logrus.WithField("user", user.Name).Info("two-factor authentication enabled")
+	c.JSON(200, gin.H{"enabled": true, "recovery_codes": codes})
+}
+
+func (svc *Service) DisableTwoFactor(c *gin.Context) {
+	ctx := c.Request.Context()
+	user, ok := svc.twoFactorUser(c)
+	if !ok {
+		return
+	}
+
+	req := new(struct {
+		Code string `json:"code"`
+	})
+	if err := c.BindJSON(req); err != nil {
+		c.JSON(400, gin.H{"error": "invalid request"})
+		return
+	}
+	if !user.TOTPEnabled {
+		c.JSON(200, gin.H{"enabled": false})
+		return
+	}
+	if valid, err := svc.checkSecondFactor(ctx, user, req.Code); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	} else if !valid {
+		c.JSON(401, gin.H{"error": "invalid code"})
+		return
+	}
+
+	user.ResetTwoFactor()
+	if err := svc.db.SaveUser(ctx, user); err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	logrus.WithField("user", user.Name).Info("two-factor authentication disabled")
+	c.JSON(200, gin.H{"enabled": false})
+}
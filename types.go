@@ -7,23 +7,62 @@ import (
 type Feed struct {
 	ID string `gorm:"primaryKey" json:"id"`
 
-	Title         string   `yaml:"title" json:"title"`
+	Title         string   `yaml:"title" json:"title"`                   // CustomTitle when set, otherwise UpstreamTitle
+	CustomTitle   string   `yaml:"custom_title" json:"custom_title"`     // set by the user, kept across fetches
+	UpstreamTitle string   `yaml:"upstream_title" json:"upstream_title"` // as announced by the feed
 	Desc          string   `yaml:"desc" json:"desc"`
 	Link          string   `yaml:"link" json:"link"`
 	Tags          []string `gorm:"-" yaml:"tags" json:"tags"`
+	FolderID      string   `yaml:"folder_id" json:"folder_id"` // empty at the root
 	LastBuildDate *time.Time
 
 	Cron      string `yaml:"cron" json:"cron"`
 	Suspended bool   `yaml:"suspended" json:"suspended"`
 
+	// retention policy of the feed, 0 falls back to the global policy
+	RetentionMaxItems int `yaml:"retention_max_items" json:"retention_max_items"`
+	RetentionMaxDays  int `yaml:"retention_max_days" json:"retention_max_days"`
+
+	// enclosures of new items are downloaded when enabled, the oldest downloads
+	// are removed beyond the quota, 0 falls back to NEXA_DOWNLOAD_QUOTA_MB
+	DownloadEnclosures bool `yaml:"download_enclosures" json:"download_enclosures"`
+	DownloadQuotaMB    int  `yaml:"download_quota_mb" json:"download_quota_mb"`
+
+	// metadata of the upstream feed, updated on each fetch
+	SiteURL     string `yaml:"site_url" json:"site_url"`
+	Description string `yaml:"description" json:"description"` // unlike Desc, set by the user
+	Image       string `yaml:"image" json:"image"`
+	Language    string `yaml:"language" json:"language"`
+	Generator   string `yaml:"generator" json:"generator"`
+	Copyright   string `yaml:"copyright" json:"copyright"`
+
+	// favicon of the site cached under NEXA_ICON_DIR, served by /api/feed/:feed_id/icon
+	IconPath      string     `yaml:"-" json:"-"`
+	IconType      string     `yaml:"-" json:"-"`
+	IconUpdatedAt *time.Time `yaml:"-" json:"icon_updated_at,omitempty"` // nil when there is no icon
+	IconCheckedAt *time.Time `yaml:"-" json:"-"`
+
 	// Items []*Item `gorm:"foreignKey:FeedID" json:"items"`
 }
 
 func (feed *Feed) TableName() string { return "feeds" }
 
+// Folder groups feeds, folders nest through ParentID.
+type Folder struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	Name      string    `json:"name"`
+	ParentID  string    `json:"parent_id"` // empty at the root
+	Position  int       `json:"position"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (folder *Folder) TableName() string { return "folders" }
+
 type ListFeedResult struct {
 	*Feed
-	UnreadCount int `json:"unread_count"`
+	UnreadCount  int `json:"unread_count"`
+	StarredCount int `json:"starred_count"`
+	TotalCount   int `json:"total_count"`
 }
 
 type Item struct {
@@ -31,29 +70,220 @@ type Item struct {
 	FeedID    string `json:"feed_id"`
 	CreatedAt time.Time
 
-	Title       string     `json:"title"`
-	Content     string     `json:"content"`
-	Description string     `json:"description"`
-	Image       string     `json:"image"` // TODO: archive image to local disk
-	Link        string     `json:"link"`
-	GUID        string     `json:"guid"`
-	PubDate     *time.Time `json:"pub_date,omitempty"`
+	Title       string        `json:"title"`
+	Content     string        `json:"content"`
+	Description string        `json:"description"`
+	Image       string        `json:"image"` // TODO: archive image to local disk
+	Enclosures  []*Enclosure  `gorm:"-" json:"enclosures"`
+	Link        string        `json:"link"`
+	GUID        string        `json:"guid"`
+	Author      string        `json:"author"` // first author, see Authors
+	Authors     []*ItemAuthor `gorm:"-" json:"authors"`
+	Categories  []string      `gorm:"-" json:"categories"` // upstream categories, unlike labels
+	PubDate     *time.Time    `json:"pub_date,omitempty"`
+	UpdatedDate *time.Time    `json:"updated_date,omitempty"` // last upstream update, as announced by the feed
+
+	// near duplicates across feeds share a cluster, named after its first item
+	CanonicalLink string `json:"canonical_link"`
+	SimHash       int64  `json:"-"` // of title and text, 0 when too short to compare
+	ClusterID     string `json:"cluster_id"`
+
+	// podcast metadata from the iTunes extension
+	Duration    int    `json:"duration,omitempty"` // seconds
+	Episode     int    `json:"episode,omitempty"`
+	Season      int    `json:"season,omitempty"`
+	EpisodeType string `json:"episode_type,omitempty"` // full, trailer or bonus
 
 	// fields below should store within user info,
 	// but for now, there is only one user in the system.
-	Read    bool   `json:"read"`
-	Starred bool   `json:"starred"`
-	Liked   bool   `json:"liked"`
-	Tags    string `json:"tags"`
+	Read     bool     `json:"read"`
+	Starred  bool     `json:"starred"`
+	Liked    bool     `json:"liked"`
+	Labels   []string `gorm:"-" json:"labels"` // user labels of the item, unlike feed tags
+	Note     string   `json:"note"`
+	Position int      `json:"position"` // playback position of the enclosures, in seconds
+
+	InFeed bool `json:"-"` // listed by the upstream feed on the last fetch
 
 	// Feed *Feed `gorm:"references:ID" json:"feed"`
 }
 
 func (item *Item) TableName() string { return "items" }
 
+// Enclosure is a media file attached to an item, like a podcast episode,
+// from the RSS enclosure or from media RSS.
+type Enclosure struct {
+	ID       string `gorm:"primaryKey" json:"id"`
+	ItemID   string `gorm:"index" json:"item_id"`
+	FeedID   string `gorm:"index" json:"feed_id"`
+	Position int    `json:"-"` // order in the item
+	URL      string `json:"url"`
+	Type     string `json:"type"`
+	Length   int64  `json:"length"`             // bytes, as announced by the feed
+	Duration int    `json:"duration,omitempty"` // seconds, as announced by media RSS
+
+	// local copy, see NEXA_DOWNLOAD_DIR
+	Path         string     `json:"-"`
+	Size         int64      `json:"size,omitempty"`
+	DownloadedAt *time.Time `json:"downloaded_at,omitempty"`
+
+	StreamURL string    `gorm:"-" json:"stream_url,omitempty"` // signed, see signEnclosures
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (enclosure *Enclosure) TableName() string { return "enclosures" }
+
+type ItemLabel struct {
+	ItemID string `gorm:"primaryKey" json:"item_id"`
+	Name   string `gorm:"primaryKey" json:"name"`
+}
+
+func (label *ItemLabel) TableName() string { return "item_labels" }
+
+// ItemAuthor is an author of an item, as listed by the feed.
+type ItemAuthor struct {
+	ItemID   string `gorm:"primaryKey" json:"-"`
+	Position int    `gorm:"primaryKey;autoIncrement:false" json:"-"`
+	Name     string `gorm:"index" json:"name"` // the email when the feed gives no name
+	Email    string `json:"email,omitempty"`
+}
+
+func (author *ItemAuthor) TableName() string { return "item_authors" }
+
+// ItemCategory is a category of an item, as listed by the feed.
+type ItemCategory struct {
+	ItemID string `gorm:"primaryKey" json:"item_id"`
+	Name   string `gorm:"primaryKey;index" json:"name"`
+}
+
+func (category *ItemCategory) TableName() string { return "item_categories" }
+
+// Highlight is a passage of an item, anchored like a W3C Web Annotation by a
+// TextQuoteSelector (Quote with Prefix/Suffix context) and a TextPositionSelector
+// (Start/End rune offsets in the plain text of the item, a hint to find the quote again).
+type Highlight struct {
+	ID        string    `gorm:"primaryKey" json:"id"`
+	ItemID    string    `gorm:"index" json:"item_id"`
+	Quote     string    `json:"quote"`
+	Prefix    string    `json:"prefix"`
+	Suffix    string    `json:"suffix"`
+	Start     int       `json:"start"`
+	End       int       `json:"end"`
+	Comment   string    `json:"comment"`
+	Orphaned  bool      `json:"orphaned"` // the quote is no longer in the item
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (highlight *Highlight) TableName() string { return "highlights" }
+
+// Rule runs its actions on the new items of the feeds in its scope matching its conditions.
+type Rule struct {
+	ID       string `gorm:"primaryKey" json:"id"`
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Position int    `json:"position"` // evaluation order, ascending
+
+	// scope, empty for all feeds
+	FeedIDs []string `gorm:"serializer:json" json:"feed_ids"`
+	Tags    []string `gorm:"serializer:json" json:"tags"`
+
+	Match      string          `json:"match"` // "all" (default) or "any" of the conditions
+	Conditions []RuleCondition `gorm:"serializer:json" json:"conditions"`
+	Actions    []RuleAction    `gorm:"serializer:json" json:"actions"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (rule *Rule) TableName() string { return "rules" }
+
+type RuleCondition struct {
+	Field string `json:"field"` // title, content, author, link or age
+	Op    string `json:"op"`    // contains, not_contains, matches, not_matches; older_than, newer_than for age
+	Value string `json:"value"` // keyword, regexp, or duration like 12h or 7d
+}
+
+type RuleAction struct {
+	Type  string `json:"type"`            // read, star, like, label, skip, delete or webhook
+	Value string `json:"value,omitempty"` // label name or webhook url
+}
+
+// SmartFeed is a saved item filter, listed and read like a feed.
+type SmartFeed struct {
+	ID       string `gorm:"primaryKey" json:"id"`
+	Name     string `json:"name"`
+	Position int    `json:"position"`
+
+	FeedIDs []string `gorm:"serializer:json" json:"feed_ids"`
+	Tags    []string `gorm:"serializer:json" json:"tags"`
+	Labels  []string `gorm:"serializer:json" json:"labels"`
+	Query   string   `json:"query"`
+	Unread  bool     `json:"unread"`
+	Starred bool     `json:"starred"`
+	Liked   bool     `json:"liked"`
+	Days    int      `json:"days"` // only items published in the last N days, 0 for no limit
+	Sort    ItemSort `json:"sort"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (feed *SmartFeed) TableName() string { return "smart_feeds" }
+
+// OutputFeed republishes the items of a filter as RSS, Atom or JSON Feed,
+// readable by anyone knowing its token.
+type OutputFeed struct {
+	ID    string `gorm:"primaryKey" json:"id"`
+	Name  string `json:"name"`
+	Token string `gorm:"uniqueIndex" json:"token"`
+
+	SmartFeedID string   `json:"smart_feed_id"` // starts from the filter of the smart feed
+	FeedIDs     []string `gorm:"serializer:json" json:"feed_ids"`
+	Tags        []string `gorm:"serializer:json" json:"tags"`
+	Labels      []string `gorm:"serializer:json" json:"labels"`
+	Query       string   `json:"query"`
+	Starred     bool     `json:"starred"`
+	Liked       bool     `json:"liked"`
+	Days        int      `json:"days"`
+	Limit       int      `json:"limit"` // number of items published
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (feed *OutputFeed) TableName() string { return "output_feeds" }
+
 type Tag struct {
 	FeedID string `gorm:"primaryKey" json:"feed_id"`
 	Name   string `gorm:"primaryKey" json:"name"`
 }
 
 func (tag *Tag) TableName() string { return "tags" }
+
+// TagSetting holds the display settings of a tag, shared by all feeds with the tag.
+type TagSetting struct {
+	Name     string `gorm:"primaryKey" json:"name"`
+	Position int    `json:"position"` // display order, ascending
+	Color    string `json:"color"`    // #rrggbb, empty for the default color
+}
+
+func (setting *TagSetting) TableName() string { return "tag_settings" }
+
+type User struct {
+	Name      string    `gorm:"primaryKey" json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// TOTPSecret is set by the setup step, it only takes effect once TOTPEnabled is set by verification.
+	TOTPSecret    string   `json:"-"`
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	RecoveryCodes []string `gorm:"serializer:json" json:"-"` // sha256 of unused recovery codes
+}
+
+func (user *User) TableName() string { return "users" }
+
+func (user *User) ResetTwoFactor() {
+	user.TOTPSecret = ""
+	user.TOTPEnabled = false
+	user.RecoveryCodes = nil
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"regexp"
 	"strings"
 )
@@ -34,9 +36,24 @@ func getPageFromOffset(offset, limit *int) int {
 	return (*offset / *limit) + 1
 }
 
-func getPageSize(limit *int) int {
-	if limit == nil {
-		return 10
+// encodeCursor returns the opaque cursor pointing after item in the given order.
+func encodeCursor(item *Item, sort ItemSort) string {
+	cursor := &ItemCursor{Sort: sort, Time: item.CreatedAt, ID: item.ID}
+	if sort != SortCreatedAt && item.PubDate != nil {
+		cursor.Time = *item.PubDate
 	}
-	return *limit
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (*ItemCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	cursor := new(ItemCursor)
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, err
+	}
+	return cursor, nil
 }